@@ -22,10 +22,13 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	util "github.com/DITAS-Project/TUBUtil"
+	"github.com/DITAS-Project/VDC-Logging-Agent/message"
 	"github.com/olivere/elastic"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -62,8 +65,42 @@ type Configuration struct {
 	ElasticUser      string
 	ElasticPassword  string
 
-	waitTime time.Duration //the duration for which the server gracefully wait for existing connections to finish in secounds
+	Kafka       KafkaConfig       //publishes documents and spans to kafka, alongside elastic search or instead of it with IgnoreElastic
+	Loki        LokiConfig        //pushes logs to grafana loki
+	HTTPSinks   []HTTPSinkConfig  //send batches of documents to any http endpoint
+	InfluxDB    InfluxDBConfig    //writes numeric meters to influxdb
+	RemoteWrite RemoteWriteConfig //writes numeric meters to a prometheus remote write endpoint
 
+	Redaction  RedactionConfig   //rules to remove sensitive data before it is persisted
+	Processors []ProcessorConfig //ordered processing steps applied to each document before it is persisted
+
+	Metadata      MetadataConfig //information about the origin that is added to every document and span
+	BlueprintID   string         //id of the blueprint of the VDC
+	BlueprintPath string         //blueprint file the id is read from if BlueprintID is not set
+
+	Tail   TailConfig   //local log files that are forwarded like messages sent to /v1/log
+	Syslog SyslogConfig //syslog listeners that are forwarded like messages sent to /v1/log
+
+	ProcessMetrics ProcessMetricsConfig //resource usage of the VDC processes that is stored as meters
+
+	StreamBuffer  int      //number of events buffered per stream subscriber before it is disconnected
+	StreamOrigins []string //origins of other sites whose pages may open websocket streams, * allows all
+
+	Alerting AlertingConfig //alert rules evaluated on incoming data
+
+	SpanMetrics SpanMetricsConfig //request metrics derived from the traced spans
+	Sampling    SamplingConfig    //which traces are exported to zipkin
+
+	MultiTenant MultiTenantConfig //serve several VDCs with one agent
+
+	Build string //build of the agent, set by main
+
+	Testing     bool //api testing mode, nothing is sent to elastic search or zipkin
+	CaptureSize int  //number of documents and spans kept for /v1/_debug in testing mode (default 1000)
+	Tracing     bool //if tracing should be loaded or not
+	Verbose     bool //debug logging
+
+	WaitTime time.Duration //the duration for which the server gracefully wait for existing connections to finish (default 15s)
 }
 type Agent struct {
 	name        string
@@ -72,20 +109,41 @@ type Agent struct {
 	elastic     *elastic.Client
 	isDebugging bool
 	tracing     bool //if tracing should be loaded or not
+	redactor    *redactor
+	pipeline    pipeline
+	meta        *Metadata
+	tailer      *tailer
+	syslog      *syslogServer
+	processes   *processCollector
+	stream      *broadcaster
+	alerts      *alertManager
+	metrics     *spanMetrics
+	sampler     *sampler
+	endpoint    string
+	spanConfig  SpanMetricsConfig
+	tracer      opentracing.Tracer //tracer of the VDC, the global tracer is used if not set
+	tenants     *tenantRegistry    //only set in multi VDC mode
+	limits      *tenantLimits
+	cnf         Configuration      //the active configuration
+	locks       *reloadLocks
+	retired     []zipkin.Collector //replaced collectors that may still receive open spans
+	hangup      chan os.Signal
+	testing     bool
+	capture     *capture //what would have been sent, only set in testing mode
+	sinks       []sink   //outputs besides elastic search and zipkin
+	lifecycle   *lifecycle
 }
 
 func NewAgent() (*Agent, error) {
 	rand.Seed(time.Now().UTC().UnixNano())
-	err := viper.ReadInConfig()
-	cnf := Configuration{}
+	cnf, err := LoadConfiguration()
 	if err != nil {
-		log.Error("failed to load config", err)
+		log.Error("failed to load config ", err)
 		return nil, err
 	}
-	viper.Unmarshal(&cnf)
 
 	log.Infof("config file used @ %v", viper.ConfigFileUsed())
-	if viper.GetBool("verbose") {
+	if cnf.Verbose {
 		viper.Debug()
 	}
 
@@ -96,11 +154,27 @@ func CreateAgent(cnf Configuration) (*Agent, error) {
 	var ctx = Agent{
 		name:        cnf.VDCName,
 		spans:       make(map[string]opentracing.Span),
-		isDebugging: viper.GetBool("verbose"),
-		tracing:     viper.GetBool("tracing"),
+		isDebugging: cnf.Verbose,
+		tracing:     cnf.Tracing,
+		testing:     cnf.Testing,
+		stream:      newBroadcaster(cnf.StreamBuffer),
+		endpoint:    cnf.Endpoint,
+		spanConfig:  cnf.SpanMetrics,
+		cnf:         cnf,
+		locks:       &reloadLocks{},
+		lifecycle:   &lifecycle{},
 	}
 
-	if !viper.GetBool("testing") && viper.GetBool("tracing") {
+	if !cnf.Testing {
+		sinks, err := newSinks(cnf, ctx.lifecycle)
+		if err != nil {
+			log.Errorf("unable to create sinks: %+v\n", err)
+			return nil, err
+		}
+		ctx.sinks = sinks
+	}
+
+	if !cnf.Testing && cnf.Tracing {
 		// Create our HTTP collector.
 		collector, err := zipkin.NewHTTPCollector(cnf.ZipkinEndpoint)
 
@@ -108,60 +182,134 @@ func CreateAgent(cnf Configuration) (*Agent, error) {
 			log.Errorf("unable to create Zipkin HTTP collector: %+v\n", err)
 			return nil, err
 		}
+		collector = ctx.withSinks(collector)
 
-		// Create our recorder.
-		recorder := zipkin.NewRecorder(collector, viper.GetBool("verbose"), cnf.Endpoint, "vdc-agent")
+		if cnf.Sampling.DecisionWait > 0 {
+			collector = newTailCollector(cnf.Sampling, collector)
+		}
 
-		tracer, err := zipkin.NewTracer(recorder,
-			zipkin.WithLogger(zipkin.LoggerFunc(func(kv ...interface{}) error {
-				log.Info(kv)
-				return nil
-			})),
-			zipkin.DebugMode(viper.GetBool("verbose")),
-			zipkin.DebugAssertUseAfterFinish(viper.GetBool("verbose")),
-			zipkin.DebugAssertUseAfterFinish(viper.GetBool("verbose")),
-		)
+		tracer, err := newTracer(collector, cnf.Verbose, cnf.Endpoint, "vdc-agent")
 
 		if err != nil {
 			log.Errorf("unable to create Zipkin tracer: %+v\n", err)
 			return nil, err
 		}
 
-		opentracing.InitGlobalTracer(tracer)
 		ctx.collector = collector
+		ctx.tracer = tracer
+	}
+
+	if cnf.Testing {
+		ctx.capture = newCapture(cnf.CaptureSize)
+
+		if cnf.Tracing {
+			tracer, err := newTracer(ctx.capture, cnf.Verbose, cnf.Endpoint, "vdc-agent")
+			if err != nil {
+				log.Errorf("unable to create tracer: %+v\n", err)
+				return nil, err
+			}
+			ctx.collector = ctx.capture
+			ctx.tracer = tracer
+		}
+	}
+
+	sampler, err := newSampler(cnf.Sampling)
+	if err != nil {
+		log.Errorf("unable to create sampling: %+v\n", err)
+		return nil, err
+	}
+	ctx.sampler = sampler
+
+	if len(cnf.Redaction.Rules) > 0 || len(cnf.Redaction.Detectors) > 0 {
+		redactor, err := newRedactor(cnf.Redaction)
+		if err != nil {
+			log.Errorf("unable to create redaction rules: %+v\n", err)
+			return nil, err
+		}
+		ctx.redactor = redactor
+	}
+
+	processors, err := newPipeline(cnf, cnf.Processors)
+	if err != nil {
+		log.Errorf("unable to create processing pipeline: %+v\n", err)
+		return nil, err
+	}
+	ctx.pipeline = processors
+	ctx.meta = collectMetadata(cnf)
+
+	if len(cnf.Tail.Paths) > 0 {
+		tailer, err := newTailer(cnf.Tail, ctx.addLog)
+		if err != nil {
+			log.Errorf("unable to follow log files: %+v\n", err)
+			return nil, err
+		}
+		ctx.tailer = tailer
+	}
+
+	if cnf.Syslog.UDP != "" || cnf.Syslog.TCP != "" || cnf.Syslog.TLS != "" {
+		server, err := newSyslogServer(cnf.Syslog, ctx.addLog)
+		if err != nil {
+			log.Errorf("unable to start syslog listeners: %+v\n", err)
+			return nil, err
+		}
+		ctx.syslog = server
+	}
+
+	if cnf.ProcessMetrics.Interval > 0 {
+		collector, err := newProcessCollector(cnf.ProcessMetrics, func(data ElasticData) {
+			ctx.AddToES(data)
+		})
+		if err != nil {
+			log.Errorf("unable to collect process metrics: %+v\n", err)
+			return nil, err
+		}
+		ctx.processes = collector
+	}
+
+	if cnf.MultiTenant.Enabled {
+		tenants, err := newTenantRegistry(cnf.MultiTenant, cnf.VDCName)
+		if err != nil {
+			log.Errorf("unable to create tenants: %+v\n", err)
+			return nil, err
+		}
+		ctx.tenants = tenants
+		ctx.limits = newTenantLimits(cnf.MultiTenant, tenants.settings[cnf.VDCName])
+	}
+
+	ctx.metrics = newSpanMetrics(cnf.SpanMetrics, func(data ElasticData) {
+		ctx.AddToES(data)
+	})
+
+	if len(cnf.Alerting.Meters) > 0 || len(cnf.Alerting.Logs) > 0 {
+		alerts, err := newAlertManager(cnf.Alerting, func(data ElasticData) {
+			ctx.AddToES(data)
+		})
+		if err != nil {
+			log.Errorf("unable to create alert rules: %+v\n", err)
+			return nil, err
+		}
+		alerts.vdc = cnf.VDCName
+		ctx.alerts = alerts
 	}
 
 	util.SetLogger(logger)
 	util.SetLog(log)
 
-	if !viper.GetBool("testing") {
+	if !cnf.Testing {
 		if !cnf.IgnoreElastic {
-			var client *elastic.Client
-			var err error
 			if cnf.ElasticBasicAuth {
 				util.WaitForAvailibleWithAuth(cnf.ElasticSearchURL, []string{cnf.ElasticUser, cnf.ElasticPassword}, nil)
-				client, err = elastic.NewSimpleClient(
-					elastic.SetURL(cnf.ElasticSearchURL),
-					elastic.SetSniff(false),
-					elastic.SetErrorLog(log),
-					elastic.SetInfoLog(log),
-					elastic.SetBasicAuth(cnf.ElasticUser, cnf.ElasticPassword),
-				)
 			} else {
 				util.WaitForAvailible(cnf.ElasticSearchURL, nil)
-				client, err = elastic.NewSimpleClient(
-					elastic.SetURL(cnf.ElasticSearchURL),
-					elastic.SetSniff(false),
-					elastic.SetErrorLog(log),
-					elastic.SetInfoLog(log),
-				)
 			}
 
+			client, err := newElasticClient(cnf)
 			if err != nil {
 				log.Errorf("unable to create elastic client tracer: %+v\n", err)
 				return nil, err
 			}
 			ctx.elastic = client
+			ctx.initIndex()
 		} else {
 			log.Warn("ignoring elastic")
 		}
@@ -169,49 +317,153 @@ func CreateAgent(cnf Configuration) (*Agent, error) {
 		log.Warn("running in testing mode")
 	}
 
-	return &ctx, nil
-}
+	if ctx.tailer != nil {
+		ctx.tailer.start()
+	}
 
-func (agent *Agent) Shutdown() {
-	if agent.collector != nil {
-		agent.collector.Close()
+	if ctx.syslog != nil {
+		ctx.syslog.start()
 	}
 
-	if agent.elastic != nil {
-		agent.elastic.Stop()
+	if ctx.processes != nil {
+		ctx.processes.start()
 	}
+
+	if ctx.alerts != nil {
+		ctx.alerts.start()
+	}
+
+	ctx.metrics.start()
+
+	return &ctx, nil
 }
 
-type TraceMessage struct {
-	TraceId      string `json:"traceId"`
-	ParentSpanId string `json:"parentSpanId"`
-	SpanId       string `json:"spanId"`
-	Operation    string `json:"operation"`
-	Message      string `json:"message"`
+// Shutdown stops the agent in order: the api server stops accepting requests and waits for open ones,
+// the inputs are stopped, open spans are finished with a shutdown tag and exported, and pending writes
+// to elastic search are awaited. Everything has to finish before the context ends, data that could not
+// be delivered is reported in the returned error. Only the first call has an effect.
+func (agent *Agent) Shutdown(ctx context.Context) error {
+	var err error
+	agent.lifecycle.shutdown.Do(func() {
+		err = agent.stop(ctx)
+	})
+	return err
 }
 
-type ElasticData struct {
-	Timestamp time.Time     `json:"@timestamp"`
-	Meter     *MeterMessage `json:"meter,omitempty"`
-	Log       *LogMessage   `json:"log,omitempty"`
+func (agent *Agent) stop(ctx context.Context) error {
+	var problems []string
+
+	//streams never end on their own, the server would wait for them until the context is done
+	if agent.stream != nil {
+		agent.stream.close()
+	}
+
+	if err := agent.lifecycle.stopServer(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("open requests were aborted: %s", err))
+	}
+	agent.lifecycle.stopping()
+
+	if agent.tailer != nil {
+		agent.tailer.shutdown()
+	}
+
+	if agent.syslog != nil {
+		agent.syslog.shutdown()
+	}
+
+	if agent.processes != nil {
+		agent.processes.shutdown()
+	}
+
+	if agent.metrics != nil {
+		agent.metrics.shutdown()
+	}
+
+	if agent.tenants != nil {
+		agent.tenants.shutdown()
+	}
+
+	if agent.alerts != nil {
+		agent.alerts.shutdown()
+	}
+
+	retired := agent.stopWatching()
+
+	if spans := agent.finishOpenSpans(); spans > 0 {
+		log.Infof("finished %d open spans", spans)
+	}
+
+	backends := agent.backends()
+	for _, collector := range append(retired, backends.collector) {
+		if collector != nil {
+			if err := collector.Close(); err != nil {
+				problems = append(problems, fmt.Sprintf("spans could not be exported: %s", err))
+			}
+		}
+	}
+
+	pending, failed := agent.lifecycle.wait(ctx)
+	if pending > 0 {
+		problems = append(problems, fmt.Sprintf("%d documents were still being written to elastic search or the sinks", pending))
+	}
+	if failed > 0 {
+		problems = append(problems, fmt.Sprintf("%d documents could not be written to elastic search or the sinks", failed))
+	}
+
+	for _, sink := range agent.sinks {
+		if err := sink.close(); err != nil {
+			problems = append(problems, fmt.Sprintf("sink could not be closed: %s", err))
+		}
+	}
+
+	if backends.elastic != nil {
+		backends.elastic.Stop()
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("not all data was delivered: %s", strings.Join(problems, ", "))
+	}
+	return nil
 }
 
-type MeterMessage struct {
-	Timestamp   time.Time   `json:"timestamp,omitempty"`
-	OperationID string      `json:"operationID,omitempty"`
-	Value       interface{} `json:"value,omitempty"`
-	Unit        string      `json:"unit,omitempty"`
-	Name        string      `json:"name,omitempty"`
-	Raw         string      `json:"appendix,omitempty"`
+// finishOpenSpans finishes the spans of the agent and all VDCs it serves that were never closed,
+// it must only be called once no requests are handled anymore
+func (agent *Agent) finishOpenSpans() int {
+	children, unlock := agent.lockChildren()
+	defer unlock()
+
+	finished := 0
+	for _, target := range append(children, agent) {
+		for key, span := range target.spans {
+			span.SetTag("shutdown", true)
+			span.Finish()
+			delete(target.spans, key)
+			finished++
+		}
+	}
+	return finished
 }
 
-type LogMessage struct {
-	Timestamp time.Time `json:"timestamp,omitempty"`
-	Value     string    `json:"value,omitempty"`
+// the messages of the api are shared with the client
+type (
+	TraceMessage = message.TraceMessage
+	MeterMessage = message.MeterMessage
+	LogMessage   = message.LogMessage
+	SyslogFields = message.SyslogFields
+)
+
+type ElasticData struct {
+	ID        string                 `json:"id,omitempty"` //unique id, orders documents with the same timestamp
+	Timestamp time.Time              `json:"@timestamp"`
+	Meter     *MeterMessage          `json:"meter,omitempty"`
+	Log       *LogMessage            `json:"log,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"` //custom fields added by the processing pipeline
+	Meta      *Metadata              `json:"meta,omitempty"`
+	Alert     *AlertMessage          `json:"alert,omitempty"`
 }
 
 //tracing functions
-func (t TraceMessage) build() *zipkin.SpanContext {
+func buildSpanContext(t TraceMessage) *zipkin.SpanContext {
 	var pid *uint64
 	var sid uint64
 	ppid, err := strconv.ParseUint(t.ParentSpanId, 16, 64)
@@ -249,46 +501,80 @@ func (t TraceMessage) build() *zipkin.SpanContext {
 	return &context
 }
 
-func (agent *Agent) InitES() error {
-	ctx := context.Background()
-	mappings := `
+// elasticMapping is the mapping of the documents, meter values are numeric so they can be aggregated,
+// other values are kept in the source but not indexed
+const elasticMapping = `{
+	"properties": {
+		"id": {
+			"type": "keyword"
+		},
+		"@timestamp": {
+			"type": "date"
+		},
+		"meter": {
 			"properties": {
-				"@timestamp": {
+				"timestamp": {
 					"type": "date"
 				},
-				"meter": {
-					"properties": {
-						"meter.timestamp": {
-							"type": "date"
-						},
-						"meter.unit": {
-							"type": "text"
-						},
-						"meter.value": {
-							"type": "text"
-						}
-						"meter.name": {
-							"type": "text"
-						},
-						"meter.appendix": {
-							"type": "text"
-						},
-						"meter.operationID": {
-							"type": "keyword"
-						}
-					}
+				"unit": {
+					"type": "text"
 				},
-				"log": {
-					"properties": {
-						"log.value": {
-							"type": "text"
-						}
-					}
+				"value": {
+					"type": "double",
+					"ignore_malformed": true
+				},
+				"name": {
+					"type": "text"
+				},
+				"appendix": {
+					"type": "text"
+				},
+				"operationID": {
+					"type": "keyword"
+				}
+			}
+		},
+		"log": {
+			"properties": {
+				"value": {
+					"type": "text"
 				}
 			}
-		`
+		}
+	}
+}`
+
+// initIndex creates the index of the VDC with the mapping of the agent. Failures are only logged,
+// documents are still stored with a dynamic mapping but meters may not be aggregated.
+func (agent *Agent) initIndex() {
+	if agent.elastic == nil {
+		return
+	}
+	if err := agent.InitES(); err != nil {
+		log.Errorf("could not create the mapping of index %s, meters may not be aggregated %+v", agent.getElasticIndex(), err)
+	}
+}
+
+// InitES installs the mapping of the agent: as a template for the daily indices of the VDC that are
+// created later on and on the index of today, which is created if it does not exist yet.
+func (agent *Agent) InitES() error {
+	ctx := context.Background()
 
 	if agent.elastic != nil {
+		template := fmt.Sprintf(`{
+			"index_patterns": ["%s-*"],
+			"settings": {
+				"number_of_shards": 1,
+				"number_of_replicas": 0
+			},
+			"mappings": {
+				"data": %s
+			}
+		}`, agent.name, elasticMapping)
+
+		if _, err := agent.elastic.IndexPutTemplate(agent.name).BodyString(template).Do(ctx); err != nil {
+			return err
+		}
 
 		if ok, err := agent.elastic.IndexExists(agent.getElasticIndex()).Do(ctx); !ok || err != nil {
 			log.Infof("creating inxex %s", agent.getElasticIndex())
@@ -299,11 +585,9 @@ func (agent *Agent) InitES() error {
 				"number_of_replicas": 0
 			},
 			"mappings": {
-				"data": {
-					%s
-				}
+				"data": %s
 			}
-		}`, mappings)
+		}`, elasticMapping)
 
 			_, err := agent.elastic.CreateIndex(agent.getElasticIndex()).BodyString(index).Do(ctx)
 			if err != nil {
@@ -316,7 +600,7 @@ func (agent *Agent) InitES() error {
 			_, err := agent.elastic.PutMapping().
 				Index(agent.getElasticIndex()).
 				Type("data").
-				BodyString(fmt.Sprintf("{%s},", mappings)).
+				BodyString(elasticMapping).
 				Do(ctx)
 			if err != nil {
 				return err
@@ -340,16 +624,24 @@ func (agent *Agent) getSpan(trace TraceMessage) opentracing.Span {
 	}
 
 	log.Infof("building trace %s", trace.SpanId)
-	var context = trace.build()
+	var context = buildSpanContext(trace)
+
+	options := []opentracing.StartSpanOption{}
+	if agent.meta != nil {
+		options = append(options, agent.meta.tags())
+	}
 
 	if context != nil {
-		span := opentracing.StartSpan(trace.Operation, ext.RPCServerOption(*context))
+		if sampler := agent.backends().sampler; sampler != nil {
+			context.Sampled = sampler.sample(trace.Operation, context.TraceID, time.Now())
+		}
+		span := agent.startSpan(trace.Operation, append(options, ext.RPCServerOption(*context))...)
 		agent.spans[trace.TraceId+trace.SpanId] = span
 		log.Infof("trace %s build", trace.SpanId)
 		return span
 	}
 
-	return opentracing.StartSpan(trace.Operation)
+	return agent.startSpan(trace.Operation, options...)
 
 }
 
@@ -358,19 +650,50 @@ func (agent *Agent) freeSpan(trace TraceMessage) {
 }
 
 func (agent *Agent) AddToES(data ElasticData) error {
-	if viper.GetBool("testing") {
+	backends := agent.backends()
+	if backends.redactor != nil {
+		backends.redactor.applyData(&data)
+	}
+
+	if !backends.pipeline.run(&data) {
+		log.Debugf("document dropped by processing pipeline %+v", data)
+		return nil
+	}
+
+	if agent.meta != nil {
+		data.Meta = agent.meta
+	}
+	if data.ID == "" {
+		data.ID = fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+	}
+
+	agent.publishData(data)
+
+	if agent.alerts != nil {
+		agent.alerts.observe(data)
+	}
+
+	if agent.testing {
 		log.Infof("testing only will not use elastic serach %+v", data)
+		agent.capture.addDocument(agent.name, agent.getElasticIndex(), data)
 		return nil
 	}
 
-	if agent.elastic != nil {
+	for _, sink := range agent.sinks {
+		sink.document(agent.name, data)
+	}
+
+	if backends.elastic != nil {
 		ctx := context.Background()
-		if _, err := agent.elastic.Index().
+		agent.lifecycle.begin()
+		_, err := backends.elastic.Index().
 			Index(agent.getElasticIndex()).
 			Type("data").
 			BodyJson(data).
-			Do(ctx); err != nil {
+			Do(ctx)
+		agent.lifecycle.end(err)
 
+		if err != nil {
 			log.Errorf("could not write to elastic serach :%+v\n", err)
 			return err
 		}
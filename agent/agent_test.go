@@ -19,24 +19,33 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
-	util "github.com/DITAS-Project/TUBUtil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
+	"github.com/DITAS-Project/VDC-Logging-Agent/agenttest"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
 )
 
 func TestTracingMethods(t *testing.T) {
-	agent := Agent{
-		name:        "test",
-		spans:       make(map[string]opentracing.Span),
-		collector:   nil,
-		elastic:     nil,
-		isDebugging: true,
+	fake := agenttest.NewZipkin()
+	defer fake.Close()
+
+	agent, err := CreateAgent(Configuration{VDCName: "test", Testing: true, Tracing: true, Verbose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+
+	if agent.collector, err = zipkin.NewHTTPCollector(fake.Endpoint(), zipkin.HTTPBatchSize(1)); err != nil {
+		t.Fatal(err)
+	}
+	if agent.tracer, err = newTracer(agent.collector, true, "", "vdc-agent"); err != nil {
+		t.Fatal(err)
 	}
 
 	var trace = TraceMessage{
@@ -81,6 +90,14 @@ func TestTracingMethods(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
+
+	spans := fake.WaitForSpans(2, 5*time.Second)
+	if len(spans) != 2 || spans[0].Name != "test" || spans[1].Name != "mysql-query" {
+		t.Fatalf("expected both spans to reach zipkin but got %+v", spans)
+	}
+	if spans[1].TraceID != "5e27c67030932221" || len(spans[1].Annotations) == 0 {
+		t.Errorf("expected the span to continue the trace with the message logged %+v", spans[1])
+	}
 }
 
 func TestTraceMessages(t *testing.T) {
@@ -169,25 +186,17 @@ func TestLogMessages(t *testing.T) {
 }
 
 func TestElastic(t *testing.T) {
-	ElasticSearchURL := "http://localhost:9200"
+	fake := agenttest.NewElastic()
+	defer fake.Close()
 	vdcName := "test-client"
 
-	t.Logf("Waiting for ElasticSearch")
-	var timeout time.Duration = 60000
-	err := util.WaitForAvailible(ElasticSearchURL, &timeout)
-	if err != nil{
-		t.Logf("elastic search unavailible: %+v\n", err)
-		t.SkipNow()
-	}
-
 	agt, err := CreateAgent(Configuration{
 		VDCName:          vdcName,
-		ElasticSearchURL: ElasticSearchURL,
+		ElasticSearchURL: fake.URL,
 	})
 
 	if err != nil {
-		t.Logf("could not start agent %+v", err)
-		t.Fail()
+		t.Fatalf("could not start agent %+v", err)
 	}
 
 
@@ -205,4 +214,9 @@ func TestElastic(t *testing.T) {
 		t.Fail()
 	}
 
+	documents := fake.Documents(vdcName)
+	if len(documents) != 1 || field(documents[0].Source, "meter.value") != "123456sadfghj" {
+		t.Errorf("expected the meter to be stored but got %+v", documents)
+	}
+
 }
\ No newline at end of file
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	defaultMaxBuckets = 100
+	maxBucketLimit    = 10000 //upper bound of the buckets parameter, larger aggregations overload elastic search
+)
+
+// intervals that are considered by the automatic interval selection, with their elastic search notation
+var intervals = []struct {
+	duration time.Duration
+	name     string
+}{
+	{time.Second, "1s"},
+	{5 * time.Second, "5s"},
+	{10 * time.Second, "10s"},
+	{30 * time.Second, "30s"},
+	{time.Minute, "1m"},
+	{5 * time.Minute, "5m"},
+	{10 * time.Minute, "10m"},
+	{30 * time.Minute, "30m"},
+	{time.Hour, "1h"},
+	{3 * time.Hour, "3h"},
+	{6 * time.Hour, "6h"},
+	{12 * time.Hour, "12h"},
+	{24 * time.Hour, "1d"},
+	{7 * 24 * time.Hour, "7d"},
+}
+
+type AggregateResult struct {
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Interval string            `json:"interval"`
+	Buckets  []AggregateBucket `json:"buckets"`
+}
+
+type AggregateBucket struct {
+	Timestamp   time.Time          `json:"timestamp"`
+	Count       int64              `json:"count"`
+	Min         *float64           `json:"min,omitempty"`
+	Max         *float64           `json:"max,omitempty"`
+	Avg         *float64           `json:"avg,omitempty"`
+	Sum         *float64           `json:"sum,omitempty"`
+	Rate        float64            `json:"rate"`      //sum of the values per second
+	CountRate   float64            `json:"countRate"` //number of meters per second
+	Percentiles map[string]float64 `json:"percentiles,omitempty"`
+}
+
+// AggregateMeter returns bucketed statistics of the stored meters of the VDC
+func (agent *Agent) AggregateMeter(w http.ResponseWriter, req *http.Request) {
+	client := agent.backends().elastic
+	if client == nil {
+		writeError(w, http.StatusServiceUnavailable, "no elastic search available")
+		return
+	}
+
+	params := req.URL.Query()
+	result := AggregateResult{To: time.Now().UTC()}
+
+	var err error
+	if to := params.Get("to"); to != "" {
+		if result.To, err = time.Parse(time.RFC3339, to); err != nil {
+			writeError(w, http.StatusBadRequest, "to must be a RFC 3339 timestamp")
+			return
+		}
+	}
+
+	result.From = result.To.Add(-time.Hour)
+	if from := params.Get("from"); from != "" {
+		if result.From, err = time.Parse(time.RFC3339, from); err != nil {
+			writeError(w, http.StatusBadRequest, "from must be a RFC 3339 timestamp")
+			return
+		}
+	}
+
+	if !result.From.Before(result.To) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	maxBuckets := defaultMaxBuckets
+	if value := params.Get("buckets"); value != "" {
+		if maxBuckets, err = strconv.Atoi(value); err != nil || maxBuckets <= 0 || maxBuckets > maxBucketLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("buckets must be a number between 1 and %d", maxBucketLimit))
+			return
+		}
+	}
+
+	var interval time.Duration
+	result.Interval = params.Get("interval")
+	if result.Interval == "" {
+		interval, result.Interval = selectInterval(result.To.Sub(result.From), maxBuckets)
+	} else if interval, err = parseInterval(result.Interval); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	//an explicit interval, or the coarsest one for very long ranges, must not exceed the buckets either
+	if result.To.Sub(result.From)/interval >= time.Duration(maxBuckets) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("interval %s results in more than %d buckets, use a larger interval, a shorter range or raise buckets", result.Interval, maxBuckets))
+		return
+	}
+
+	percents := []float64{50, 90, 95, 99}
+	if value := params.Get("percentiles"); value != "" {
+		percents = nil
+		for _, part := range strings.Split(value, ",") {
+			percent, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || percent < 0 || percent > 100 {
+				writeError(w, http.StatusBadRequest, "percentiles must be numbers between 0 and 100")
+				return
+			}
+			percents = append(percents, percent)
+		}
+	}
+
+	query := meterQuery(params).Filter(elastic.NewRangeQuery("@timestamp").Gte(result.From).Lte(result.To))
+
+	histogram := elastic.NewDateHistogramAggregation().
+		Field("@timestamp").
+		Interval(result.Interval).
+		MinDocCount(0).
+		ExtendedBounds(result.From, result.To).
+		SubAggregation("stats", elastic.NewStatsAggregation().Field("meter.value")).
+		SubAggregation("percentiles", elastic.NewPercentilesAggregation().Field("meter.value").Percentiles(percents...))
+
+	search, err := client.Search(agent.getElasticIndex()).
+		Query(query).
+		Size(0).
+		Aggregation("buckets", histogram).
+		Do(req.Context())
+
+	if err != nil {
+		log.Errorf("could not aggregate meters %+v", err)
+		writeError(w, http.StatusBadGateway, "could not query elastic search")
+		return
+	}
+
+	result.Buckets = []AggregateBucket{}
+	if buckets, ok := search.Aggregations.DateHistogram("buckets"); ok {
+		seconds := interval.Seconds()
+		for _, item := range buckets.Buckets {
+			bucket := AggregateBucket{
+				Timestamp: time.Unix(0, int64(item.Key)*int64(time.Millisecond)).UTC(),
+				Count:     item.DocCount,
+				CountRate: float64(item.DocCount) / seconds,
+			}
+
+			if stats, ok := item.Stats("stats"); ok && stats.Count > 0 {
+				bucket.Min, bucket.Max, bucket.Avg, bucket.Sum = stats.Min, stats.Max, stats.Avg, stats.Sum
+				if stats.Sum != nil {
+					bucket.Rate = *stats.Sum / seconds
+				}
+			}
+
+			if percentiles, ok := item.Percentiles("percentiles"); ok && item.DocCount > 0 {
+				bucket.Percentiles = percentiles.Values
+			}
+
+			result.Buckets = append(result.Buckets, bucket)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// selectInterval returns the smallest interval that covers the time range with at most max buckets
+func selectInterval(span time.Duration, max int) (time.Duration, string) {
+	for _, interval := range intervals {
+		if span/interval.duration < time.Duration(max) {
+			return interval.duration, interval.name
+		}
+	}
+	last := intervals[len(intervals)-1]
+	return last.duration, last.name
+}
+
+// parseInterval accepts intervals in the elastic search notation, e.g. 30s, 5m, 1h or 1d
+func parseInterval(value string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+	}
+
+	invalid := fmt.Errorf("interval must be a number followed by s, m, h or d")
+	if len(value) < 2 {
+		return 0, invalid
+	}
+
+	unit, ok := units[value[len(value)-1:]]
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if !ok || err != nil || count <= 0 {
+		return 0, invalid
+	}
+
+	return time.Duration(count) * unit, nil
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+func TestSelectInterval(t *testing.T) {
+	cases := map[time.Duration]string{
+		time.Minute:               "1s",
+		time.Hour:                 "1m",
+		24 * time.Hour:            "30m",
+		30 * 24 * time.Hour:       "12h",
+		10 * 365 * 24 * time.Hour: "7d",
+	}
+
+	for span, expected := range cases {
+		if _, name := selectInterval(span, 100); name != expected {
+			t.Errorf("%s: expected %s got %s", span, expected, name)
+		}
+	}
+
+	if interval, err := parseInterval("15m"); err != nil || interval != 15*time.Minute {
+		t.Errorf("expected 15m got %s %v", interval, err)
+	}
+
+	for _, invalid := range []string{"", "m", "0s", "5w", "1.5h"} {
+		if _, err := parseInterval(invalid); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestAggregateMeter(t *testing.T) {
+	var search string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		search = string(body)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"took":1,"hits":{"total":3,"hits":[]},"aggregations":{"buckets":{"buckets":[
+			{"key":1519043520000,"doc_count":3,
+				"stats":{"count":3,"min":10,"max":30,"avg":20,"sum":60},
+				"percentiles":{"values":{"50.0":20,"99.0":30}}},
+			{"key":1519043580000,"doc_count":0,
+				"stats":{"count":0,"min":null,"max":null,"avg":null,"sum":0},
+				"percentiles":{"values":{"50.0":null,"99.0":null}}}
+		]}}}`))
+	}))
+	defer es.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(es.URL), elastic.SetSniff(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := Agent{name: "test", elastic: client}
+
+	rr := httptest.NewRecorder()
+	agent.AggregateMeter(rr, httptest.NewRequest("GET", "/v1/meter/aggregate?name=responseTime&from=2018-02-19T12:32:00Z&to=2018-02-19T12:34:00Z&percentiles=50,99", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	for _, expected := range []string{`"interval":"5s"`, `"percents":[50,99]`, `"meter.name":{"query":"responseTime"}`, `"field":"meter.value"`} {
+		if !strings.Contains(search, expected) {
+			t.Errorf("search %s does not contain %s", search, expected)
+		}
+	}
+
+	var result AggregateResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Interval != "5s" || len(result.Buckets) != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	first := result.Buckets[0]
+	if first.Count != 3 || *first.Min != 10 || *first.Max != 30 || *first.Avg != 20 || *first.Sum != 60 {
+		t.Errorf("unexpected stats %+v", first)
+	}
+
+	if first.Rate != 12 || first.CountRate != 0.6 {
+		t.Errorf("unexpected rates %+v", first)
+	}
+
+	if first.Percentiles["99.0"] != 30 {
+		t.Errorf("unexpected percentiles %+v", first.Percentiles)
+	}
+
+	if empty := result.Buckets[1]; empty.Count != 0 || empty.Avg != nil || empty.Percentiles != nil {
+		t.Errorf("empty buckets should not contain statistics %+v", empty)
+	}
+
+	rr = httptest.NewRecorder()
+	agent.AggregateMeter(rr, httptest.NewRequest("GET", "/v1/meter/aggregate?from=2018-02-19T12:34:00Z&to=2018-02-19T12:32:00Z", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an empty time range got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	for _, query := range []string{
+		"from=2018-01-01T00:00:00Z&to=2018-02-01T00:00:00Z&interval=1s",
+		"from=2018-02-19T12:00:00Z&to=2018-02-19T13:00:00Z&interval=1m&buckets=10",
+		"from=2000-01-01T00:00:00Z&to=2018-01-01T00:00:00Z",
+		"buckets=100000",
+	} {
+		rr = httptest.NewRecorder()
+		agent.AggregateMeter(rr, httptest.NewRequest("GET", "/v1/meter/aggregate?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected %d for too many buckets with %s got %d", http.StatusBadRequest, query, rr.Code)
+		}
+	}
+}
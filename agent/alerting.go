@@ -0,0 +1,520 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAlertSamples = 5
+	maxRecentAlerts     = 100
+)
+
+// alert states
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+type AlertingConfig struct {
+	Webhooks []string         //webhooks notified about all alerts
+	Meters   []MeterAlertRule //rules evaluated on incoming meters
+	Logs     []LogAlertRule   //rules evaluated on incoming logs
+}
+
+type MeterAlertRule struct {
+	Name        string
+	Meter       string        //name of the meter
+	OperationID string        //only meters of this operation, all if empty
+	Comparison  string        //>, >=, <, <=, == or !=
+	Threshold   float64       //value the meter is compared to
+	Window      time.Duration //the average over this window is compared, the latest value if not set
+	For         time.Duration //how long the condition has to hold before the alert fires
+	Webhooks    []string      //webhooks notified about this rule in addition to the global ones
+}
+
+type LogAlertRule struct {
+	Name      string
+	Pattern   string        //regex matched against the log value
+	Level     string        //level of the log, e.g. error
+	Threshold int           //the alert fires if more logs match within the window
+	Window    time.Duration //length of the sliding window (default 1m)
+	Samples   int           //number of matching lines included in the alert (default 5)
+	Webhooks  []string      //webhooks notified about this rule in addition to the global ones
+}
+
+type AlertMessage struct {
+	Rule        string    `json:"rule"`
+	VDC         string    `json:"vdc,omitempty"` //VDC the alert belongs to
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"` //when the condition started to hold
+	Meter       string    `json:"meter,omitempty"`
+	OperationID string    `json:"operationID,omitempty"`
+	Comparison  string    `json:"comparison,omitempty"`
+	Threshold   float64   `json:"threshold"`
+	Value       float64   `json:"value"`
+	Message     string    `json:"message"`
+	Samples     []string  `json:"samples,omitempty"` //matching log lines
+}
+
+type AlertsResult struct {
+	Active []AlertMessage `json:"active"` //alerts that are currently firing
+	Recent []AlertMessage `json:"recent"` //latest notifications, newest first
+}
+
+type timedValue struct {
+	at    time.Time
+	value float64
+}
+
+type meterAlert struct {
+	rule   MeterAlertRule
+	values []timedValue
+	state  string //pending or firing while the condition holds, empty otherwise
+	since  time.Time
+}
+
+type logAlert struct {
+	rule    LogAlertRule
+	expr    *regexp.Regexp
+	level   string
+	hits    []time.Time
+	samples []string
+	firing  bool
+	since   time.Time
+}
+
+type notification struct {
+	alert    AlertMessage
+	webhooks []string
+}
+
+type alertManager struct {
+	lock     sync.Mutex
+	meters   []*meterAlert
+	logs     []*logAlert
+	webhooks []string
+
+	active map[string]AlertMessage
+	recent []AlertMessage
+
+	vdc    string //set on every alert, so webhooks can tell the VDCs apart
+	store  func(ElasticData)
+	client *http.Client
+	wg     sync.WaitGroup
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newAlertManager(cnf AlertingConfig, store func(ElasticData)) (*alertManager, error) {
+	m := &alertManager{
+		webhooks: cnf.Webhooks,
+		active:   make(map[string]AlertMessage),
+		store:    store,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for i, rule := range cnf.Meters {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("meter-alert-%d", i)
+		}
+		if rule.Meter == "" {
+			return nil, fmt.Errorf("alert rule %s has no meter", rule.Name)
+		}
+		if _, err := compare(rule.Comparison, 0, 0); err != nil {
+			return nil, fmt.Errorf("alert rule %s: %s", rule.Name, err)
+		}
+		m.meters = append(m.meters, &meterAlert{rule: rule})
+	}
+
+	for i, rule := range cnf.Logs {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("log-alert-%d", i)
+		}
+		if rule.Pattern == "" && rule.Level == "" {
+			return nil, fmt.Errorf("alert rule %s needs a pattern or a level", rule.Name)
+		}
+		if rule.Window <= 0 {
+			rule.Window = time.Minute
+		}
+		if rule.Samples <= 0 {
+			rule.Samples = defaultAlertSamples
+		}
+
+		alert := &logAlert{rule: rule, level: normalizeLevel(rule.Level)}
+		if rule.Pattern != "" {
+			expr, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %s: %s", rule.Name, err)
+			}
+			alert.expr = expr
+		}
+		m.logs = append(m.logs, alert)
+	}
+
+	return m, nil
+}
+
+// start periodically re-evaluates the log rules so alerts resolve once no more logs arrive
+func (m *alertManager) start() {
+	go func() {
+		defer close(m.done)
+		if len(m.logs) == 0 {
+			return
+		}
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				m.evaluate(now)
+			}
+		}
+	}()
+}
+
+func compare(comparison string, value, threshold float64) (bool, error) {
+	switch comparison {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	}
+	return false, fmt.Errorf("unknown comparison %s", comparison)
+}
+
+// toFloat converts the value of a meter, it returns false for non numeric values
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// observe evaluates all rules against an accepted document
+func (m *alertManager) observe(data ElasticData) {
+	var pending []notification
+
+	m.lock.Lock()
+	if data.Meter != nil {
+		pending = append(pending, m.observeMeter(data)...)
+	}
+	if data.Log != nil {
+		pending = append(pending, m.observeLog(data)...)
+	}
+	m.lock.Unlock()
+
+	for _, n := range pending {
+		m.dispatch(n)
+	}
+}
+
+// evaluate checks the log rules without a new log
+func (m *alertManager) evaluate(now time.Time) {
+	var pending []notification
+
+	m.lock.Lock()
+	for _, alert := range m.logs {
+		if n, ok := alert.check(now); ok {
+			pending = append(pending, n)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, n := range pending {
+		m.dispatch(n)
+	}
+}
+
+func (m *alertManager) observeMeter(data ElasticData) []notification {
+	value, ok := toFloat(data.Meter.Value)
+	if !ok {
+		return nil
+	}
+
+	now := data.Meter.Timestamp
+	if now.IsZero() {
+		now = data.Timestamp
+	}
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var result []notification
+	for _, alert := range m.meters {
+		rule := alert.rule
+		if rule.Meter != data.Meter.Name || (rule.OperationID != "" && rule.OperationID != data.Meter.OperationID) {
+			continue
+		}
+
+		current := alert.add(now, value)
+		holds, _ := compare(rule.Comparison, current, rule.Threshold)
+
+		msg := AlertMessage{
+			Rule:        rule.Name,
+			Meter:       rule.Meter,
+			OperationID: data.Meter.OperationID,
+			Comparison:  rule.Comparison,
+			Threshold:   rule.Threshold,
+			Value:       current,
+		}
+
+		switch {
+		case holds && alert.state == "":
+			alert.state = AlertPending
+			alert.since = now
+			fallthrough
+		case holds && alert.state == AlertPending:
+			if now.Sub(alert.since) >= rule.For {
+				alert.state = AlertFiring
+				msg.State = AlertFiring
+				msg.Since = alert.since
+				msg.Message = fmt.Sprintf("%s is %g which is %s %g", rule.Meter, current, rule.Comparison, rule.Threshold)
+				result = append(result, notification{alert: msg, webhooks: rule.Webhooks})
+			}
+		case !holds && alert.state == AlertFiring:
+			msg.State = AlertResolved
+			msg.Since = alert.since
+			msg.Message = fmt.Sprintf("%s is back to %g", rule.Meter, current)
+			result = append(result, notification{alert: msg, webhooks: rule.Webhooks})
+			alert.state = ""
+		case !holds:
+			alert.state = ""
+		}
+	}
+
+	return result
+}
+
+func (m *alertManager) observeLog(data ElasticData) []notification {
+	now := data.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var result []notification
+	for _, alert := range m.logs {
+		if alert.matches(data.Log) {
+			alert.hits = append(alert.hits, now)
+			alert.samples = append(alert.samples, data.Log.Value)
+			if len(alert.samples) > alert.rule.Samples {
+				alert.samples = alert.samples[len(alert.samples)-alert.rule.Samples:]
+			}
+		}
+
+		if n, ok := alert.check(now); ok {
+			result = append(result, n)
+		}
+	}
+
+	return result
+}
+
+// matches checks the level and pattern of a log, logs without a level, e.g. sent to /v1/log without
+// a level processor, are matched by the first level named in their value
+func (alert *logAlert) matches(msg *LogMessage) bool {
+	if alert.level != "" {
+		level := msg.Level
+		if level == "" {
+			level = levelExpr.FindString(msg.Value)
+		}
+		if normalizeLevel(level) != alert.level {
+			return false
+		}
+	}
+	return alert.expr == nil || alert.expr.MatchString(msg.Value)
+}
+
+// check drops matches that left the window and returns a notification if the state changed
+func (alert *logAlert) check(now time.Time) (notification, bool) {
+	rule := alert.rule
+
+	start := 0
+	for start < len(alert.hits) && now.Sub(alert.hits[start]) > rule.Window {
+		start++
+	}
+	alert.hits = alert.hits[start:]
+	if len(alert.hits) == 0 {
+		alert.samples = nil
+	}
+
+	count := len(alert.hits)
+	msg := AlertMessage{
+		Rule:       rule.Name,
+		Comparison: ">",
+		Threshold:  float64(rule.Threshold),
+		Value:      float64(count),
+	}
+
+	switch {
+	case count > rule.Threshold && !alert.firing:
+		alert.firing = true
+		alert.since = now
+		msg.State = AlertFiring
+		msg.Message = fmt.Sprintf("%d matching logs within %s", count, rule.Window)
+		msg.Samples = append([]string{}, alert.samples...)
+	case count <= rule.Threshold && alert.firing:
+		alert.firing = false
+		msg.State = AlertResolved
+		msg.Message = fmt.Sprintf("%d matching logs within %s", count, rule.Window)
+	default:
+		return notification{}, false
+	}
+
+	msg.Since = alert.since
+	return notification{alert: msg, webhooks: rule.Webhooks}, true
+}
+
+// add records a value and returns the value the rule is evaluated on
+func (alert *meterAlert) add(now time.Time, value float64) float64 {
+	if alert.rule.Window <= 0 {
+		return value
+	}
+
+	alert.values = append(alert.values, timedValue{at: now, value: value})
+
+	start := 0
+	for start < len(alert.values) && now.Sub(alert.values[start].at) > alert.rule.Window {
+		start++
+	}
+	alert.values = alert.values[start:]
+
+	sum := 0.0
+	for _, v := range alert.values {
+		sum += v.value
+	}
+	return sum / float64(len(alert.values))
+}
+
+// dispatch stores the alert in the index of the VDC and notifies all webhooks
+func (m *alertManager) dispatch(n notification) {
+	n.alert.VDC = m.vdc
+	log.Warnf("alert %s %s: %s", n.alert.Rule, n.alert.State, n.alert.Message)
+
+	m.lock.Lock()
+	if n.alert.State == AlertFiring {
+		m.active[n.alert.Rule] = n.alert
+	} else {
+		delete(m.active, n.alert.Rule)
+	}
+	m.recent = append([]AlertMessage{n.alert}, m.recent...)
+	if len(m.recent) > maxRecentAlerts {
+		m.recent = m.recent[:maxRecentAlerts]
+	}
+	m.lock.Unlock()
+
+	alert := n.alert
+	if m.store != nil {
+		m.store(ElasticData{Timestamp: time.Now(), Alert: &alert})
+	}
+
+	body, err := json.Marshal(n.alert)
+	if err != nil {
+		return
+	}
+
+	for _, hook := range append(append([]string{}, m.webhooks...), n.webhooks...) {
+		m.wg.Add(1)
+		go func(hook string) {
+			defer m.wg.Done()
+			resp, err := m.client.Post(hook, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Errorf("could not notify %s about alert %s %+v", hook, n.alert.Rule, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Errorf("webhook %s rejected alert %s with %d", hook, n.alert.Rule, resp.StatusCode)
+			}
+		}(hook)
+	}
+}
+
+func (m *alertManager) result() AlertsResult {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	result := AlertsResult{
+		Active: make([]AlertMessage, 0, len(m.active)),
+		Recent: append([]AlertMessage{}, m.recent...),
+	}
+	for _, alert := range m.active {
+		result.Active = append(result.Active, alert)
+	}
+	sort.Slice(result.Active, func(i, j int) bool {
+		return result.Active[i].Rule < result.Active[j].Rule
+	})
+
+	return result
+}
+
+// shutdown stops the evaluation and waits for outstanding webhook notifications
+func (m *alertManager) shutdown() {
+	close(m.stop)
+	<-m.done
+	m.wg.Wait()
+}
+
+// Alerts returns the currently firing alerts and the latest notifications
+func (agent *Agent) Alerts(w http.ResponseWriter, req *http.Request) {
+	if agent.alerts == nil {
+		writeJSON(w, http.StatusOK, AlertsResult{Active: []AlertMessage{}, Recent: []AlertMessage{}})
+		return
+	}
+	writeJSON(w, http.StatusOK, agent.alerts.result())
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func meterAt(at time.Time, name string, value interface{}) ElasticData {
+	return ElasticData{Timestamp: at, Meter: &MeterMessage{Timestamp: at, Name: name, OperationID: "getData", Value: value}}
+}
+
+func TestMeterAlerting(t *testing.T) {
+	var lock sync.Mutex
+	var received []AlertMessage
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alert AlertMessage
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		received = append(received, alert)
+		lock.Unlock()
+	}))
+	defer hook.Close()
+
+	var stored []AlertMessage
+	alerts, err := newAlertManager(AlertingConfig{
+		Webhooks: []string{hook.URL},
+		Meters: []MeterAlertRule{{
+			Name:       "slow",
+			Meter:      "response.time",
+			Comparison: ">",
+			Threshold:  100,
+			Window:     time.Minute,
+			For:        20 * time.Second,
+		}},
+	}, func(data ElasticData) {
+		stored = append(stored, *data.Alert)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts.start()
+
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	values := []interface{}{50, 150.0, "300", 200, 250, 220, "not a number", 10, 10, 10, 10}
+	for i, value := range values {
+		alerts.observe(meterAt(start.Add(time.Duration(i)*10*time.Second), "response.time", value))
+	}
+	alerts.observe(meterAt(start, "other", 1000))
+	alerts.shutdown()
+
+	if len(stored) != 2 {
+		t.Fatalf("expected a firing and a resolved alert but got %+v", stored)
+	}
+
+	if stored[0].State != AlertFiring || stored[0].Rule != "slow" || stored[0].OperationID != "getData" {
+		t.Errorf("unexpected firing alert %+v", stored[0])
+	}
+	//the average first exceeds the threshold with the third value and has to hold for 20 seconds
+	if !stored[0].Since.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("expected the alert to be pending since %s but was %s", start.Add(20*time.Second), stored[0].Since)
+	}
+
+	if stored[1].State != AlertResolved || stored[1].Value > 100 {
+		t.Errorf("unexpected resolved alert %+v", stored[1])
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 2 {
+		t.Errorf("expected two webhook notifications but got %+v", received)
+	}
+}
+
+func TestLogAlerting(t *testing.T) {
+	var stored []AlertMessage
+	alerts, err := newAlertManager(AlertingConfig{
+		Logs: []LogAlertRule{{
+			Name:      "errors",
+			Level:     "ERROR",
+			Pattern:   "database",
+			Threshold: 2,
+			Window:    time.Minute,
+			Samples:   2,
+		}},
+	}, func(data ElasticData) {
+		stored = append(stored, *data.Alert)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	logs := []LogMessage{
+		{Value: "database timeout 1", Level: "error"},
+		{Value: "database timeout 2", Level: "warn"},
+		{Value: "disk full", Level: "error"},
+		{Value: "database timeout 3", Level: "err"},
+		{Value: "ERROR database timeout 4"},
+		{Value: "INFO database retry"},
+		{Value: "database timeout 5", Level: "error"},
+	}
+	for i, msg := range logs {
+		msg := msg
+		alerts.observe(ElasticData{Timestamp: start.Add(time.Duration(i) * time.Second), Log: &msg})
+	}
+
+	if len(stored) != 1 || stored[0].State != AlertFiring || stored[0].Value != 3 {
+		t.Fatalf("expected the alert to fire with the third match but got %+v", stored)
+	}
+	if strings.Join(stored[0].Samples, "|") != "database timeout 3|ERROR database timeout 4" {
+		t.Errorf("unexpected samples %v", stored[0].Samples)
+	}
+
+	result := alerts.result()
+	if len(result.Active) != 1 || result.Active[0].Rule != "errors" {
+		t.Errorf("expected the alert to be active but got %+v", result.Active)
+	}
+
+	//without new logs the matches leave the window and the alert resolves
+	alerts.evaluate(start.Add(2 * time.Minute))
+
+	if len(stored) != 2 || stored[1].State != AlertResolved {
+		t.Fatalf("expected the alert to be resolved but got %+v", stored)
+	}
+
+	result = alerts.result()
+	if len(result.Active) != 0 || len(result.Recent) != 2 || result.Recent[0].State != AlertResolved {
+		t.Errorf("unexpected alerts %+v", result)
+	}
+}
+
+func TestMeterAlertingInvalidRules(t *testing.T) {
+	rules := []MeterAlertRule{
+		{Name: "no meter", Comparison: ">"},
+		{Name: "bad comparison", Meter: "cpu", Comparison: "=>"},
+	}
+
+	for _, rule := range rules {
+		if _, err := newAlertManager(AlertingConfig{Meters: []MeterAlertRule{rule}}, nil); err == nil {
+			t.Errorf("expected rule %s to be rejected", rule.Name)
+		}
+	}
+}
@@ -31,9 +31,10 @@ func (agent *Agent) Trace(w http.ResponseWriter, req *http.Request) {
 	log.Info("got trace request")
 
 	if agent.tracing {
+		backends := agent.backends()
 		var trace TraceMessage
 		var body io.ReadCloser
-		if agent.isDebugging {
+		if backends.debugging {
 			b, err := ioutil.ReadAll(req.Body)
 			if err != nil {
 				log.Errorf("could not write to elastic serach :%+v\n", err)
@@ -54,10 +55,22 @@ func (agent *Agent) Trace(w http.ResponseWriter, req *http.Request) {
 			log.Errorf("faile dto read trace message %+v", err)
 		}
 
+		if backends.redactor != nil {
+			backends.redactor.applyTrace(&trace)
+		}
+
 		log.Infof("trace request for %s : %s", trace.ParentSpanId, trace.Operation)
+		agent.publish(StreamEvent{Type: EventTrace, Trace: &trace})
 
-		if agent.collector != nil {
+		if agent.metrics != nil {
+			agent.metrics.begin(trace, time.Now())
+		}
+
+		if backends.collector != nil {
 			span := agent.getSpan(trace)
+			for key, value := range trace.Tags {
+				span.SetTag(key, value)
+			}
 			if trace.Message != "" {
 				span.LogEvent(trace.Message)
 			}
@@ -74,9 +87,10 @@ func (agent *Agent) Close(w http.ResponseWriter, req *http.Request) {
 	log.Info("got trace finish request")
 
 	if agent.tracing {
+		backends := agent.backends()
 		var trace TraceMessage
 		var body io.ReadCloser
-		if agent.isDebugging {
+		if backends.debugging {
 			b, err := ioutil.ReadAll(req.Body)
 			if err != nil {
 				log.Errorf("could not write to elastic serach :%+v\n", err)
@@ -96,11 +110,23 @@ func (agent *Agent) Close(w http.ResponseWriter, req *http.Request) {
 			log.Errorf("faile dto read trace message %+v", err)
 		}
 
+		if backends.redactor != nil {
+			backends.redactor.applyTrace(&trace)
+		}
+
 		log.Infof("trace request for %s : %s", trace.ParentSpanId, trace.Operation)
+		agent.publish(StreamEvent{Type: EventClose, Trace: &trace})
 
-		if agent.collector != nil {
+		if agent.metrics != nil {
+			agent.metrics.finish(trace, time.Now())
+		}
+
+		if backends.collector != nil {
 
 			var span = agent.getSpan(trace)
+			for key, value := range trace.Tags {
+				span.SetTag(key, value)
+			}
 			span.Finish()
 			agent.freeSpan(trace)
 		} else {
@@ -111,10 +137,14 @@ func (agent *Agent) Close(w http.ResponseWriter, req *http.Request) {
 }
 
 func (agent *Agent) Meter(w http.ResponseWriter, req *http.Request) {
+	if !agent.withinQuota(w) {
+		return
+	}
+
 	var meter MeterMessage
 	_ = json.NewDecoder(req.Body).Decode(&meter)
 
-	if agent.isDebugging {
+	if agent.backends().debugging {
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			log.Errorf("could not write to elastic serach :%+v\n", err)
@@ -140,25 +170,34 @@ func (agent *Agent) Meter(w http.ResponseWriter, req *http.Request) {
 }
 
 func (agent *Agent) Log(w http.ResponseWriter, req *http.Request) {
+	if !agent.withinQuota(w) {
+		return
+	}
+
 	body, err := ioutil.ReadAll(req.Body)
 
 	if err != nil {
 		log.Errorf("could not write to elastic serach :%+v\n", err)
 	}
-	if agent.isDebugging {
+	if agent.backends().debugging {
 		log.Debugln(string(body))
 	}
 
 	defer req.Body.Close()
 
+	agent.addLog(LogMessage{
+		Value: string(body),
+	})
+
+	w.WriteHeader(200)
+}
+
+// addLog stores a log message, it is used by all log inputs of the agent
+func (agent *Agent) addLog(msg LogMessage) {
 	data := ElasticData{
 		Timestamp: time.Now(),
-		Log: &LogMessage{
-			Value: string(body),
-		},
+		Log:       &msg,
 	}
 
 	agent.AddToES(data)
-
-	w.WriteHeader(200)
 }
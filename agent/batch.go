@@ -0,0 +1,317 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultBufferSize    = 10000
+	defaultBatchRetries  = 3
+	defaultRetryBackoff  = time.Second
+	defaultBatchTimeout  = 10 * time.Second
+)
+
+var errBufferFull = errors.New("buffer is full")
+
+// HTTPAuthConfig authenticates the requests of a sink
+type HTTPAuthConfig struct {
+	User        string            //basic auth user
+	Password    string            //basic auth password
+	BearerToken string            //sent as bearer token instead of basic auth
+	Headers     map[string]string //additional headers, e.g. X-Scope-OrgID for a multi tenant loki
+}
+
+// BatchConfig controls how a sink buffers, batches and retries its requests
+type BatchConfig struct {
+	Size          int           //documents per request (default 100)
+	FlushInterval time.Duration //time after which a batch is sent even if it is not full (default 1s)
+	BufferSize    int           //documents kept while the endpoint is unavailable, the oldest are dropped (default 10000)
+	MaxRetries    *int          //retries of a failed request before the batch is dropped, 0 disables retries (default 3)
+	RetryBackoff  time.Duration //wait before the first retry, doubled for each further retry (default 1s)
+	Timeout       time.Duration //timeout of a single request (default 10s)
+}
+
+func (cnf BatchConfig) withDefaults() BatchConfig {
+	if cnf.Size <= 0 {
+		cnf.Size = defaultBatchSize
+	}
+	if cnf.FlushInterval <= 0 {
+		cnf.FlushInterval = defaultFlushInterval
+	}
+	if cnf.BufferSize <= 0 {
+		cnf.BufferSize = defaultBufferSize
+	}
+	if cnf.BufferSize < cnf.Size {
+		cnf.BufferSize = cnf.Size
+	}
+	if cnf.MaxRetries == nil {
+		retries := defaultBatchRetries
+		cnf.MaxRetries = &retries
+	}
+	if cnf.RetryBackoff <= 0 {
+		cnf.RetryBackoff = defaultRetryBackoff
+	}
+	if cnf.Timeout <= 0 {
+		cnf.Timeout = defaultBatchTimeout
+	}
+	return cnf
+}
+
+// check reports invalid batch settings of the sink configured at key
+func (cnf BatchConfig) check(c *configCheck, key string) {
+	if cnf.Size < 0 {
+		c.fail(key+".Size", "must not be negative, got %d", cnf.Size)
+	}
+	if cnf.BufferSize < 0 {
+		c.fail(key+".BufferSize", "must not be negative, got %d", cnf.BufferSize)
+	}
+	if cnf.MaxRetries != nil && *cnf.MaxRetries < 0 {
+		c.fail(key+".MaxRetries", "must not be negative, got %d", *cnf.MaxRetries)
+	}
+	c.duration(key+".FlushInterval", cnf.FlushInterval)
+	c.duration(key+".RetryBackoff", cnf.RetryBackoff)
+	c.duration(key+".Timeout", cnf.Timeout)
+}
+
+// batchEntry is a document of a VDC waiting to be sent
+type batchEntry struct {
+	VDC      string      `json:"vdc"`
+	Document ElasticData `json:"document"`
+}
+
+// batchEncoder turns a batch into the body of a request and its headers, e.g. the content type
+type batchEncoder func(entries []batchEntry) ([]byte, http.Header, error)
+
+// batchOutput buffers documents and sends them in batches to an http endpoint. Failed requests are
+// retried with a growing backoff, while the endpoint is unavailable documents are kept up to the
+// buffer size. Every document is tracked in the lifecycle of the agent until it is sent or dropped.
+type batchOutput struct {
+	name      string //name of the sink in logs, never the url as it may contain credentials
+	method    string
+	url       string
+	auth      HTTPAuthConfig
+	cnf       BatchConfig
+	encode    batchEncoder
+	client    *http.Client
+	lifecycle *lifecycle
+
+	lock   sync.Mutex
+	buffer []batchEntry
+	closed bool
+
+	full chan struct{} //a complete batch is buffered
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBatchOutput(name, method, endpoint string, auth HTTPAuthConfig, cnf BatchConfig, encode batchEncoder, lifecycle *lifecycle) *batchOutput {
+	cnf = cnf.withDefaults()
+	o := &batchOutput{
+		name:      name,
+		method:    method,
+		url:       endpoint,
+		auth:      auth,
+		cnf:       cnf,
+		encode:    encode,
+		client:    &http.Client{Timeout: cnf.Timeout},
+		lifecycle: lifecycle,
+		full:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+func (o *batchOutput) add(entry batchEntry) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		log.Warnf("%s sink is closed, dropping document", o.name)
+		return
+	}
+
+	if len(o.buffer) >= o.cnf.BufferSize {
+		log.Warnf("%s buffer is full, dropping the oldest document", o.name)
+		o.buffer = o.buffer[1:]
+		o.lifecycle.end(errBufferFull)
+	}
+	o.lifecycle.begin()
+	o.buffer = append(o.buffer, entry)
+
+	if len(o.buffer) >= o.cnf.Size {
+		select {
+		case o.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes the next batch from the buffer
+func (o *batchOutput) take() []batchEntry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	n := len(o.buffer)
+	if n > o.cnf.Size {
+		n = o.cnf.Size
+	}
+	batch := append([]batchEntry{}, o.buffer[:n]...)
+	o.buffer = o.buffer[n:]
+	return batch
+}
+
+func (o *batchOutput) run() {
+	defer close(o.done)
+	ticker := time.NewTicker(o.cnf.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			//last attempt for everything that is left, there is no time for retries
+			for batch := o.take(); len(batch) > 0; batch = o.take() {
+				o.send(batch, false)
+			}
+			return
+		case <-o.full:
+		case <-ticker.C:
+		}
+
+		//the remaining documents wait for the next flush if the endpoint is unavailable
+		for batch := o.take(); len(batch) > 0; batch = o.take() {
+			if !o.send(batch, true) {
+				break
+			}
+		}
+	}
+}
+
+// send delivers a batch, it returns false if the batch had to be dropped
+func (o *batchOutput) send(batch []batchEntry, retry bool) bool {
+	body, header, err := o.encode(batch)
+	if err != nil {
+		log.Errorf("could not encode batch for %s %+v", o.name, err)
+		o.finish(batch, err)
+		return false
+	}
+
+	backoff := o.cnf.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := o.post(body, header)
+		if err == nil {
+			o.finish(batch, nil)
+			return true
+		}
+
+		if !retryable || !retry || attempt >= *o.cnf.MaxRetries {
+			log.Errorf("could not send %d documents to %s, dropping them: %+v", len(batch), o.name, err)
+			o.finish(batch, err)
+			return false
+		}
+		log.Warnf("could not send %d documents to %s, retrying in %s: %+v", len(batch), o.name, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-o.stop:
+			retry = false
+		}
+	}
+}
+
+// post sends one request, errors of the connection, rate limits and server errors can be retried
+func (o *batchOutput) post(body []byte, header http.Header) (bool, error) {
+	req, err := http.NewRequest(o.method, o.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	for key, value := range o.auth.Headers {
+		req.Header.Set(key, value)
+	}
+	if o.auth.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+o.auth.BearerToken)
+	} else if o.auth.User != "" {
+		req.SetBasicAuth(o.auth.User, o.auth.Password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("%s responded with %d %s", redactURL(o.url), resp.StatusCode, strings.TrimSpace(string(message)))
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+	}
+	return false, nil
+}
+
+// redactURL removes the credentials and the query, e.g. an api key, from a url before it is logged
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "invalid url"
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+func (o *batchOutput) finish(batch []batchEntry, err error) {
+	for range batch {
+		o.lifecycle.end(err)
+	}
+}
+
+// close sends the buffered documents once more and stops the output
+func (o *batchOutput) close() {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return
+	}
+	o.closed = true
+	o.lock.Unlock()
+
+	close(o.stop)
+	<-o.done
+}
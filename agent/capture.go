@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+const defaultCaptureSize = 1000
+
+// CapturedDocument is a document that would have been written to elastic search in testing mode
+type CapturedDocument struct {
+	VDC   string      `json:"vdc"`
+	Index string      `json:"index"`
+	Data  ElasticData `json:"data"`
+}
+
+// capture keeps the latest documents and spans in testing mode so contract tests can inspect what
+// the agent would have sent. It is the zipkin collector of the agent in testing mode.
+type capture struct {
+	lock      sync.Mutex
+	size      int
+	documents []CapturedDocument
+	spans     []SpanMessage
+}
+
+func newCapture(size int) *capture {
+	if size <= 0 {
+		size = defaultCaptureSize
+	}
+	return &capture{size: size}
+}
+
+func (c *capture) addDocument(vdc, index string, data ElasticData) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.documents = append(c.documents, CapturedDocument{VDC: vdc, Index: index, Data: data})
+	if len(c.documents) > c.size {
+		c.documents = c.documents[len(c.documents)-c.size:]
+	}
+}
+
+func (c *capture) Collect(span *zipkincore.Span) error {
+	captured := newSpanMessage(span)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.spans = append(c.spans, captured)
+	if len(c.spans) > c.size {
+		c.spans = c.spans[len(c.spans)-c.size:]
+	}
+	return nil
+}
+
+func (c *capture) Close() error {
+	return nil
+}
+
+func (c *capture) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.documents = nil
+	c.spans = nil
+}
+
+// debugRoutes registers the inspection api of the testing mode
+func (agent *Agent) debugRoutes(router *mux.Router) {
+	router.Path("/_debug/documents").Methods("GET").HandlerFunc(agent.CapturedDocuments)
+	router.Path("/_debug/spans").Methods("GET").HandlerFunc(agent.CapturedSpans)
+	router.Path("/_debug/reset").Methods("POST").HandlerFunc(agent.ResetCapture)
+}
+
+// CapturedDocuments returns the documents captured in testing mode, oldest first. They can be
+// filtered by the vdc and type (meter or log) parameters.
+func (agent *Agent) CapturedDocuments(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	vdc, kind := params.Get("vdc"), params.Get("type")
+	if kind != "" && kind != "meter" && kind != "log" {
+		writeError(w, http.StatusBadRequest, "type must be meter or log")
+		return
+	}
+
+	agent.capture.lock.Lock()
+	defer agent.capture.lock.Unlock()
+
+	documents := []CapturedDocument{}
+	for _, document := range agent.capture.documents {
+		if vdc != "" && document.VDC != vdc {
+			continue
+		}
+		if (kind == "meter" && document.Data.Meter == nil) || (kind == "log" && document.Data.Log == nil) {
+			continue
+		}
+		documents = append(documents, document)
+	}
+	writeJSON(w, http.StatusOK, documents)
+}
+
+// CapturedSpans returns the finished spans captured in testing mode, oldest first. They can be
+// filtered by the traceId and operation parameters.
+func (agent *Agent) CapturedSpans(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	traceID, operation := params.Get("traceId"), params.Get("operation")
+
+	agent.capture.lock.Lock()
+	defer agent.capture.lock.Unlock()
+
+	spans := []SpanMessage{}
+	for _, span := range agent.capture.spans {
+		if (traceID != "" && span.TraceId != traceID) || (operation != "" && span.Operation != operation) {
+			continue
+		}
+		spans = append(spans, span)
+	}
+	writeJSON(w, http.StatusOK, spans)
+}
+
+// ResetCapture removes all captured documents and spans, e.g. between contract tests
+func (agent *Agent) ResetCapture(w http.ResponseWriter, req *http.Request) {
+	agent.capture.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
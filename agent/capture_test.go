@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	agent, err := CreateAgent(Configuration{VDCName: "test", Testing: true, Tracing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+	handler := agent.Handler()
+
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout","message":"reserving stock"}`
+	send(handler, "PUT", "/v1/trace", trace, nil)
+	send(handler, "POST", "/v1/close", `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout","tags":{"cart":"42"}}`, nil)
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":12}`, nil)
+	send(handler, "POST", "/v1/log", "payment accepted", nil)
+
+	var documents []CapturedDocument
+	json.Unmarshal(send(handler, "GET", "/v1/_debug/documents", "", nil).Body.Bytes(), &documents)
+	if len(documents) != 2 || documents[0].Data.Meter == nil || documents[0].Data.Meter.Name != "responseTime" ||
+		documents[1].Data.Log == nil || documents[1].Data.Log.Value != "payment accepted" {
+		t.Fatalf("expected the meter and the log in order but got %+v", documents)
+	}
+	if documents[0].VDC != "test" || documents[0].Index != agent.getElasticIndex() {
+		t.Errorf("expected the target of the document %+v", documents[0])
+	}
+
+	json.Unmarshal(send(handler, "GET", "/v1/_debug/documents?type=log", "", nil).Body.Bytes(), &documents)
+	if len(documents) != 1 || documents[0].Data.Log == nil {
+		t.Errorf("expected only the log %+v", documents)
+	}
+	if rr := send(handler, "GET", "/v1/_debug/documents?type=span", "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid type to be rejected but got %d", rr.Code)
+	}
+
+	var spans []SpanMessage
+	json.Unmarshal(send(handler, "GET", "/v1/_debug/spans?traceId=5e27c67030932221", "", nil).Body.Bytes(), &spans)
+	if len(spans) != 1 {
+		t.Fatalf("expected the closed span but got %+v", spans)
+	}
+	span := spans[0]
+	if span.Operation != "checkout" || span.Service != "vdc-agent" || span.Tags["cart"] != "42" ||
+		len(span.Messages) != 1 || span.Messages[0] != "reserving stock" {
+		t.Errorf("unexpected span %+v", span)
+	}
+
+	if rr := send(handler, "POST", "/v1/_debug/reset", "", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("expected the reset to succeed but got %d", rr.Code)
+	}
+	if body := send(handler, "GET", "/v1/_debug/documents", "", nil).Body.String(); body != "[]\n" {
+		t.Errorf("expected no documents after the reset but got %s", body)
+	}
+	if body := send(handler, "GET", "/v1/_debug/spans", "", nil).Body.String(); body != "[]\n" {
+		t.Errorf("expected no spans after the reset but got %s", body)
+	}
+}
+
+func TestCaptureSize(t *testing.T) {
+	agent, err := CreateAgent(Configuration{VDCName: "test", Testing: true, CaptureSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+	handler := agent.Handler()
+
+	for _, value := range []string{"first", "second", "third"} {
+		send(handler, "POST", "/v1/log", value, nil)
+	}
+
+	var documents []CapturedDocument
+	json.Unmarshal(send(handler, "GET", "/v1/_debug/documents", "", nil).Body.Bytes(), &documents)
+	if len(documents) != 2 || documents[0].Data.Log.Value != "second" || documents[1].Data.Log.Value != "third" {
+		t.Errorf("expected the latest two logs but got %+v", documents)
+	}
+}
+
+func TestCaptureOnlyInTesting(t *testing.T) {
+	agent, err := CreateAgent(Configuration{VDCName: "test", IgnoreElastic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+
+	if body := send(agent.Handler(), "GET", "/v1/_debug/documents", "", nil).Body.String(); body != "" {
+		t.Errorf("expected the inspection api to be disabled outside of testing mode but got %s", body)
+	}
+}
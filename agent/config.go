@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of the environment variables that configure the agent
+const EnvPrefix = "DITAS_LOGAGENT"
+
+var envKeyReplacer = strings.NewReplacer(".", "_")
+
+// BindEnvironment lets environment variables override the config file, e.g. DITAS_LOGAGENT_VDCNAME
+// sets VDCName and DITAS_LOGAGENT_SAMPLING_PROBABILITY sets Sampling.Probability
+func BindEnvironment() {
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(envKeyReplacer)
+	viper.AutomaticEnv()
+
+	//automatic env only applies to keys viper already knows, so the entries without a default are bound explicitly
+	for _, key := range configKeys(reflect.TypeOf(Configuration{}), "") {
+		viper.BindEnv(key)
+	}
+}
+
+// configKeys lists the keys of all values of a configuration, lists and maps are single values
+func configKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		key := prefix + field.Name
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			keys = append(keys, configKeys(field.Type, key+".")...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// envName returns the environment variable of a key
+func envName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(envKeyReplacer.Replace(key))
+}
+
+// readConfigFile reads the config file if there is one, without a file the agent is configured by
+// flags, environment variables and defaults
+func readConfigFile() error {
+	err := viper.ReadInConfig()
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		log.Info("no config file found, using flags, environment variables and defaults")
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigurationFromEnvironment(t *testing.T) {
+	defer viper.Reset()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := map[string]string{
+		"DITAS_LOGAGENT_PORT":                 "8585",
+		"DITAS_LOGAGENT_VDCNAME":              "envVDC",
+		"DITAS_LOGAGENT_IGNOREELASTIC":        "true",
+		"DITAS_LOGAGENT_TRACING":              "false",
+		"DITAS_LOGAGENT_SAMPLING_PROBABILITY": "0.25",
+		"DITAS_LOGAGENT_TAIL_PATHS":           "/var/log/a.log,/var/log/b.log",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	//there is no config file in the search path
+	viper.SetConfigName("logging")
+	viper.AddConfigPath(dir)
+	BindEnvironment()
+
+	cnf, err := LoadConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cnf.Port != 8585 || cnf.VDCName != "envVDC" || !cnf.IgnoreElastic || cnf.Sampling.Probability != 0.25 {
+		t.Errorf("expected the values of the environment but got %+v", cnf)
+	}
+	if !reflect.DeepEqual(cnf.Tail.Paths, []string{"/var/log/a.log", "/var/log/b.log"}) {
+		t.Errorf("expected two tailed paths but got %v", cnf.Tail.Paths)
+	}
+
+	os.Setenv("DITAS_LOGAGENT_PORT", "0")
+	_, err = LoadConfiguration()
+	problems, ok := err.(ConfigErrors)
+	if !ok || len(problems) != 1 || problems[0].Source != "environment DITAS_LOGAGENT_PORT" {
+		t.Errorf("expected the port to be reported with its variable but got %+v", err)
+	}
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DITAS-Project/VDC-Logging-Agent/agenttest"
+	"github.com/opentracing/opentracing-go"
+)
+
+// the zipkin collector sends its batches every second
+const spanTimeout = 5 * time.Second
+
+// e2e is an agent served by the real router, writing to a fake elastic search and zipkin
+type e2e struct {
+	t       *testing.T
+	agent   *Agent
+	server  *httptest.Server
+	elastic *agenttest.Elastic
+	zipkin  *agenttest.Zipkin
+}
+
+func newE2E(t *testing.T, cnf Configuration) *e2e {
+	env := &e2e{t: t, elastic: agenttest.NewElastic(), zipkin: agenttest.NewZipkin()}
+
+	if cnf.VDCName == "" {
+		cnf.VDCName = "shop"
+	}
+	cnf.ElasticSearchURL = env.elastic.URL
+	cnf.ZipkinEndpoint = env.zipkin.Endpoint()
+	cnf.Tracing = true
+
+	agent, err := CreateAgent(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.agent = agent
+	env.server = httptest.NewServer(agent.Handler())
+	return env
+}
+
+func (env *e2e) close() {
+	env.server.Close()
+	env.agent.Shutdown(context.Background())
+	env.elastic.Close()
+	env.zipkin.Close()
+}
+
+func (env *e2e) send(method, path, body string, headers map[string]string) (int, string) {
+	req, err := http.NewRequest(method, env.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	response, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(response)
+}
+
+func (env *e2e) expect(status int, method, path, body string) string {
+	code, response := env.send(method, path, body, nil)
+	if code != status {
+		env.t.Fatalf("%s %s: expected %d but got %d %s", method, path, status, code, response)
+	}
+	return response
+}
+
+// field reads a nested field of a document source
+func field(source map[string]interface{}, path string) interface{} {
+	var current interface{} = source
+	for _, part := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[part]
+	}
+	return current
+}
+
+func TestEndToEnd(t *testing.T) {
+	env := newE2E(t, Configuration{})
+	defer env.close()
+
+	//the agent uses its own tracer and leaves the global one to the application it is embedded in
+	if _, ok := opentracing.GlobalTracer().(opentracing.NoopTracer); !ok {
+		t.Errorf("expected the global tracer to be untouched but got %T", opentracing.GlobalTracer())
+	}
+
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout","message":"reserving stock","tags":{"cart":"42"}}`
+	env.expect(http.StatusOK, "PUT", "/v1/trace", trace)
+	env.expect(http.StatusOK, "POST", "/v1/close", `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout","tags":{"http.status_code":"200"}}`)
+
+	env.expect(http.StatusOK, "POST", "/v1/meter", `{"name":"responseTime","value":12,"unit":"ms","operationID":"checkout"}`)
+	env.expect(http.StatusOK, "POST", "/v1/log", "payment accepted")
+
+	documents := env.elastic.Documents("shop")
+	if len(documents) != 2 {
+		t.Fatalf("expected the meter and the log but got %+v", documents)
+	}
+	if field(documents[0].Source, "meter.name") != "responseTime" || field(documents[0].Source, "meter.value") != 12.0 ||
+		field(documents[0].Source, "meter.operationID") != "checkout" || documents[0].Type != "data" {
+		t.Errorf("unexpected meter %+v", documents[0])
+	}
+	if field(documents[1].Source, "log.value") != "payment accepted" || field(documents[1].Source, "meter") != nil {
+		t.Errorf("unexpected log %+v", documents[1])
+	}
+
+	spans := env.zipkin.WaitForSpans(1, spanTimeout)
+	if len(spans) != 1 {
+		t.Fatalf("expected exactly the closed span but got %+v", spans)
+	}
+	span := spans[0]
+	if span.TraceID != "5e27c67030932221" || span.Name != "checkout" || span.ServiceName != "vdc-agent" {
+		t.Errorf("unexpected span %+v", span)
+	}
+	if span.Tags["cart"] != "42" || span.Tags["http.status_code"] != "200" {
+		t.Errorf("expected the tags of the trace and the close message %+v", span.Tags)
+	}
+	found := false
+	for _, annotation := range span.Annotations {
+		found = found || annotation == "reserving stock"
+	}
+	if !found {
+		t.Errorf("expected the message to be logged on the span %+v", span.Annotations)
+	}
+
+	//the stored data can be read back through the api
+	var result QueryResult
+	json.Unmarshal([]byte(env.expect(http.StatusOK, "GET", "/v1/meter?name=responseTime", "")), &result)
+	if len(result.Hits) != 1 {
+		t.Errorf("expected the meter to be found %+v", result)
+	}
+	json.Unmarshal([]byte(env.expect(http.StatusOK, "GET", "/v1/log", "")), &result)
+	if len(result.Hits) != 1 {
+		t.Errorf("expected the log to be found %+v", result)
+	}
+
+	if metrics := env.expect(http.StatusOK, "GET", "/v1/metrics", ""); !strings.Contains(metrics, `operation="checkout"`) {
+		t.Errorf("expected the closed span to be counted\n%s", metrics)
+	}
+	env.expect(http.StatusOK, "GET", "/v1/alerts", "")
+
+	env.expect(http.StatusBadRequest, "GET", "/v1/meter?size=0", "")
+	env.expect(http.StatusMethodNotAllowed, "GET", "/v1/trace", "")
+
+	if documents := env.elastic.Documents(""); len(documents) != 2 {
+		t.Errorf("expected no further documents but got %+v", documents)
+	}
+}
+
+func TestEndToEndQuery(t *testing.T) {
+	env := newE2E(t, Configuration{})
+	defer env.close()
+
+	env.expect(http.StatusOK, "POST", "/v1/meter", `{"name":"responseTime","value":12,"operationID":"checkout"}`)
+	env.expect(http.StatusOK, "POST", "/v1/meter", `{"name":"responseTime","value":30,"operationID":"search"}`)
+	env.expect(http.StatusOK, "POST", "/v1/meter", `{"name":"queueLength","value":3,"operationID":"checkout"}`)
+	env.expect(http.StatusOK, "POST", "/v1/log", "payment accepted")
+	env.expect(http.StatusOK, "POST", "/v1/log", "payment failed")
+
+	count := func(path string) int {
+		var result QueryResult
+		json.Unmarshal([]byte(env.expect(http.StatusOK, "GET", path, "")), &result)
+		return len(result.Hits)
+	}
+
+	//the filters of the api are applied by the fake elastic search
+	for path, expected := range map[string]int{
+		"/v1/meter":                   3,
+		"/v1/meter?name=responseTime": 2,
+		"/v1/meter?name=responseTime&operationID=checkout": 1,
+		"/v1/meter?from=2000-01-01T00:00:00Z":              3,
+		"/v1/meter?from=2099-01-01T00:00:00Z":              0,
+		"/v1/meter?to=2000-01-01T00:00:00Z":                0,
+		"/v1/log?q=payment":                                2,
+		"/v1/log?q=payment%20failed":                       1,
+	} {
+		if got := count(path); got != expected {
+			t.Errorf("expected %d hits for %s but got %d", expected, path, got)
+		}
+	}
+
+	//pages continue behind the last document without repeating one
+	seen := make(map[string]bool)
+	path := "/v1/meter?size=1"
+	for page := 0; page < 4 && path != ""; page++ {
+		var result QueryResult
+		json.Unmarshal([]byte(env.expect(http.StatusOK, "GET", path, "")), &result)
+		for _, hit := range result.Hits {
+			if hit.ID == "" || seen[hit.ID] {
+				t.Errorf("unexpected document on page %d %+v", page, hit)
+			}
+			seen[hit.ID] = true
+		}
+		path = ""
+		if result.Next != "" {
+			path = "/v1/meter?size=1&search_after=" + result.Next
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected all meters on the pages but got %d", len(seen))
+	}
+}
+
+func TestEndToEndMapping(t *testing.T) {
+	env := newE2E(t, Configuration{})
+	defer env.close()
+
+	index := env.agent.getElasticIndex()
+	mapping := env.elastic.Mapping(index)
+	if field(mapping, "properties.meter.properties.value.type") != "double" ||
+		field(mapping, "properties.meter.properties.operationID.type") != "keyword" {
+		t.Errorf("expected numeric meter values so they can be aggregated %+v", mapping)
+	}
+
+	//an existing index gets the mapping updated
+	if err := env.agent.InitES(); err != nil {
+		t.Fatalf("expected the mapping to be updated %+v", err)
+	}
+	if field(env.elastic.Mapping(index), "properties.meter.properties.value.type") != "double" {
+		t.Errorf("expected the updated mapping %+v", env.elastic.Mapping(index))
+	}
+
+	//the indices of the following days get the mapping through the template
+	resp, err := http.Post(env.elastic.URL+"/shop-2099-01-01/data", "application/json", strings.NewReader(`{"meter":{"value":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if field(env.elastic.Mapping("shop-2099-01-01"), "properties.meter.properties.value.type") != "double" {
+		t.Errorf("expected the template to apply to a new index %+v", env.elastic.Mapping("shop-2099-01-01"))
+	}
+}
+
+func TestEndToEndElasticFailure(t *testing.T) {
+	env := newE2E(t, Configuration{})
+	defer env.close()
+
+	env.elastic.Fail(http.StatusServiceUnavailable)
+
+	//the api does not block the VDC on a failing backend, the document is lost
+	env.expect(http.StatusOK, "POST", "/v1/meter", `{"name":"responseTime","value":12}`)
+	env.expect(http.StatusOK, "POST", "/v1/log", "lost")
+	if code, _ := env.send("GET", "/v1/log", "", nil); code < http.StatusInternalServerError {
+		t.Errorf("expected a failing query to be reported but got %d", code)
+	}
+
+	env.elastic.Recover()
+	env.expect(http.StatusOK, "POST", "/v1/log", "delivered")
+
+	documents := env.elastic.Documents("shop")
+	if len(documents) != 1 || field(documents[0].Source, "log.value") != "delivered" {
+		t.Errorf("expected only the log written after the recovery but got %+v", documents)
+	}
+}
+
+func TestEndToEndZipkinFailure(t *testing.T) {
+	env := newE2E(t, Configuration{})
+	defer env.close()
+
+	env.zipkin.Fail(http.StatusInternalServerError)
+	env.expect(http.StatusOK, "PUT", "/v1/trace", `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"lost"}`)
+	env.expect(http.StatusOK, "POST", "/v1/close", `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"lost"}`)
+
+	//wait for the batch to be rejected
+	time.Sleep(1500 * time.Millisecond)
+	env.zipkin.Recover()
+
+	env.expect(http.StatusOK, "PUT", "/v1/trace", `{"traceId":"6e27c67030932221","spanId":"48357d8f309b379d","operation":"delivered"}`)
+	env.expect(http.StatusOK, "POST", "/v1/close", `{"traceId":"6e27c67030932221","spanId":"48357d8f309b379d","operation":"delivered"}`)
+
+	spans := env.zipkin.WaitForSpans(1, spanTimeout)
+	if len(spans) != 1 || spans[0].Name != "delivered" || spans[0].TraceID != "6e27c67030932221" {
+		t.Errorf("expected only the span sent after the recovery but got %+v", spans)
+	}
+
+	if documents := env.elastic.Documents(""); len(documents) != 0 {
+		t.Errorf("expected traces not to be written to elastic search %+v", documents)
+	}
+}
+
+func TestEndToEndProcessing(t *testing.T) {
+	env := newE2E(t, Configuration{
+		Redaction:  RedactionConfig{Detectors: []string{"email"}},
+		Processors: []ProcessorConfig{{Type: "drop", Pattern: "healthcheck"}},
+	})
+	defer env.close()
+
+	env.expect(http.StatusOK, "POST", "/v1/log", "healthcheck ok")
+	env.expect(http.StatusOK, "POST", "/v1/log", "order placed by jane.doe@example.com")
+
+	documents := env.elastic.Documents("shop")
+	if len(documents) != 1 {
+		t.Fatalf("expected the health check to be dropped but got %+v", documents)
+	}
+	if value, _ := field(documents[0].Source, "log.value").(string); strings.Contains(value, "jane.doe@example.com") {
+		t.Errorf("expected the email to be redacted before it is stored %s", value)
+	}
+}
+
+func TestEndToEndMultiTenant(t *testing.T) {
+	env := newE2E(t, Configuration{
+		VDCName: "root",
+		MultiTenant: MultiTenantConfig{
+			Enabled: true,
+			Tenants: []TenantSettings{
+				{Name: "shop", APIKey: "secret", MaxDocuments: 1},
+			},
+		},
+	})
+	defer env.close()
+
+	secured := map[string]string{"X-API-Key": "secret"}
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout"}`
+	for _, c := range []struct {
+		method, path, body string
+		headers            map[string]string
+		status             int
+	}{
+		{"PUT", "/v1/vdc/shop/trace", trace, secured, http.StatusOK},
+		{"POST", "/v1/vdc/shop/close", trace, secured, http.StatusOK},
+		{"POST", "/v1/vdc/shop/log", "first", secured, http.StatusOK},
+		{"POST", "/v1/vdc/shop/log", "over quota", secured, http.StatusTooManyRequests},
+		{"POST", "/v1/vdc/shop/log", "no key", nil, http.StatusUnauthorized},
+		{"POST", "/v1/vdc/unknown/log", "unknown", nil, http.StatusForbidden},
+		{"POST", "/v1/log", "root", nil, http.StatusOK},
+	} {
+		if code, response := env.send(c.method, c.path, c.body, c.headers); code != c.status {
+			t.Errorf("%s %s: expected %d but got %d %s", c.method, c.path, c.status, code, response)
+		}
+	}
+
+	shop := env.elastic.Documents("shop")
+	if len(shop) != 1 || field(shop[0].Source, "log.value") != "first" {
+		t.Errorf("expected only the first log of the VDC in its index %+v", shop)
+	}
+	root := env.elastic.Documents("root")
+	if len(root) != 1 || field(root[0].Source, "log.value") != "root" {
+		t.Errorf("expected the log of the agent in its own index %+v", root)
+	}
+	if all := env.elastic.Documents(""); len(all) != 2 {
+		t.Errorf("expected no documents of unknown or rejected VDCs %+v", all)
+	}
+
+	//the index of a VDC is created with the mapping of the agent when the VDC is first served
+	index := env.agent.tenants.agents["shop"].getElasticIndex()
+	if field(env.elastic.Mapping(index), "properties.meter.properties.value.type") != "double" {
+		t.Errorf("expected the mapping for the index of the VDC %+v", env.elastic.Mapping(index))
+	}
+
+	spans := env.zipkin.WaitForSpans(1, spanTimeout)
+	if len(spans) != 1 || spans[0].Name != "checkout" || spans[0].ServiceName != "shop" {
+		t.Errorf("expected the span under the service of the VDC %+v", spans)
+	}
+}
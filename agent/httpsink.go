@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+type HTTPSinkConfig struct {
+	URL         string   //endpoint the batches are sent to
+	Method      string   //http method (default POST)
+	Types       []string //documents that are sent: log, meter and/or alert (default log)
+	Template    string   //go template rendering the body of a batch, a json array of {"vdc","document"} if not set
+	ContentType string   //content type of the body (default application/json)
+
+	Auth  HTTPAuthConfig
+	Batch BatchConfig
+}
+
+// functions available in the templates of http sinks
+var httpSinkFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// documentType returns whether a document is a log, meter or alert
+func documentType(data ElasticData) string {
+	switch {
+	case data.Alert != nil:
+		return "alert"
+	case data.Meter != nil:
+		return "meter"
+	case data.Log != nil:
+		return "log"
+	}
+	return ""
+}
+
+// httpSink sends batches of documents to any http endpoint, e.g. a webhook of a chat or an ingest api
+type httpSink struct {
+	output   *batchOutput
+	types    map[string]bool
+	template *template.Template
+	header   http.Header
+}
+
+func newHTTPSink(cnf HTTPSinkConfig, lifecycle *lifecycle) (*httpSink, error) {
+	s, err := parseHTTPSink(cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.ToUpper(cnf.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	s.output = newBatchOutput(redactURL(cnf.URL), method, cnf.URL, cnf.Auth, cnf.Batch, s.encode, lifecycle)
+	log.Infof("sending batches of documents to %s", redactURL(cnf.URL))
+	return s, nil
+}
+
+// parseHTTPSink checks the types and the template of a sink without starting it
+func parseHTTPSink(cnf HTTPSinkConfig) (*httpSink, error) {
+	s := &httpSink{
+		types:  make(map[string]bool),
+		header: http.Header{"Content-Type": {"application/json"}},
+	}
+
+	types := cnf.Types
+	if len(types) == 0 {
+		types = []string{"log"}
+	}
+	for _, kind := range types {
+		if kind != "log" && kind != "meter" && kind != "alert" {
+			return nil, fmt.Errorf("unknown type %s, expected log, meter or alert", kind)
+		}
+		s.types[kind] = true
+	}
+	if cnf.Template != "" {
+		var err error
+		if s.template, err = template.New("body").Funcs(httpSinkFuncs).Parse(cnf.Template); err != nil {
+			return nil, err
+		}
+	}
+	if cnf.ContentType != "" {
+		s.header.Set("Content-Type", cnf.ContentType)
+	}
+	return s, nil
+}
+
+// encode renders the template with the batch, each entry has a VDC and a Document
+func (s *httpSink) encode(entries []batchEntry) ([]byte, http.Header, error) {
+	if s.template == nil {
+		body, err := json.Marshal(entries)
+		return body, s.header, err
+	}
+
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, entries); err != nil {
+		return nil, nil, err
+	}
+	return body.Bytes(), s.header, nil
+}
+
+func (s *httpSink) document(vdc string, data ElasticData) {
+	if !s.types[documentType(data)] {
+		return
+	}
+	s.output.add(batchEntry{VDC: vdc, Document: data})
+}
+
+func (s *httpSink) span(vdc string, span SpanMessage) {}
+
+func (s *httpSink) close() error {
+	s.output.close()
+	return nil
+}
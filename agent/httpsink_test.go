@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPSinkConfig(t *testing.T) {
+	for _, cnf := range []HTTPSinkConfig{
+		{Types: []string{"span"}},
+		{Template: "{{range .}}"},
+	} {
+		if _, err := parseHTTPSink(cnf); err == nil {
+			t.Errorf("expected an error for %+v", cnf)
+		}
+	}
+
+	sink, err := parseHTTPSink(HTTPSinkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sink.types["log"] || sink.types["meter"] {
+		t.Errorf("expected only logs to be sent by default %+v", sink.types)
+	}
+
+	body, _, err := sink.encode([]batchEntry{{VDC: "shop", Document: ElasticData{Log: &LogMessage{Value: "payment accepted"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `[{"vdc":"shop","document":{"@timestamp":"0001-01-01T00:00:00Z","log":{"timestamp":"0001-01-01T00:00:00Z","value":"payment accepted"}}}]` {
+		t.Errorf("unexpected default body %s", body)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	var contentType, user string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		contentType = req.Header.Get("Content-Type")
+		user, _, _ = req.BasicAuth()
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	agent, err := CreateAgent(Configuration{
+		VDCName:       "shop",
+		IgnoreElastic: true,
+		HTTPSinks: []HTTPSinkConfig{{
+			URL:         server.URL,
+			Types:       []string{"meter"},
+			Template:    `{"text":{{json (printf "%d meters of %s" (len .) (index . 0).VDC)}}}`,
+			ContentType: "application/vnd.chat+json",
+			Auth:        HTTPAuthConfig{User: "agent", Password: "123456"},
+			Batch:       BatchConfig{Size: 10, FlushInterval: time.Minute},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := agent.Handler()
+
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":12}`, nil)
+	send(handler, "POST", "/v1/log", "payment accepted", nil)
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":14}`, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := agent.Shutdown(ctx); err == nil {
+		t.Error("expected the buffered meters to still be pending when the wait time is over")
+	}
+
+	//the buffer is flushed when the sink is closed
+	lock.Lock()
+	defer lock.Unlock()
+	if len(bodies) != 1 || bodies[0] != `{"text":"2 meters of shop"}` {
+		t.Errorf("expected one templated batch with the meters %+v", bodies)
+	}
+	if contentType != "application/vnd.chat+json" || user != "agent" {
+		t.Errorf("unexpected request with content type %s and user %s", contentType, user)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	defaultKafkaVersion    = "1.0.0"
+	defaultKafkaMeterTopic = "ditas-meters"
+	defaultKafkaLogTopic   = "ditas-logs"
+	defaultKafkaSpanTopic  = "ditas-spans"
+	defaultKafkaRetries    = 3
+)
+
+// kafkaSendTimeout is how long a message waits for the producer before it is dropped, so requests
+// are not held up if kafka cannot keep up
+var kafkaSendTimeout = 100 * time.Millisecond
+
+var errKafkaBusy = errors.New("kafka producer is busy")
+
+type KafkaConfig struct {
+	Brokers []string //addresses of the kafka brokers, the sink is enabled if set
+	Version string   //kafka version of the brokers (default 1.0.0)
+
+	MeterTopic string //topic of the meters (default ditas-meters)
+	LogTopic   string //topic of the logs and alerts (default ditas-logs)
+	SpanTopic  string //topic of the finished spans (default ditas-spans)
+	Encoding   string //encoding of the messages, only json is supported (default json)
+
+	RequiredAcks  string        //acknowledgements awaited per message: none, leader or all (default all)
+	Idempotent    bool          //prevents duplicates on retries, requires kafka 0.11 and all acknowledgements
+	MaxRetries    int           //retries of a failed message before it is dropped (default 3)
+	Compression   string        //none (default), gzip, snappy, lz4 or zstd
+	BatchSize     int           //number of messages that triggers sending a batch (default 0, as soon as possible)
+	FlushInterval time.Duration //time after which a batch is sent even if it is not full
+
+	TLS  KafkaTLSConfig
+	SASL KafkaSASLConfig
+}
+
+type KafkaTLSConfig struct {
+	Enabled            bool
+	CAFile             string //certificate authority to verify the brokers, the system pool if not set
+	CertFile           string //client certificate
+	KeyFile            string //private key of the client certificate
+	InsecureSkipVerify bool   //do not verify the brokers (only for testing)
+}
+
+type KafkaSASLConfig struct {
+	Enabled  bool //authenticate with SASL/PLAIN
+	User     string
+	Password string
+}
+
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+var kafkaCompression = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// newKafkaConfig translates the configuration of the sink to a producer configuration
+func newKafkaConfig(cnf KafkaConfig) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "vdc-logging-agent"
+
+	version := cnf.Version
+	if version == "" {
+		version = defaultKafkaVersion
+	}
+	var err error
+	if config.Version, err = sarama.ParseKafkaVersion(version); err != nil {
+		return nil, fmt.Errorf("invalid kafka version %s", version)
+	}
+
+	if cnf.Encoding != "" && cnf.Encoding != "json" {
+		return nil, fmt.Errorf("unsupported encoding %s, only json is supported", cnf.Encoding)
+	}
+
+	acks := cnf.RequiredAcks
+	if acks == "" {
+		acks = "all"
+	}
+	var ok bool
+	if config.Producer.RequiredAcks, ok = kafkaAcks[acks]; !ok {
+		return nil, fmt.Errorf("unknown acknowledgement %s, expected none, leader or all", cnf.RequiredAcks)
+	}
+
+	compression := cnf.Compression
+	if compression == "" {
+		compression = "none"
+	}
+	if config.Producer.Compression, ok = kafkaCompression[compression]; !ok {
+		return nil, fmt.Errorf("unknown compression %s, expected none, gzip, snappy, lz4 or zstd", cnf.Compression)
+	}
+
+	config.Producer.Retry.Max = defaultKafkaRetries
+	if cnf.MaxRetries != 0 {
+		config.Producer.Retry.Max = cnf.MaxRetries
+	}
+	if cnf.Idempotent {
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+	config.Producer.Flush.Messages = cnf.BatchSize
+	config.Producer.Flush.Frequency = cnf.FlushInterval
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	if cnf.TLS.Enabled {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cnf.TLS.InsecureSkipVerify}
+		if cnf.TLS.CAFile != "" {
+			ca, err := ioutil.ReadFile(cnf.TLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the certificate authority %s", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", cnf.TLS.CAFile)
+			}
+		}
+		if cnf.TLS.CertFile != "" || cnf.TLS.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cnf.TLS.CertFile, cnf.TLS.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load the client certificate %s", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if cnf.SASL.Enabled {
+		if cnf.SASL.User == "" {
+			return nil, fmt.Errorf("SASL requires a user")
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = cnf.SASL.User
+		config.Net.SASL.Password = cnf.SASL.Password
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// kafkaSink publishes documents and spans as json, keyed by the VDC so all data of a VDC stays in
+// order on one partition
+type kafkaSink struct {
+	producer   sarama.AsyncProducer
+	lifecycle  *lifecycle
+	meterTopic string
+	logTopic   string
+	spanTopic  string
+	done       sync.WaitGroup
+
+	lock    sync.RWMutex
+	closed  bool
+	sending sync.WaitGroup //messages handed to the producer, it is only closed once they are
+}
+
+func newKafkaSink(cnf KafkaConfig, lifecycle *lifecycle) (*kafkaSink, error) {
+	config, err := newKafkaConfig(cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewAsyncProducer(cnf.Brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to kafka at %s: %s", strings.Join(cnf.Brokers, ","), err)
+	}
+	log.Infof("publishing to kafka at %s", strings.Join(cnf.Brokers, ","))
+
+	return startKafkaSink(cnf, producer, lifecycle), nil
+}
+
+func startKafkaSink(cnf KafkaConfig, producer sarama.AsyncProducer, lifecycle *lifecycle) *kafkaSink {
+	s := &kafkaSink{
+		producer:   producer,
+		lifecycle:  lifecycle,
+		meterTopic: cnf.MeterTopic,
+		logTopic:   cnf.LogTopic,
+		spanTopic:  cnf.SpanTopic,
+	}
+	if s.meterTopic == "" {
+		s.meterTopic = defaultKafkaMeterTopic
+	}
+	if s.logTopic == "" {
+		s.logTopic = defaultKafkaLogTopic
+	}
+	if s.spanTopic == "" {
+		s.spanTopic = defaultKafkaSpanTopic
+	}
+
+	s.done.Add(2)
+	go func() {
+		defer s.done.Done()
+		for range producer.Successes() {
+			s.lifecycle.end(nil)
+		}
+	}()
+	go func() {
+		defer s.done.Done()
+		for err := range producer.Errors() {
+			log.Errorf("could not publish to kafka topic %s: %+v", err.Msg.Topic, err.Err)
+			s.lifecycle.end(err.Err)
+		}
+	}()
+
+	return s
+}
+
+// message encodes a document or span, documents have the same format as in elastic search
+func (s *kafkaSink) message(topic, vdc string, value interface{}) (*sarama.ProducerMessage, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(vdc),
+		Value: sarama.ByteEncoder(encoded),
+	}, nil
+}
+
+func (s *kafkaSink) publish(topic, vdc string, value interface{}) {
+	msg, err := s.message(topic, vdc, value)
+	if err != nil {
+		log.Errorf("could not encode message for kafka topic %s: %+v", topic, err)
+		return
+	}
+
+	s.lock.RLock()
+	if s.closed {
+		s.lock.RUnlock()
+		log.Warnf("kafka sink is closed, dropping message for topic %s", topic)
+		return
+	}
+	s.sending.Add(1)
+	s.lock.RUnlock()
+	defer s.sending.Done()
+
+	s.lifecycle.begin()
+	timeout := time.NewTimer(kafkaSendTimeout)
+	defer timeout.Stop()
+
+	select {
+	case s.producer.Input() <- msg:
+	case <-timeout.C:
+		log.Warnf("kafka producer is busy, dropping message for topic %s", topic)
+		s.lifecycle.end(errKafkaBusy)
+	}
+}
+
+func (s *kafkaSink) document(vdc string, data ElasticData) {
+	if data.Meter != nil {
+		s.publish(s.meterTopic, vdc, data)
+	} else {
+		s.publish(s.logTopic, vdc, data)
+	}
+}
+
+func (s *kafkaSink) span(vdc string, span SpanMessage) {
+	s.publish(s.spanTopic, vdc, span)
+}
+
+// close sends the buffered messages and waits for their acknowledgements
+func (s *kafkaSink) close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.sending.Wait()
+	s.producer.AsyncClose()
+	s.done.Wait()
+	return nil
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+)
+
+func TestKafkaConfig(t *testing.T) {
+	config, err := newKafkaConfig(KafkaConfig{Idempotent: true, Compression: "zstd", Version: "2.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Producer.Idempotent || config.Producer.RequiredAcks != sarama.WaitForAll ||
+		config.Producer.Compression != sarama.CompressionZSTD || config.Net.MaxOpenRequests != 1 {
+		t.Errorf("unexpected producer configuration %+v", config.Producer)
+	}
+
+	for _, cnf := range []KafkaConfig{
+		{Version: "latest"},
+		{Encoding: "avro"},
+		{RequiredAcks: "some"},
+		{Compression: "brotli"},
+		{Idempotent: true, RequiredAcks: "leader"},
+		{Idempotent: true, Version: "0.10.2.0"},
+		{SASL: KafkaSASLConfig{Enabled: true}},
+		{TLS: KafkaTLSConfig{Enabled: true, CAFile: "missing.pem"}},
+	} {
+		if _, err := newKafkaConfig(cnf); err == nil {
+			t.Errorf("expected an error for %+v", cnf)
+		}
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	config, err := newKafkaConfig(KafkaConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := mocks.NewAsyncProducer(t, config)
+	lifecycle := &lifecycle{}
+	sink := startKafkaSink(KafkaConfig{LogTopic: "logs"}, producer, lifecycle)
+
+	expect := func(name, value string) mocks.ValueChecker {
+		return func(encoded []byte) error {
+			var message map[string]interface{}
+			if err := json.Unmarshal(encoded, &message); err != nil {
+				return err
+			}
+			if fmt.Sprint(field(message, name)) != value {
+				return fmt.Errorf("expected %s to be %s in %s", name, value, encoded)
+			}
+			return nil
+		}
+	}
+	producer.ExpectInputWithCheckerFunctionAndSucceed(expect("meter.name", "responseTime"))
+	producer.ExpectInputWithCheckerFunctionAndSucceed(expect("log.value", "payment accepted"))
+	producer.ExpectInputWithCheckerFunctionAndSucceed(expect("operation", "checkout"))
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+
+	sink.document("shop", ElasticData{Meter: &MeterMessage{Name: "responseTime", Value: 12}})
+	sink.document("shop", ElasticData{Log: &LogMessage{Value: "payment accepted"}})
+	sink.span("shop", SpanMessage{TraceId: "5e27c67030932221", Operation: "checkout"})
+
+	lifecycle.stopping()
+	sink.document("shop", ElasticData{Log: &LogMessage{Value: "lost"}})
+
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	pending, failed := lifecycle.wait(context.Background())
+	if pending != 0 || failed != 1 {
+		t.Errorf("expected all messages to be acknowledged and the failure to be counted, got %d pending and %d failed", pending, failed)
+	}
+
+	//messages after the shutdown are dropped
+	sink.document("shop", ElasticData{Log: &LogMessage{Value: "late"}})
+}
+
+func TestKafkaMessage(t *testing.T) {
+	sink := &kafkaSink{}
+	msg, err := sink.message("ditas-logs", "shop", ElasticData{Log: &LogMessage{Value: "payment accepted"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := msg.Key.Encode()
+	value, _ := msg.Value.Encode()
+	if msg.Topic != "ditas-logs" || string(key) != "shop" {
+		t.Errorf("expected the message to be keyed by the VDC %+v", msg)
+	}
+	if string(value) != `{"@timestamp":"0001-01-01T00:00:00Z","log":{"timestamp":"0001-01-01T00:00:00Z","value":"payment accepted"}}` {
+		t.Errorf("expected the document as it is written to elastic search %s", value)
+	}
+}
+
+func TestKafkaBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for _, topic := range []string{defaultKafkaMeterTopic, defaultKafkaLogTopic, defaultKafkaSpanTopic} {
+		metadata.SetLeader(topic, 0, broker.BrokerID())
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest":  sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	agent, err := CreateAgent(Configuration{
+		VDCName:       "shop",
+		IgnoreElastic: true,
+		Kafka:         KafkaConfig{Brokers: []string{broker.Addr()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := agent.Handler()
+
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":12}`, nil)
+	if rr := send(handler, "POST", "/v1/log", "payment accepted", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected the log to be accepted but got %d", rr.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agent.Shutdown(ctx); err != nil {
+		t.Fatalf("expected all messages to be delivered %+v", err)
+	}
+
+	produced := 0
+	for _, exchange := range broker.History() {
+		if _, ok := exchange.Request.(*sarama.ProduceRequest); ok {
+			produced++
+		}
+	}
+	if produced == 0 {
+		t.Error("expected the documents to be produced to the broker")
+	}
+}
+
+// busyProducer never takes messages, like a producer waiting for unreachable brokers
+type busyProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func (p *busyProducer) AsyncClose() {
+	close(p.successes)
+	close(p.errors)
+}
+
+func (p *busyProducer) Close() error {
+	p.AsyncClose()
+	return nil
+}
+
+func (p *busyProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *busyProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *busyProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func TestKafkaSinkBusy(t *testing.T) {
+	producer := &busyProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+	lifecycle := &lifecycle{}
+	sink := startKafkaSink(KafkaConfig{}, producer, lifecycle)
+
+	lifecycle.stopping()
+	start := time.Now()
+	sink.document("shop", ElasticData{Log: &LogMessage{Value: "dropped"}})
+	if elapsed := time.Since(start); elapsed > 5*kafkaSendTimeout {
+		t.Errorf("expected the message to be dropped after %s but waited %s", kafkaSendTimeout, elapsed)
+	}
+
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	pending, failed := lifecycle.wait(context.Background())
+	if pending != 0 || failed != 1 {
+		t.Errorf("expected the dropped message to be counted, got %d pending and %d failed", pending, failed)
+	}
+}
+
+func TestKafkaUnavailable(t *testing.T) {
+	_, err := CreateAgent(Configuration{
+		VDCName:       "shop",
+		IgnoreElastic: true,
+		Kafka:         KafkaConfig{Brokers: []string{"127.0.0.1:1"}},
+	})
+	if err == nil {
+		t.Error("expected the agent not to start without a reachable broker")
+	}
+}
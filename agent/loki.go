@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invalid characters of loki label names
+var lokiLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type LokiConfig struct {
+	URL    string   //push endpoint, e.g. http://loki:3100/loki/api/v1/push, the sink is enabled if set
+	Labels []string //fields used as additional labels, e.g. fields.env, named after the last part of the path
+
+	Auth  HTTPAuthConfig
+	Batch BatchConfig
+}
+
+// lokiLabel returns the label name of a field path
+func lokiLabel(path string) string {
+	name := path[strings.LastIndex(path, ".")+1:]
+	name = lokiLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// checkLokiLabels reports labels that cannot be used
+func checkLokiLabels(labels []string) error {
+	seen := map[string]string{"vdc": "the VDC", "level": "log.level"}
+	for _, path := range labels {
+		if path == "" {
+			return fmt.Errorf("label fields must not be empty")
+		}
+		name := lokiLabel(path)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s are both sent as label %s", path, other, name)
+		}
+		seen[name] = path
+	}
+	return nil
+}
+
+// lokiSink pushes logs to loki, one stream per VDC, level and the values of the configured fields
+type lokiSink struct {
+	output *batchOutput
+	labels []string
+}
+
+func newLokiSink(cnf LokiConfig, lifecycle *lifecycle) (*lokiSink, error) {
+	if err := checkLokiLabels(cnf.Labels); err != nil {
+		return nil, err
+	}
+
+	s := &lokiSink{labels: cnf.Labels}
+	s.output = newBatchOutput("loki", http.MethodPost, cnf.URL, cnf.Auth, cnf.Batch, s.encode, lifecycle)
+	log.Infof("pushing logs to loki at %s", redactURL(cnf.URL))
+	return s, nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPush struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+// streamLabels returns the labels of a log
+func (s *lokiSink) streamLabels(entry batchEntry) map[string]string {
+	labels := map[string]string{"vdc": entry.VDC}
+	if entry.Document.Log.Level != "" {
+		labels["level"] = entry.Document.Log.Level
+	}
+	for _, path := range s.labels {
+		if value, ok := getField(&entry.Document, path); ok {
+			labels[lokiLabel(path)] = fmt.Sprint(value)
+		}
+	}
+	return labels
+}
+
+// encode builds a push request, loki expects the values of a stream in order
+func (s *lokiSink) encode(entries []batchEntry) ([]byte, http.Header, error) {
+	push := lokiPush{}
+	streams := make(map[string]*lokiStream)
+	times := make(map[*lokiStream][]time.Time)
+
+	for _, entry := range entries {
+		labels := s.streamLabels(entry)
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var key strings.Builder
+		for _, name := range names {
+			key.WriteString(name + "=" + strconv.Quote(labels[name]) + ",")
+		}
+
+		stream, ok := streams[key.String()]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key.String()] = stream
+			push.Streams = append(push.Streams, stream)
+		}
+
+		timestamp := entry.Document.Log.Timestamp
+		if timestamp.IsZero() {
+			timestamp = entry.Document.Timestamp
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(timestamp.UnixNano(), 10), entry.Document.Log.Value})
+		times[stream] = append(times[stream], timestamp)
+	}
+
+	for _, stream := range push.Streams {
+		sort.Stable(byTime{stream.Values, times[stream]})
+	}
+
+	body, err := json.Marshal(push)
+	return body, http.Header{"Content-Type": {"application/json"}}, err
+}
+
+// byTime sorts the values of a stream by their timestamps
+type byTime struct {
+	values [][2]string
+	times  []time.Time
+}
+
+func (b byTime) Len() int           { return len(b.values) }
+func (b byTime) Less(i, j int) bool { return b.times[i].Before(b.times[j]) }
+func (b byTime) Swap(i, j int) {
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+}
+
+func (s *lokiSink) document(vdc string, data ElasticData) {
+	if data.Log == nil {
+		return
+	}
+	s.output.add(batchEntry{VDC: vdc, Document: data})
+}
+
+func (s *lokiSink) span(vdc string, span SpanMessage) {}
+
+func (s *lokiSink) close() error {
+	s.output.close()
+	return nil
+}
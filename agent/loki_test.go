@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLokiEncode(t *testing.T) {
+	sink := &lokiSink{labels: []string{"fields.env"}}
+	now := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	body, header, err := sink.encode([]batchEntry{
+		{VDC: "shop", Document: ElasticData{Log: &LogMessage{Timestamp: now.Add(time.Second), Value: "later"}}},
+		{VDC: "shop", Document: ElasticData{Log: &LogMessage{Timestamp: now, Value: "earlier"}}},
+		{VDC: "shop", Document: ElasticData{Log: &LogMessage{Timestamp: now, Value: "failed", Level: "error"}}},
+		{VDC: "shop", Document: ElasticData{Timestamp: now, Log: &LogMessage{Value: "deployed"}, Fields: map[string]interface{}{"env": "prod"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected content type %s", header.Get("Content-Type"))
+	}
+
+	var push lokiPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 3 {
+		t.Fatalf("expected a stream per label set but got %s", body)
+	}
+
+	plain := push.Streams[0]
+	if len(plain.Stream) != 1 || plain.Stream["vdc"] != "shop" || len(plain.Values) != 2 ||
+		plain.Values[0][1] != "earlier" || plain.Values[0][0] != "1551441600000000000" {
+		t.Errorf("expected the values of the stream to be ordered by time %+v", plain)
+	}
+	if push.Streams[1].Stream["level"] != "error" {
+		t.Errorf("expected the level as label %+v", push.Streams[1])
+	}
+	if push.Streams[2].Stream["env"] != "prod" || push.Streams[2].Values[0][0] != "1551441600000000000" {
+		t.Errorf("expected the custom field as label and the time of the document %+v", push.Streams[2])
+	}
+}
+
+func TestLokiLabels(t *testing.T) {
+	for path, label := range map[string]string{"fields.env": "env", "meter.operationID": "operationID", "k8s-pod": "k8s_pod", "1st": "_1st"} {
+		if name := lokiLabel(path); name != label {
+			t.Errorf("expected label %s for %s but got %s", label, path, name)
+		}
+	}
+
+	if err := checkLokiLabels([]string{"fields.env", "fields.level"}); err == nil {
+		t.Error("expected labels colliding with the level to be rejected")
+	}
+	if err := checkLokiLabels([]string{"fields.env", "env"}); err == nil {
+		t.Error("expected duplicate labels to be rejected")
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	var lock sync.Mutex
+	var pushes []lokiPush
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var push lokiPush
+		json.NewDecoder(req.Body).Decode(&push)
+		lock.Lock()
+		pushes = append(pushes, push)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	agent, err := CreateAgent(Configuration{
+		VDCName:       "shop",
+		IgnoreElastic: true,
+		Processors:    []ProcessorConfig{{Type: "add_fields", Fields: map[string]string{"env": "prod"}}},
+		Loki:          LokiConfig{URL: server.URL + "/loki/api/v1/push", Labels: []string{"fields.env"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := agent.Handler()
+
+	send(handler, "POST", "/v1/log", "payment accepted", nil)
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":12}`, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agent.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the log to be delivered %+v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(pushes) != 1 || len(pushes[0].Streams) != 1 {
+		t.Fatalf("expected only the log to be pushed %+v", pushes)
+	}
+	stream := pushes[0].Streams[0]
+	if stream.Stream["vdc"] != "shop" || stream.Stream["env"] != "prod" || stream.Values[0][1] != "payment accepted" {
+		t.Errorf("unexpected stream %+v", stream)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// MetadataConfig selects which information about the origin of the data is added to documents and spans.
+type MetadataConfig struct {
+	Hostname    bool //hostname of the agent
+	ContainerID bool //container id parsed from /proc/self/cgroup
+	Kubernetes  bool //pod, namespace and node taken from the POD_NAME, POD_NAMESPACE and NODE_NAME env vars
+	Build       bool //build of the agent
+	BlueprintID bool //id of the blueprint the VDC was created from
+}
+
+type Metadata struct {
+	Hostname    string `json:"hostname,omitempty"`
+	ContainerID string `json:"containerID,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Node        string `json:"node,omitempty"`
+	Build       string `json:"build,omitempty"`
+	BlueprintID string `json:"blueprintID,omitempty"`
+}
+
+var containerIDExpr = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// collectMetadata gathers all enabled metadata once, it returns nil if nothing is known.
+func collectMetadata(cnf Configuration) *Metadata {
+	meta := Metadata{}
+
+	if cnf.Metadata.Hostname {
+		meta.Hostname, _ = os.Hostname()
+	}
+
+	if cnf.Metadata.ContainerID {
+		if file, err := os.Open("/proc/self/cgroup"); err == nil {
+			meta.ContainerID = parseContainerID(file)
+			file.Close()
+		} else {
+			log.Debugf("could not read cgroup information %+v", err)
+		}
+	}
+
+	if cnf.Metadata.Kubernetes {
+		meta.Pod = os.Getenv("POD_NAME")
+		meta.Namespace = os.Getenv("POD_NAMESPACE")
+		meta.Node = os.Getenv("NODE_NAME")
+	}
+
+	if cnf.Metadata.Build {
+		meta.Build = cnf.Build
+	}
+
+	if cnf.Metadata.BlueprintID {
+		meta.BlueprintID = cnf.BlueprintID
+		if meta.BlueprintID == "" && cnf.BlueprintPath != "" {
+			meta.BlueprintID = readBlueprintID(cnf.BlueprintPath)
+		}
+	}
+
+	if meta == (Metadata{}) {
+		return nil
+	}
+
+	return &meta
+}
+
+// parseContainerID returns the last container id found in a cgroup file,
+// which works for docker, containerd and cri-o under cgroup v1 and v2.
+func parseContainerID(cgroup io.Reader) string {
+	var id string
+	scanner := bufio.NewScanner(cgroup)
+	for scanner.Scan() {
+		if match := containerIDExpr.FindString(scanner.Text()); match != "" {
+			id = match
+		}
+	}
+	return id
+}
+
+func readBlueprintID(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Debugf("could not read blueprint %s %+v", path, err)
+		return ""
+	}
+
+	var blueprint struct {
+		ID string `json:"_id"`
+	}
+
+	if err := json.Unmarshal(data, &blueprint); err != nil {
+		log.Warnf("could not parse blueprint %s %+v", path, err)
+		return ""
+	}
+
+	return blueprint.ID
+}
+
+// tags returns the metadata as span tags
+func (meta *Metadata) tags() opentracing.Tags {
+	tags := opentracing.Tags{}
+	add := func(key, value string) {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+
+	add("host.name", meta.Hostname)
+	add("container.id", meta.ContainerID)
+	add("k8s.pod.name", meta.Pod)
+	add("k8s.namespace.name", meta.Namespace)
+	add("k8s.node.name", meta.Node)
+	add("agent.build", meta.Build)
+	add("blueprint.id", meta.BlueprintID)
+
+	return tags
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseContainerID(t *testing.T) {
+	id := "4a3b6c2f0e5d4c1b9a8f7e6d5c4b3a291817161514131211100f0e0d0c0b0a09"
+
+	cgroups := map[string]string{
+		"docker":     "12:memory:/docker/" + id + "\n11:cpu:/docker/" + id + "\n",
+		"kubernetes": "11:cpuset:/kubepods/burstable/pod5f2c1c34-2a1b-11e9-b56e-0800200c9a66/" + id + "\n",
+		"cgroupv2":   "0::/system.slice/docker-" + id + ".scope\n",
+	}
+
+	for name, cgroup := range cgroups {
+		if parsed := parseContainerID(strings.NewReader(cgroup)); parsed != id {
+			t.Errorf("%s: expected %s got %s", name, id, parsed)
+		}
+	}
+
+	if parsed := parseContainerID(strings.NewReader("0::/\n")); parsed != "" {
+		t.Errorf("expected no container id outside of a container got %s", parsed)
+	}
+}
+
+func TestCollectMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blueprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blueprint.json")
+	if err := ioutil.WriteFile(path, []byte(`{"_id":"5c4f3e2a1b","INTERNAL_STRUCTURE":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("POD_NAME", "vdc-0")
+	os.Setenv("POD_NAMESPACE", "ditas")
+	defer os.Unsetenv("POD_NAME")
+	defer os.Unsetenv("POD_NAMESPACE")
+
+	meta := collectMetadata(Configuration{
+		Build:         "abc123",
+		BlueprintPath: path,
+		Metadata: MetadataConfig{
+			Kubernetes:  true,
+			Build:       true,
+			BlueprintID: true,
+		},
+	})
+
+	if meta == nil {
+		t.Fatal("expected metadata")
+	}
+
+	if meta.Pod != "vdc-0" || meta.Namespace != "ditas" || meta.Build != "abc123" || meta.BlueprintID != "5c4f3e2a1b" {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+
+	if meta.Hostname != "" {
+		t.Errorf("hostname was disabled but got %s", meta.Hostname)
+	}
+
+	tags := meta.tags()
+	if tags["k8s.pod.name"] != "vdc-0" || tags["blueprint.id"] != "5c4f3e2a1b" {
+		t.Errorf("unexpected span tags %+v", tags)
+	}
+
+	if _, ok := tags["host.name"]; ok {
+		t.Error("empty values should not become tags")
+	}
+
+	if collectMetadata(Configuration{Build: "abc123"}) != nil {
+		t.Error("expected no metadata if nothing is enabled")
+	}
+}
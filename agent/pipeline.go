@@ -0,0 +1,417 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ProcessorConfig describes one step of the processing pipeline, which fields are used depends on the Type.
+type ProcessorConfig struct {
+	Type    string            //add_fields, rename, drop_fields, grok, level, drop or keep
+	Fields  map[string]string //add_fields: values to add, supports ${vdc}, ${build}, ${hostname} and environment variables
+	Names   []string          //drop_fields: fields to remove
+	From    string            //rename: source field
+	To      string            //rename: target field
+	Field   string            //grok, level, drop, keep: field to inspect, defaults to log.value
+	Pattern string            //grok: pattern to parse; drop, keep: regex the field must match, if empty the field must exist
+}
+
+type processor interface {
+	//process changes the document in place and returns false if it should be dropped
+	process(data *ElasticData) bool
+}
+
+type pipeline []processor
+
+func newPipeline(cnf Configuration, processors []ProcessorConfig) (pipeline, error) {
+	var p pipeline
+	for i, pc := range processors {
+		proc, err := newProcessor(cnf, pc)
+		if err != nil {
+			return nil, fmt.Errorf("processor %d (%s): %s", i, pc.Type, err)
+		}
+		p = append(p, proc)
+	}
+	return p, nil
+}
+
+func (p pipeline) run(data *ElasticData) bool {
+	for _, proc := range p {
+		if !proc.process(data) {
+			return false
+		}
+	}
+	return true
+}
+
+func newProcessor(cnf Configuration, pc ProcessorConfig) (processor, error) {
+	field := pc.Field
+	if field == "" {
+		field = FieldLogValue
+	}
+
+	switch strings.ToLower(pc.Type) {
+	case "add_fields":
+		if len(pc.Fields) == 0 {
+			return nil, fmt.Errorf("no fields to add")
+		}
+		return newAddFields(cnf, pc.Fields), nil
+	case "rename":
+		if pc.From == "" || pc.To == "" {
+			return nil, fmt.Errorf("rename needs From and To")
+		}
+		return renameProcessor{from: pc.From, to: pc.To}, nil
+	case "drop_fields":
+		if len(pc.Names) == 0 {
+			return nil, fmt.Errorf("no fields to drop")
+		}
+		return dropFieldsProcessor(pc.Names), nil
+	case "grok", "regex":
+		expr, names, err := compileGrok(pc.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return grokProcessor{field: field, expr: expr, names: names}, nil
+	case "level":
+		return levelProcessor{field: field}, nil
+	case "drop", "keep":
+		cond := condition{field: field}
+		if pc.Pattern != "" {
+			expr, err := regexp.Compile(pc.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			cond.expr = expr
+		}
+		return filterProcessor{cond: cond, keep: strings.ToLower(pc.Type) == "keep"}, nil
+	default:
+		return nil, fmt.Errorf("unknown processor type")
+	}
+}
+
+type addFieldsProcessor map[string]string
+
+func newAddFields(cnf Configuration, fields map[string]string) addFieldsProcessor {
+	hostname, _ := os.Hostname()
+	mapping := func(name string) string {
+		switch name {
+		case "vdc":
+			return cnf.VDCName
+		case "build":
+			return cnf.Build
+		case "hostname":
+			return hostname
+		}
+		return os.Getenv(name)
+	}
+
+	//static values are expanded once, the result does not change while the agent runs
+	expanded := make(addFieldsProcessor)
+	for key, value := range fields {
+		expanded[key] = os.Expand(value, mapping)
+	}
+	return expanded
+}
+
+func (p addFieldsProcessor) process(data *ElasticData) bool {
+	for key, value := range p {
+		setField(data, key, value)
+	}
+	return true
+}
+
+type renameProcessor struct {
+	from string
+	to   string
+}
+
+func (p renameProcessor) process(data *ElasticData) bool {
+	if value, ok := getField(data, p.from); ok {
+		deleteField(data, p.from)
+		setField(data, p.to, value)
+	}
+	return true
+}
+
+type dropFieldsProcessor []string
+
+func (p dropFieldsProcessor) process(data *ElasticData) bool {
+	for _, name := range p {
+		deleteField(data, name)
+	}
+	return true
+}
+
+type grokProcessor struct {
+	field string
+	expr  *regexp.Regexp
+	names []string //field path of each group, e.g. log.level
+}
+
+func (p grokProcessor) process(data *ElasticData) bool {
+	value, ok := getField(data, p.field)
+	if !ok {
+		return true
+	}
+
+	match := p.expr.FindStringSubmatch(fmt.Sprint(value))
+	if match == nil {
+		return true
+	}
+
+	for i, name := range p.names {
+		if name != "" && match[i] != "" {
+			setField(data, name, match[i])
+		}
+	}
+	return true
+}
+
+var levelExpr = regexp.MustCompile(`(?i)\b(trace|debug|info|warn(?:ing)?|error|err|fatal|critical|panic)\b`)
+
+type levelProcessor struct {
+	field string
+}
+
+func (p levelProcessor) process(data *ElasticData) bool {
+	if data.Log == nil || data.Log.Level != "" {
+		return true
+	}
+
+	value, ok := getField(data, p.field)
+	if !ok {
+		return true
+	}
+
+	if match := levelExpr.FindString(fmt.Sprint(value)); match != "" {
+		data.Log.Level = normalizeLevel(match)
+	}
+	return true
+}
+
+func normalizeLevel(level string) string {
+	switch level = strings.ToLower(level); level {
+	case "warning":
+		return "warn"
+	case "err":
+		return "error"
+	case "critical":
+		return "fatal"
+	}
+	return level
+}
+
+type condition struct {
+	field string
+	expr  *regexp.Regexp //nil if the field only has to exist
+}
+
+// applies returns false for documents without the root object of the field, e.g. meters for log.value
+func (c condition) applies(data *ElasticData) bool {
+	root := strings.ToLower(c.field)
+	if i := strings.Index(root, "."); i >= 0 {
+		root = root[:i]
+	}
+	switch root {
+	case "log":
+		return data.Log != nil
+	case "meter":
+		return data.Meter != nil
+	}
+	return true
+}
+
+func (c condition) matches(data *ElasticData) bool {
+	value, ok := getField(data, c.field)
+	if !ok {
+		return false
+	}
+	return c.expr == nil || c.expr.MatchString(fmt.Sprint(value))
+}
+
+type filterProcessor struct {
+	cond condition
+	keep bool
+}
+
+func (p filterProcessor) process(data *ElasticData) bool {
+	if !p.cond.applies(data) {
+		return true
+	}
+	return p.cond.matches(data) == p.keep
+}
+
+// grokPatterns is a small subset of the logstash grok patterns
+var grokPatterns = map[string]string{
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?[0-9]+`,
+	"NUMBER":            `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"IP":                `(?:[0-9]{1,3}\.){3}[0-9]{1,3}|(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`,
+	"LOGLEVEL":          `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|severe|emerg(?:ency)?|alert|panic)`,
+	"TIMESTAMP_ISO8601": `[0-9]{4}-[0-9]{2}-[0-9]{2}[T ][0-9]{2}:[0-9]{2}(?::[0-9]{2}(?:[.,][0-9]+)?)?(?:Z|[+-][0-9]{2}:?[0-9]{2})?`,
+}
+
+var grokExpr = regexp.MustCompile(`%\{(\w+)(?::([\w.]+))?\}`)
+
+// compileGrok expands %{PATTERN:name} references into named groups, plain regular expressions are used as they are.
+// Names can be nested fields like log.level, it returns the field of each group.
+func compileGrok(pattern string) (*regexp.Regexp, []string, error) {
+	if pattern == "" {
+		return nil, nil, fmt.Errorf("no pattern given")
+	}
+
+	//group names cannot contain dots, so they are replaced and mapped back to the field
+	fields := make(map[string]string)
+	var err error
+	expanded := grokExpr.ReplaceAllStringFunc(pattern, func(ref string) string {
+		parts := grokExpr.FindStringSubmatch(ref)
+		base, ok := grokPatterns[parts[1]]
+		if !ok {
+			err = fmt.Errorf("unknown grok pattern %s", parts[1])
+			return ref
+		}
+		if parts[2] == "" {
+			return "(?:" + base + ")"
+		}
+		group := strings.Replace(parts[2], ".", "_", -1)
+		if other, ok := fields[group]; ok && other != parts[2] {
+			err = fmt.Errorf("%s and %s cannot both be captured", other, parts[2])
+		}
+		fields[group] = parts[2]
+		return "(?P<" + group + ">" + base + ")"
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expr, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := expr.SubexpNames()
+	for i, name := range names {
+		if field, ok := fields[name]; ok {
+			names[i] = field
+		}
+	}
+	return expr, names, nil
+}
+
+// getField resolves a field path of a document, paths that are not part of the
+// log or meter message are looked up in the custom fields.
+func getField(data *ElasticData, path string) (interface{}, bool) {
+	switch strings.ToLower(path) {
+	case "log.value":
+		if data.Log != nil && data.Log.Value != "" {
+			return data.Log.Value, true
+		}
+		return nil, false
+	case "log.level":
+		if data.Log != nil && data.Log.Level != "" {
+			return data.Log.Level, true
+		}
+		return nil, false
+	case "meter.name":
+		if data.Meter != nil && data.Meter.Name != "" {
+			return data.Meter.Name, true
+		}
+		return nil, false
+	case "meter.unit":
+		if data.Meter != nil && data.Meter.Unit != "" {
+			return data.Meter.Unit, true
+		}
+		return nil, false
+	case "meter.operationid":
+		if data.Meter != nil && data.Meter.OperationID != "" {
+			return data.Meter.OperationID, true
+		}
+		return nil, false
+	case "meter.value":
+		if data.Meter != nil && data.Meter.Value != nil {
+			return data.Meter.Value, true
+		}
+		return nil, false
+	case "meter.appendix":
+		if data.Meter != nil && data.Meter.Raw != "" {
+			return data.Meter.Raw, true
+		}
+		return nil, false
+	}
+
+	value, ok := data.Fields[strings.TrimPrefix(path, "fields.")]
+	return value, ok
+}
+
+func setField(data *ElasticData, path string, value interface{}) {
+	switch strings.ToLower(path) {
+	case "log.value":
+		if data.Log != nil {
+			data.Log.Value = fmt.Sprint(value)
+		}
+	case "log.level":
+		if data.Log != nil {
+			data.Log.Level = fmt.Sprint(value)
+		}
+	case "meter.name":
+		if data.Meter != nil {
+			data.Meter.Name = fmt.Sprint(value)
+		}
+	case "meter.unit":
+		if data.Meter != nil {
+			data.Meter.Unit = fmt.Sprint(value)
+		}
+	case "meter.operationid":
+		if data.Meter != nil {
+			data.Meter.OperationID = fmt.Sprint(value)
+		}
+	case "meter.value":
+		if data.Meter != nil {
+			data.Meter.Value = value
+		}
+	case "meter.appendix":
+		if data.Meter != nil {
+			data.Meter.Raw = fmt.Sprint(value)
+		}
+	default:
+		if data.Fields == nil {
+			data.Fields = make(map[string]interface{})
+		}
+		data.Fields[strings.TrimPrefix(path, "fields.")] = value
+	}
+}
+
+func deleteField(data *ElasticData, path string) {
+	switch strings.ToLower(path) {
+	case "log.value", "log.level", "meter.name", "meter.unit", "meter.operationid", "meter.appendix":
+		setField(data, path, "")
+	case "meter.value":
+		setField(data, path, nil)
+	default:
+		delete(data.Fields, strings.TrimPrefix(path, "fields."))
+	}
+}
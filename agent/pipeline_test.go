@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	os.Setenv("VDC_TEST_ENV", "staging")
+
+	p, err := newPipeline(Configuration{VDCName: "tubvdc", Build: "abc123"}, []ProcessorConfig{
+		{Type: "drop", Pattern: "healthcheck"},
+		{Type: "add_fields", Fields: map[string]string{"vdc": "${vdc}", "build": "${build}", "env": "${VDC_TEST_ENV}"}},
+		{Type: "grok", Pattern: `^%{TIMESTAMP_ISO8601:time} \[%{WORD:component}\] %{GREEDYDATA:msg}$`},
+		{Type: "level"},
+		{Type: "rename", From: "component", To: "service"},
+		{Type: "drop_fields", Names: []string{"time"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ElasticData{Log: &LogMessage{Value: "2018-02-19T12:32:32Z [VDCController] ERROR could not reach database"}}
+	if !p.run(&data) {
+		t.Fatal("document was dropped unexpectedly")
+	}
+
+	expected := map[string]interface{}{
+		"vdc":     "tubvdc",
+		"build":   "abc123",
+		"env":     "staging",
+		"service": "VDCController",
+		"msg":     "ERROR could not reach database",
+	}
+
+	for key, value := range expected {
+		if data.Fields[key] != value {
+			t.Errorf("expected field %s to be %v got %v", key, value, data.Fields[key])
+		}
+	}
+
+	if _, ok := data.Fields["time"]; ok {
+		t.Error("time field should have been dropped")
+	}
+
+	if _, ok := data.Fields["component"]; ok {
+		t.Error("component field should have been renamed")
+	}
+
+	if data.Log.Level != "error" {
+		t.Errorf("expected level error got %s", data.Log.Level)
+	}
+
+	health := ElasticData{Log: &LogMessage{Value: "GET /healthcheck 200"}}
+	if p.run(&health) {
+		t.Error("healthcheck log should have been dropped")
+	}
+}
+
+func TestPipelineKeepMeters(t *testing.T) {
+	p, err := newPipeline(Configuration{}, []ProcessorConfig{
+		{Type: "keep", Field: "meter.name", Pattern: "^response"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.run(&ElasticData{Meter: &MeterMessage{Name: "responseTime", Value: 12}}) {
+		t.Error("matching meter should be kept")
+	}
+
+	if p.run(&ElasticData{Meter: &MeterMessage{Name: "payload", Value: 12}}) {
+		t.Error("meter that does not match should be dropped")
+	}
+
+	if !p.run(&ElasticData{Log: &LogMessage{Value: "response"}}) {
+		t.Error("logs should not be filtered by a meter rule")
+	}
+}
+
+func TestPipelineNestedGrok(t *testing.T) {
+	p, err := newPipeline(Configuration{}, []ProcessorConfig{
+		{Type: "grok", Pattern: `^%{LOGLEVEL:log.level} %{WORD:http.method} %{NOTSPACE:fields.path}`},
+		{Type: "keep", Pattern: "^(?i)error"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ElasticData{Log: &LogMessage{Value: "ERROR GET /cart failed"}}
+	if !p.run(&data) {
+		t.Fatal("document was dropped unexpectedly")
+	}
+	if data.Log.Level != "ERROR" || data.Fields["http.method"] != "GET" || data.Fields["path"] != "/cart" {
+		t.Errorf("expected the captures in their fields %+v %+v", data.Log, data.Fields)
+	}
+
+	if !p.run(&ElasticData{Meter: &MeterMessage{Name: "responseTime", Value: 12}}) {
+		t.Error("meters should not be filtered by a log rule")
+	}
+}
+
+func TestPipelineInvalidConfig(t *testing.T) {
+	invalid := []ProcessorConfig{
+		{Type: "unknown"},
+		{Type: "grok", Pattern: "%{NOPE:x}"},
+		{Type: "grok", Pattern: "%{WORD:http.method} %{WORD:http_method}"},
+		{Type: "rename", From: "a"},
+		{Type: "drop", Pattern: "("},
+	}
+
+	for _, pc := range invalid {
+		if _, err := newPipeline(Configuration{}, []ProcessorConfig{pc}); err == nil {
+			t.Errorf("expected an error for %+v", pc)
+		}
+	}
+}
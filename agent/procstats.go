@@ -0,0 +1,330 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clock ticks per second used in /proc/<pid>/stat, fixed to 100 on all linux platforms we run on
+const clockTicks = 100
+
+// ProcessMetricsConfig describes which processes of the attached container are sampled.
+type ProcessMetricsConfig struct {
+	Interval time.Duration //how often processes are sampled, disabled if not set
+	Match    []string      //regexes matched against the process name and command line, all processes if empty
+	PIDs     []int         //processes that are always sampled
+	ProcRoot string        //mount point of procfs, defaults to /proc
+}
+
+type processSample struct {
+	pid     int
+	name    string
+	cmdline string
+	cpu     float64 //cpu time in seconds
+	rss     int64
+	vsize   int64
+	threads int64
+	fds     int64
+	read    int64
+	write   int64
+	rx      int64 //totals of the network namespace, not of the process
+	tx      int64
+	netns   string //network namespace, e.g. net:[4026531992], empty if it cannot be read
+	io      bool   //io counters are only readable with enough permissions
+	net     bool
+}
+
+type processCollector struct {
+	cnf     ProcessMetricsConfig
+	matches []*regexp.Regexp
+	pids    map[int]bool
+	emit    func(ElasticData)
+
+	last     map[int]processSample
+	lastTime time.Time //when last was sampled
+	self     int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newProcessCollector(cnf ProcessMetricsConfig, emit func(ElasticData)) (*processCollector, error) {
+	c := &processCollector{
+		cnf:  cnf,
+		pids: make(map[int]bool),
+		emit: emit,
+		last: make(map[int]processSample),
+		self: os.Getpid(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if c.cnf.ProcRoot == "" {
+		c.cnf.ProcRoot = "/proc"
+	}
+
+	for _, pattern := range cnf.Match {
+		expr, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process match %s: %s", pattern, err)
+		}
+		c.matches = append(c.matches, expr)
+	}
+
+	for _, pid := range cnf.PIDs {
+		c.pids[pid] = true
+	}
+
+	return c, nil
+}
+
+func (c *processCollector) start() {
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.cnf.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case now := <-ticker.C:
+				c.collect(now)
+			}
+		}
+	}()
+}
+
+func (c *processCollector) shutdown() {
+	close(c.stop)
+	<-c.done
+}
+
+// collect samples all matching processes and emits one meter per value
+func (c *processCollector) collect(now time.Time) {
+	entries, err := ioutil.ReadDir(c.cnf.ProcRoot)
+	if err != nil {
+		log.Warnf("could not read %s %+v", c.cnf.ProcRoot, err)
+		return
+	}
+
+	current := make(map[int]processSample)
+	namespaces := make(map[string]bool)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == c.self {
+			continue
+		}
+
+		sample, err := c.sample(pid)
+		if err != nil {
+			continue
+		}
+
+		if !c.pids[pid] && !c.matchesProcess(sample) {
+			continue
+		}
+
+		current[pid] = sample
+		c.report(now, sample)
+
+		//processes in the same network namespace share the counters, so they are reported once
+		if sample.net && !namespaces[sample.netns] {
+			namespaces[sample.netns] = true
+			c.reportNetwork(now, sample)
+		}
+	}
+
+	c.last = current
+	c.lastTime = now
+}
+
+func (c *processCollector) matchesProcess(sample processSample) bool {
+	if len(c.matches) == 0 {
+		return true
+	}
+
+	for _, expr := range c.matches {
+		if expr.MatchString(sample.name) || expr.MatchString(sample.cmdline) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *processCollector) report(now time.Time, sample processSample) {
+	meter := func(name, unit string, value interface{}) {
+		c.emit(ElasticData{
+			Timestamp: now,
+			Meter: &MeterMessage{
+				Timestamp: now,
+				Name:      name,
+				Unit:      unit,
+				Value:     value,
+			},
+			Fields: map[string]interface{}{
+				"pid":     sample.pid,
+				"process": sample.name,
+			},
+		})
+	}
+
+	meter("process.cpu.time", "seconds", sample.cpu)
+	//the usage is based on the time that actually passed, samples can be late
+	if last, ok := c.last[sample.pid]; ok && now.After(c.lastTime) {
+		usage := (sample.cpu - last.cpu) / now.Sub(c.lastTime).Seconds() * 100
+		meter("process.cpu.usage", "percent", usage)
+	}
+	meter("process.memory.rss", "bytes", sample.rss)
+	meter("process.memory.virtual", "bytes", sample.vsize)
+	meter("process.threads", "count", sample.threads)
+	meter("process.fd.open", "count", sample.fds)
+
+	if sample.io {
+		meter("process.io.read", "bytes", sample.read)
+		meter("process.io.write", "bytes", sample.write)
+	}
+
+}
+
+// reportNetwork writes the network counters of the namespace of a process
+func (c *processCollector) reportNetwork(now time.Time, sample processSample) {
+	meter := func(name string, value int64) {
+		fields := map[string]interface{}{"pid": sample.pid}
+		if sample.netns != "" {
+			fields["netns"] = sample.netns
+		}
+		c.emit(ElasticData{
+			Timestamp: now,
+			Meter: &MeterMessage{
+				Timestamp: now,
+				Name:      name,
+				Unit:      "bytes",
+				Value:     value,
+			},
+			Fields: fields,
+		})
+	}
+
+	meter("network.receive", sample.rx)
+	meter("network.transmit", sample.tx)
+}
+
+func (c *processCollector) sample(pid int) (processSample, error) {
+	dir := filepath.Join(c.cnf.ProcRoot, strconv.Itoa(pid))
+	sample := processSample{pid: pid}
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return sample, err
+	}
+	if err := parseStat(string(stat), &sample); err != nil {
+		return sample, err
+	}
+
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		sample.cmdline = strings.TrimSpace(string(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1)))
+	}
+
+	if fds, err := ioutil.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		sample.fds = int64(len(fds))
+	}
+
+	if file, err := os.Open(filepath.Join(dir, "io")); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			value, _ := strconv.ParseInt(fields[1], 10, 64)
+			switch fields[0] {
+			case "read_bytes:":
+				sample.read = value
+				sample.io = true
+			case "write_bytes:":
+				sample.write = value
+			}
+		}
+		file.Close()
+	}
+
+	if netns, err := os.Readlink(filepath.Join(dir, "ns", "net")); err == nil {
+		sample.netns = netns
+	}
+	if file, err := os.Open(filepath.Join(dir, "net", "dev")); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			colon := strings.IndexByte(line, ':')
+			if colon < 0 || strings.TrimSpace(line[:colon]) == "lo" {
+				continue
+			}
+			fields := strings.Fields(line[colon+1:])
+			if len(fields) < 9 {
+				continue
+			}
+			rx, _ := strconv.ParseInt(fields[0], 10, 64)
+			tx, _ := strconv.ParseInt(fields[8], 10, 64)
+			sample.rx += rx
+			sample.tx += tx
+			sample.net = true
+		}
+		file.Close()
+	}
+
+	return sample, nil
+}
+
+// parseStat reads the fields of /proc/<pid>/stat, see proc(5)
+func parseStat(stat string, sample *processSample) error {
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return fmt.Errorf("invalid stat format")
+	}
+	sample.name = stat[open+1 : end]
+
+	//fields after the name start with the state, which is field 3
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return fmt.Errorf("invalid stat format")
+	}
+
+	field := func(n int) int64 {
+		value, _ := strconv.ParseInt(fields[n-3], 10, 64)
+		return value
+	}
+
+	sample.cpu = float64(field(14)+field(15)) / clockTicks
+	sample.threads = field(20)
+	sample.vsize = field(23)
+	sample.rss = field(24) * int64(os.Getpagesize())
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeProcFile(t *testing.T, root, name, content string) {
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessCollector(t *testing.T) {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	//a java based VDC and a shell that should not be matched
+	writeProcFile(t, root, "42/stat", "42 (java) S 1 42 42 0 -1 4194560 1000 0 0 0 250 50 0 0 20 0 31 0 100 2147483648 5000 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0")
+	writeProcFile(t, root, "42/cmdline", "java\x00-jar\x00vdc.jar\x00")
+	writeProcFile(t, root, "42/io", "rchar: 100\nwchar: 200\nread_bytes: 4096\nwrite_bytes: 8192\n")
+	writeProcFile(t, root, "42/net/dev", "Inter-|   Receive |  Transmit\n face |bytes packets errs drop fifo frame compressed multicast|bytes packets errs drop fifo colls carrier compressed\n    lo: 999 1 0 0 0 0 0 0 999 1 0 0 0 0 0 0\n  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n")
+	writeProcFile(t, root, "43/stat", "43 (java) S 1 43 43 0 -1 4194560 1000 0 0 0 0 0 0 0 20 0 1 0 100 1000 10 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0")
+	writeProcFile(t, root, "43/cmdline", "java\x00-jar\x00vdc.jar\x00")
+	writeProcFile(t, root, "43/net/dev", "Inter-|   Receive |  Transmit\n  eth0: 1000 10 0 0 0 0 0 0 2000 20 0 0 0 0 0 0\n")
+	for _, pid := range []string{"42", "43"} {
+		os.MkdirAll(filepath.Join(root, pid, "ns"), 0755)
+		if err := os.Symlink("net:[4026531992]", filepath.Join(root, pid, "ns", "net")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeProcFile(t, root, "42/fd/0", "")
+	writeProcFile(t, root, "42/fd/1", "")
+	writeProcFile(t, root, "7/stat", "7 (sh) S 1 7 7 0 -1 4194560 0 0 0 0 1 1 0 0 20 0 1 0 100 1000 10 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0")
+	writeProcFile(t, root, "self/stat", "not a process")
+
+	meters := make(map[string]interface{})
+	reported := make(map[string]int)
+	collector, err := newProcessCollector(ProcessMetricsConfig{
+		Interval: time.Second,
+		Match:    []string{"vdc\\.jar"},
+		ProcRoot: root,
+	}, func(data ElasticData) {
+		reported[data.Meter.Name]++
+		if data.Fields["pid"] == 7 {
+			t.Errorf("unexpected process %+v", data.Fields)
+		}
+		if data.Fields["pid"] != 42 {
+			return
+		}
+		meters[data.Meter.Name] = data.Meter.Value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	collector.collect(start)
+
+	expect := map[string]interface{}{
+		"process.cpu.time":       3.0,
+		"process.memory.rss":     int64(5000 * os.Getpagesize()),
+		"process.memory.virtual": int64(2147483648),
+		"process.threads":        int64(31),
+		"process.fd.open":        int64(2),
+		"process.io.read":        int64(4096),
+		"process.io.write":       int64(8192),
+		"network.receive":        int64(1000),
+		"network.transmit":       int64(2000),
+	}
+
+	for name, value := range expect {
+		if meters[name] != value {
+			t.Errorf("expected %s to be %v got %v", name, value, meters[name])
+		}
+	}
+
+	if _, ok := meters["process.cpu.usage"]; ok {
+		t.Error("cpu usage needs two samples")
+	}
+	if reported["process.threads"] != 2 || reported["network.receive"] != 1 {
+		t.Errorf("expected the network of the shared namespace to be reported once %+v", reported)
+	}
+
+	//one more second of cpu time within a late sample after two seconds is 50 percent
+	writeProcFile(t, root, "42/stat", "42 (java) S 1 42 42 0 -1 4194560 1000 0 0 0 300 100 0 0 20 0 31 0 100 2147483648 5000 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0")
+	collector.collect(start.Add(2 * time.Second))
+
+	if meters["process.cpu.usage"] != 50.0 {
+		t.Errorf("expected cpu usage of 50 percent got %v", meters["process.cpu.usage"])
+	}
+}
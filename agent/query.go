@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+const (
+	defaultQuerySize = 100
+	maxQuerySize     = 1000
+)
+
+type QueryResult struct {
+	Total int64         `json:"total"`
+	Hits  []ElasticData `json:"hits"`
+	Next  string        `json:"next,omitempty"` //pass as search_after to get the next page
+}
+
+// QueryMeter returns the stored meters of the VDC
+func (agent *Agent) QueryMeter(w http.ResponseWriter, req *http.Request) {
+	agent.query(w, req, meterQuery(req.URL.Query()))
+}
+
+// meterQuery selects meters by the name and operationID parameters
+func meterQuery(params url.Values) *elastic.BoolQuery {
+	query := elastic.NewBoolQuery().Filter(elastic.NewExistsQuery("meter"))
+
+	if name := params.Get("name"); name != "" {
+		query = query.Filter(elastic.NewMatchPhraseQuery("meter.name", name))
+	}
+
+	if operationID := params.Get("operationID"); operationID != "" {
+		query = query.Filter(elastic.NewMatchPhraseQuery("meter.operationID", operationID))
+	}
+
+	return query
+}
+
+// QueryLog returns the stored logs of the VDC
+func (agent *Agent) QueryLog(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	query := elastic.NewBoolQuery().Filter(elastic.NewExistsQuery("log"))
+
+	if text := params.Get("q"); text != "" {
+		query = query.Must(elastic.NewMatchQuery("log.value", text).Operator("and"))
+	}
+
+	if level := params.Get("level"); level != "" {
+		query = query.Filter(elastic.NewMatchPhraseQuery("log.level", level))
+	}
+
+	agent.query(w, req, query)
+}
+
+func (agent *Agent) query(w http.ResponseWriter, req *http.Request, query *elastic.BoolQuery) {
+	client := agent.backends().elastic
+	if client == nil {
+		writeError(w, http.StatusServiceUnavailable, "no elastic search available")
+		return
+	}
+
+	params := req.URL.Query()
+
+	timeRange, err := parseTimeRange(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if timeRange != nil {
+		query = query.Filter(timeRange)
+	}
+
+	size := defaultQuerySize
+	if value := params.Get("size"); value != "" {
+		if size, err = strconv.Atoi(value); err != nil || size <= 0 || size > maxQuerySize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("size must be between 1 and %d", maxQuerySize))
+			return
+		}
+	}
+
+	ascending := false
+	switch params.Get("sort") {
+	case "", "desc":
+	case "asc":
+		ascending = true
+	default:
+		writeError(w, http.StatusBadRequest, "sort must be asc or desc")
+		return
+	}
+
+	search := client.Search(agent.getElasticIndex()).
+		Query(query).
+		Size(size).
+		Sort("@timestamp", ascending).
+		//_id has no doc values, documents written before the id field existed share the missing value
+		SortBy(elastic.NewFieldSort("id").Order(ascending).UnmappedType("keyword"))
+
+	if token := params.Get("search_after"); token != "" {
+		values, err := decodeSearchAfter(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid search_after")
+			return
+		}
+		search = search.SearchAfter(values...)
+	}
+
+	result, err := search.Do(req.Context())
+	if err != nil {
+		log.Errorf("could not query elastic search %+v", err)
+		writeError(w, http.StatusBadGateway, "could not query elastic search")
+		return
+	}
+
+	response := QueryResult{
+		Total: result.TotalHits(),
+		Hits:  make([]ElasticData, 0, len(result.Hits.Hits)),
+	}
+
+	for _, hit := range result.Hits.Hits {
+		var data ElasticData
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &data) != nil {
+			continue
+		}
+		response.Hits = append(response.Hits, data)
+	}
+
+	if hits := result.Hits.Hits; len(hits) == size {
+		response.Next = encodeSearchAfter(hits[len(hits)-1].Sort)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// parseTimeRange reads the from and to parameters (RFC 3339), it returns nil if none is set
+func parseTimeRange(params url.Values) (*elastic.RangeQuery, error) {
+	from, to := params.Get("from"), params.Get("to")
+	if from == "" && to == "" {
+		return nil, nil
+	}
+
+	timeRange := elastic.NewRangeQuery("@timestamp")
+	if from != "" {
+		stamp, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("from must be a RFC 3339 timestamp")
+		}
+		timeRange = timeRange.Gte(stamp)
+	}
+
+	if to != "" {
+		stamp, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("to must be a RFC 3339 timestamp")
+		}
+		timeRange = timeRange.Lte(stamp)
+	}
+
+	return timeRange, nil
+}
+
+func encodeSearchAfter(values []interface{}) string {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSearchAfter(token string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty search_after")
+	}
+	return values, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("could not write response %+v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
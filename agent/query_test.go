@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olivere/elastic"
+)
+
+func TestQueryMeter(t *testing.T) {
+	var search map[string]interface{}
+	var path string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &search)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"took":1,"hits":{"total":3,"hits":[
+			{"_id":"a","_source":{"id":"6f1ed002ab5595859014ebf0951522d9","@timestamp":"2018-02-19T12:32:32Z","meter":{"name":"responseTime","value":12}},"sort":[1519043552000,"6f1ed002ab5595859014ebf0951522d9"]},
+			{"_id":"b","_source":{"id":"8b1a9953c4611296a827abf8c47804d7","@timestamp":"2018-02-19T12:32:31Z","meter":{"name":"responseTime","value":14}},"sort":[1519043551000,"8b1a9953c4611296a827abf8c47804d7"]}
+		]}}`))
+	}))
+	defer es.Close()
+
+	client, err := elastic.NewSimpleClient(elastic.SetURL(es.URL), elastic.SetSniff(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := Agent{name: "test", elastic: client}
+
+	req := httptest.NewRequest("GET", "/v1/meter?name=responseTime&from=2018-02-19T00:00:00Z&size=2", nil)
+	rr := httptest.NewRecorder()
+	agent.QueryMeter(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if !strings.HasSuffix(path, "/_search") || !strings.Contains(path, agent.getElasticIndex()) {
+		t.Errorf("unexpected search path %s", path)
+	}
+
+	query, _ := json.Marshal(search["query"])
+	for _, expected := range []string{`"meter.name":{"query":"responseTime"}`, `"@timestamp"`, `"exists":{"field":"meter"}`} {
+		if !strings.Contains(string(query), expected) {
+			t.Errorf("query %s does not contain %s", query, expected)
+		}
+	}
+
+	//_id has no doc values, the unique id field breaks ties between equal timestamps
+	sort, _ := json.Marshal(search["sort"])
+	if string(sort) != `[{"@timestamp":{"order":"desc"}},{"id":{"order":"desc","unmapped_type":"keyword"}}]` {
+		t.Errorf("unexpected sort %s", sort)
+	}
+
+	var result QueryResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Total != 3 || len(result.Hits) != 2 || result.Hits[1].Meter.Value != 14.0 {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	if result.Next == "" {
+		t.Fatal("expected a token for the next page")
+	}
+
+	//the token is passed on as search_after
+	req = httptest.NewRequest("GET", "/v1/meter?size=2&search_after="+result.Next, nil)
+	agent.QueryMeter(httptest.NewRecorder(), req)
+
+	after, _ := json.Marshal(search["search_after"])
+	if string(after) != `[1519043551000,"8b1a9953c4611296a827abf8c47804d7"]` {
+		t.Errorf("unexpected search_after %s", after)
+	}
+}
+
+func TestQueryInvalidParameters(t *testing.T) {
+	client, err := elastic.NewSimpleClient(elastic.SetURL("http://127.0.0.1:1"), elastic.SetSniff(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := Agent{name: "test", elastic: client}
+
+	for _, query := range []string{"from=yesterday", "size=0", "size=100000", "sort=up", "search_after=not-a-token!"} {
+		rr := httptest.NewRecorder()
+		agent.QueryLog(rr, httptest.NewRequest("GET", "/v1/log?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d got %d", query, http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	(&Agent{name: "test"}).QueryLog(rr, httptest.NewRequest("GET", "/v1/log", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d without elastic search got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
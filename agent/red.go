@@ -0,0 +1,327 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxOpenSpans = 10000
+	maxSpanAge   = time.Hour
+)
+
+// upper bounds of the latency histogram in seconds
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type SpanMetricsConfig struct {
+	Interval time.Duration //how often the metrics are written as meters, disabled if not set
+	Buckets  []float64     //upper bounds of the latency histogram in seconds
+}
+
+type operationStats struct {
+	count    uint64
+	errors   uint64
+	observed uint64   //requests with a known duration, closes without a trace have none
+	sum      float64  //sum of all durations in seconds
+	buckets  []uint64 //observations per bucket, the last one counts everything above the highest bound
+}
+
+func (s *operationStats) request(failed bool) {
+	s.count++
+	if failed {
+		s.errors++
+	}
+}
+
+func (s *operationStats) observe(bounds []float64, seconds float64) {
+	s.observed++
+	s.sum += seconds
+
+	i := sort.SearchFloat64s(bounds, seconds)
+	s.buckets[i]++
+}
+
+// quantile estimates the q-quantile by interpolating within the histogram bucket
+func (s *operationStats) quantile(bounds []float64, q float64) float64 {
+	if s.observed == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.observed)
+	var seen uint64
+	for i, n := range s.buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(bounds) {
+			return bounds[len(bounds)-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		return lower + (bounds[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return bounds[len(bounds)-1]
+}
+
+// openSpan is a span that was traced but not closed yet
+type openSpan struct {
+	key string
+	at  time.Time
+}
+
+// spanMetrics derives request rate, errors and duration (RED) per operation from finished spans
+type spanMetrics struct {
+	cnf    SpanMetricsConfig
+	bounds []float64
+
+	lock    sync.Mutex
+	started map[string]*list.Element   //open spans, elements of opened
+	opened  *list.List                 //open spans from the oldest to the newest
+	evicted uint64                     //open spans that were forgotten before they were closed
+	total   map[string]*operationStats //since the start of the agent
+	window  map[string]*operationStats //since the last flush
+	last    time.Time
+
+	emit func(ElasticData)
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSpanMetrics(cnf SpanMetricsConfig, emit func(ElasticData)) *spanMetrics {
+	bounds := append([]float64{}, cnf.Buckets...)
+	if len(bounds) == 0 {
+		bounds = defaultLatencyBuckets
+	}
+	sort.Float64s(bounds)
+
+	return &spanMetrics{
+		cnf:     cnf,
+		bounds:  bounds,
+		started: make(map[string]*list.Element),
+		opened:  list.New(),
+		total:   make(map[string]*operationStats),
+		window:  make(map[string]*operationStats),
+		last:    time.Now(),
+		emit:    emit,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (m *spanMetrics) start() {
+	go func() {
+		defer close(m.done)
+		if m.cnf.Interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(m.cnf.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-m.stop:
+				return
+			case now := <-ticker.C:
+				m.flush(now)
+			}
+		}
+	}()
+}
+
+func (m *spanMetrics) shutdown() {
+	close(m.stop)
+	<-m.done
+}
+
+// begin remembers when a span was first seen
+func (m *spanMetrics) begin(trace TraceMessage, now time.Time) {
+	key := trace.TraceId + trace.SpanId
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.started[key]; ok {
+		return
+	}
+
+	//spans that are never closed must not grow the map forever, the oldest ones are forgotten first
+	for oldest := m.opened.Front(); oldest != nil; oldest = m.opened.Front() {
+		span := oldest.Value.(openSpan)
+		if len(m.started) < maxOpenSpans && now.Sub(span.at) <= maxSpanAge {
+			break
+		}
+		m.opened.Remove(oldest)
+		delete(m.started, span.key)
+		m.evicted++
+	}
+	m.started[key] = m.opened.PushBack(openSpan{key: key, at: now})
+}
+
+// finish records a span closed via /v1/close, spans that were never traced before have no duration
+func (m *spanMetrics) finish(trace TraceMessage, now time.Time) {
+	key := trace.TraceId + trace.SpanId
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	failed := isFailed(trace.Tags)
+	total, window := m.stats(m.total, trace.Operation), m.stats(m.window, trace.Operation)
+	total.request(failed)
+	window.request(failed)
+
+	//without a trace the duration is unknown, the request is counted but not observed
+	if element, ok := m.started[key]; ok {
+		duration := now.Sub(element.Value.(openSpan).at).Seconds()
+		m.opened.Remove(element)
+		delete(m.started, key)
+		total.observe(m.bounds, duration)
+		window.observe(m.bounds, duration)
+	}
+}
+
+func (m *spanMetrics) stats(set map[string]*operationStats, operation string) *operationStats {
+	s, ok := set[operation]
+	if !ok {
+		s = &operationStats{buckets: make([]uint64, len(m.bounds)+1)}
+		set[operation] = s
+	}
+	return s
+}
+
+// isFailed follows the opentracing conventions, spans are failed if tagged as error or with a 5xx status
+func isFailed(tags map[string]string) bool {
+	if failed, err := strconv.ParseBool(tags["error"]); err == nil && failed {
+		return true
+	}
+	status, err := strconv.Atoi(tags["http.status_code"])
+	return err == nil && status >= 500
+}
+
+// flush writes the metrics of the passed interval as meters
+func (m *spanMetrics) flush(now time.Time) {
+	m.lock.Lock()
+	window := m.window
+	seconds := now.Sub(m.last).Seconds()
+	m.window = make(map[string]*operationStats)
+	m.last = now
+	m.lock.Unlock()
+
+	if seconds <= 0 {
+		return
+	}
+
+	for operation, s := range window {
+		meters := []MeterMessage{
+			{Name: "red.requests", Value: s.count},
+			{Name: "red.request.rate", Value: float64(s.count) / seconds, Unit: "1/s"},
+			{Name: "red.errors", Value: s.errors},
+			{Name: "red.error.rate", Value: float64(s.errors) / float64(s.count), Unit: "ratio"},
+		}
+		if s.observed > 0 {
+			meters = append(meters,
+				MeterMessage{Name: "red.duration.avg", Value: s.sum / float64(s.observed), Unit: "s"},
+				MeterMessage{Name: "red.duration.p50", Value: s.quantile(m.bounds, .5), Unit: "s"},
+				MeterMessage{Name: "red.duration.p95", Value: s.quantile(m.bounds, .95), Unit: "s"},
+				MeterMessage{Name: "red.duration.p99", Value: s.quantile(m.bounds, .99), Unit: "s"},
+			)
+		}
+
+		for i := range meters {
+			meters[i].Timestamp = now
+			meters[i].OperationID = operation
+			m.emit(ElasticData{Timestamp: now, Meter: &meters[i]})
+		}
+	}
+}
+
+// writePrometheus writes all metrics since the start of the agent in the prometheus text format
+func (m *spanMetrics) writePrometheus(out io.Writer, vdc string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	operations := make([]string, 0, len(m.total))
+	for operation := range m.total {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	labels := func(operation string) string {
+		return fmt.Sprintf("vdc=\"%s\",operation=\"%s\"", escapeLabel(vdc), escapeLabel(operation))
+	}
+
+	fmt.Fprintln(out, "# HELP vdc_requests_total Requests finished via /v1/close.")
+	fmt.Fprintln(out, "# TYPE vdc_requests_total counter")
+	for _, operation := range operations {
+		fmt.Fprintf(out, "vdc_requests_total{%s} %d\n", labels(operation), m.total[operation].count)
+	}
+
+	fmt.Fprintln(out, "# HELP vdc_request_errors_total Failed requests finished via /v1/close.")
+	fmt.Fprintln(out, "# TYPE vdc_request_errors_total counter")
+	for _, operation := range operations {
+		fmt.Fprintf(out, "vdc_request_errors_total{%s} %d\n", labels(operation), m.total[operation].errors)
+	}
+
+	fmt.Fprintln(out, "# HELP vdc_open_spans_evicted_total Traced spans that were forgotten because too many were open or they were never closed.")
+	fmt.Fprintln(out, "# TYPE vdc_open_spans_evicted_total counter")
+	fmt.Fprintf(out, "vdc_open_spans_evicted_total{vdc=\"%s\"} %d\n", escapeLabel(vdc), m.evicted)
+
+	fmt.Fprintln(out, "# HELP vdc_request_duration_seconds Duration of the requests.")
+	fmt.Fprintln(out, "# TYPE vdc_request_duration_seconds histogram")
+	for _, operation := range operations {
+		s := m.total[operation]
+		var cumulative uint64
+		for i, bound := range m.bounds {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(out, "vdc_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels(operation), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "vdc_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(operation), s.observed)
+		fmt.Fprintf(out, "vdc_request_duration_seconds_sum{%s} %s\n", labels(operation), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(out, "vdc_request_duration_seconds_count{%s} %d\n", labels(operation), s.observed)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// Metrics exposes the request metrics derived from the traced spans in the prometheus text format
+func (agent *Agent) Metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	if agent.metrics != nil {
+		agent.metrics.writePrometheus(w, agent.name)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpanMetrics(t *testing.T) {
+	meters := make(map[string]interface{})
+	metrics := newSpanMetrics(SpanMetricsConfig{Buckets: []float64{1, 0.1, 0.5}}, func(data ElasticData) {
+		if data.Meter.OperationID == "getData" {
+			meters[data.Meter.Name] = data.Meter.Value
+		}
+	})
+
+	start := time.Now()
+	metrics.last = start
+
+	durations := []time.Duration{50 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 2 * time.Second}
+	for i, duration := range durations {
+		trace := TraceMessage{TraceId: "a", SpanId: string(rune('0' + i)), Operation: "getData"}
+		if i == 3 {
+			trace.Tags = map[string]string{"http.status_code": "503"}
+		}
+		metrics.begin(trace, start)
+		metrics.begin(trace, start.Add(time.Millisecond)) //updates do not restart the span
+		metrics.finish(trace, start.Add(duration))
+	}
+	//closes without a trace are counted, but their duration is unknown
+	metrics.finish(TraceMessage{TraceId: "c", SpanId: "1", Operation: "getData"}, start.Add(time.Hour))
+	metrics.finish(TraceMessage{TraceId: "b", SpanId: "1", Operation: "put\"Data", Tags: map[string]string{"error": "true"}}, start)
+
+	metrics.flush(start.Add(2 * time.Second))
+
+	expected := map[string]float64{
+		"red.requests":     5,
+		"red.request.rate": 2.5,
+		"red.errors":       1,
+		"red.error.rate":   0.2,
+		"red.duration.avg": 0.6375,
+		"red.duration.p50": 0.3,
+		"red.duration.p99": 1,
+	}
+	for name, value := range expected {
+		actual, ok := toFloat(meters[name])
+		if !ok || math.Abs(actual-value) > 1e-9 {
+			t.Errorf("expected %s to be %g but was %v", name, value, meters[name])
+		}
+	}
+
+	//the window is reset after each flush
+	meters = make(map[string]interface{})
+	metrics.flush(start.Add(4 * time.Second))
+	if len(meters) != 0 {
+		t.Errorf("expected no meters for an empty interval but got %v", meters)
+	}
+
+	var out bytes.Buffer
+	metrics.writePrometheus(&out, "vdc")
+	text := out.String()
+
+	for _, line := range []string{
+		`vdc_requests_total{vdc="vdc",operation="getData"} 5`,
+		`vdc_request_errors_total{vdc="vdc",operation="put\"Data"} 1`,
+		`vdc_request_duration_seconds_bucket{vdc="vdc",operation="getData",le="0.1"} 1`,
+		`vdc_request_duration_seconds_bucket{vdc="vdc",operation="getData",le="0.5"} 3`,
+		`vdc_request_duration_seconds_bucket{vdc="vdc",operation="getData",le="+Inf"} 4`,
+		`vdc_request_duration_seconds_count{vdc="vdc",operation="getData"} 4`,
+		`vdc_request_duration_seconds_sum{vdc="vdc",operation="getData"} 2.55`,
+		`vdc_request_duration_seconds_bucket{vdc="vdc",operation="put\"Data",le="+Inf"} 0`,
+		`vdc_request_duration_seconds_count{vdc="vdc",operation="put\"Data"} 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected %s in\n%s", line, text)
+		}
+	}
+}
+
+func TestSpanMetricsOpenSpans(t *testing.T) {
+	metrics := newSpanMetrics(SpanMetricsConfig{}, func(data ElasticData) {})
+
+	start := time.Now()
+	for i := 0; i < maxOpenSpans+5; i++ {
+		metrics.begin(TraceMessage{TraceId: "a", SpanId: strconv.Itoa(i)}, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(metrics.started) != maxOpenSpans || metrics.opened.Len() != maxOpenSpans || metrics.evicted != 5 {
+		t.Fatalf("expected the oldest spans to be evicted, %d open and %d evicted", len(metrics.started), metrics.evicted)
+	}
+	if _, ok := metrics.started["a4"]; ok {
+		t.Error("expected the oldest spans to be evicted first")
+	}
+
+	//closing a span frees its place, spans older than the maximum age are forgotten
+	metrics.finish(TraceMessage{TraceId: "a", SpanId: "5", Operation: "getData"}, start.Add(time.Second))
+	metrics.begin(TraceMessage{TraceId: "b", SpanId: "1"}, start.Add(2*maxSpanAge))
+	if len(metrics.started) != 1 || metrics.evicted != 5+maxOpenSpans-1 {
+		t.Errorf("expected only the new span to be open, %d open and %d evicted", len(metrics.started), metrics.evicted)
+	}
+
+	var out bytes.Buffer
+	metrics.writePrometheus(&out, "vdc")
+	if line := fmt.Sprintf(`vdc_open_spans_evicted_total{vdc="vdc"} %d`, metrics.evicted); !strings.Contains(out.String(), line+"\n") {
+		t.Errorf("expected %s in\n%s", line, out.String())
+	}
+}
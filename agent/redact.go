@@ -0,0 +1,252 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// fields that can be targeted by redaction rules
+const (
+	FieldLogValue      = "log.value"
+	FieldTraceMessage  = "trace.message"
+	FieldTraceTags     = "trace.tags"
+	FieldMeterAppendix = "meter.appendix"
+)
+
+// actions a redaction rule can perform on a match
+const (
+	ActionMask = "mask"
+	ActionHash = "hash"
+	ActionDrop = "drop"
+)
+
+// built-in detectors that can be referenced by name instead of a pattern
+var detectors = map[string]string{
+	"email":      `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"iban":       `\b[A-Z]{2}[0-9]{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`,
+	"ip":         `\b(?:(?:25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1?[0-9]?[0-9])\b|\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b`,
+	"nationalid": `\b[0-9]{3}-[0-9]{2}-[0-9]{4}\b|\b[0-9]{2}[ .]?[0-9]{3}[ .]?[0-9]{3}[ .]?[0-9]{3}\b`,
+}
+
+type RedactionConfig struct {
+	DryRun    bool            //only report what would be redacted, do not change any data
+	Mask      string          //replacement used by the mask action, defaults to "****"
+	Secret    string          //key of the HMAC-SHA256 used by the hash action, without it hashes of guessable values can be reversed
+	Detectors []string        //built-in detectors applied to all fields (email, iban, ip, nationalid)
+	Rules     []RedactionRule //custom rules
+}
+
+type RedactionRule struct {
+	Name     string   //used in reports, defaults to the pattern or detector
+	Pattern  string   //regular expression to look for
+	Detector string   //name of a built-in detector, used if no pattern is set
+	Fields   []string //fields this rule is applied to, all fields if empty
+	Action   string   //mask (default), hash or drop
+}
+
+type redactionRule struct {
+	name   string
+	expr   *regexp.Regexp //nil if the rule targets the whole field
+	fields map[string]bool
+	action string
+}
+
+type redactor struct {
+	rules  []redactionRule
+	dryRun bool
+	mask   string
+	secret []byte
+}
+
+func newRedactor(cnf RedactionConfig) (*redactor, error) {
+	r := &redactor{
+		dryRun: cnf.DryRun,
+		mask:   cnf.Mask,
+		secret: []byte(cnf.Secret),
+	}
+
+	if r.mask == "" {
+		r.mask = "****"
+	}
+
+	for _, name := range cnf.Detectors {
+		rule, err := compileRule(RedactionRule{Detector: name})
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	for _, rule := range cnf.Rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, compiled)
+	}
+
+	return r, nil
+}
+
+func compileRule(rule RedactionRule) (redactionRule, error) {
+	compiled := redactionRule{
+		name:   rule.Name,
+		action: strings.ToLower(rule.Action),
+	}
+
+	if compiled.action == "" {
+		compiled.action = ActionMask
+	}
+
+	switch compiled.action {
+	case ActionMask, ActionHash, ActionDrop:
+	default:
+		return compiled, fmt.Errorf("redaction rule %s has unknown action %s", rule.Name, rule.Action)
+	}
+
+	pattern := rule.Pattern
+	if pattern == "" && rule.Detector != "" {
+		var ok bool
+		if pattern, ok = detectors[strings.ToLower(rule.Detector)]; !ok {
+			return compiled, fmt.Errorf("unknown redaction detector %s", rule.Detector)
+		}
+		if compiled.name == "" {
+			compiled.name = rule.Detector
+		}
+	}
+
+	if pattern != "" {
+		expr, err := regexp.Compile(pattern)
+		if err != nil {
+			return compiled, fmt.Errorf("redaction rule %s has invalid pattern: %s", rule.Name, err)
+		}
+		compiled.expr = expr
+		if compiled.name == "" {
+			compiled.name = pattern
+		}
+	} else if len(rule.Fields) == 0 {
+		return compiled, fmt.Errorf("redaction rule %s needs a pattern, detector or fields", rule.Name)
+	}
+
+	if len(rule.Fields) > 0 {
+		compiled.fields = make(map[string]bool)
+		for _, field := range rule.Fields {
+			compiled.fields[strings.ToLower(field)] = true
+		}
+	}
+
+	if compiled.name == "" {
+		compiled.name = strings.Join(rule.Fields, ",")
+	}
+
+	return compiled, nil
+}
+
+func (r *redactor) applies(rule redactionRule, field string) bool {
+	return rule.fields == nil || rule.fields[field]
+}
+
+// redact runs all rules for the given field against the value and returns the result.
+// In dry-run mode the value is returned unchanged and the findings are reported instead.
+func (r *redactor) redact(field, value string) string {
+	if value == "" {
+		return value
+	}
+
+	result := value
+	for _, rule := range r.rules {
+		if !r.applies(rule, field) {
+			continue
+		}
+
+		if rule.expr == nil {
+			if r.dryRun {
+				log.Infof("redaction dry-run: rule %s would %s field %s", rule.name, rule.action, field)
+				continue
+			}
+			result = r.replace(rule.action, result)
+			if rule.action == ActionDrop {
+				return ""
+			}
+			continue
+		}
+
+		matches := rule.expr.FindAllString(result, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		if r.dryRun {
+			log.Infof("redaction dry-run: rule %s would %s %d match(es) in %s", rule.name, rule.action, len(matches), field)
+			continue
+		}
+
+		if rule.action == ActionDrop {
+			return ""
+		}
+
+		result = rule.expr.ReplaceAllStringFunc(result, func(match string) string {
+			return r.replace(rule.action, match)
+		})
+	}
+
+	return result
+}
+
+func (r *redactor) replace(action, value string) string {
+	switch action {
+	case ActionHash:
+		mac := hmac.New(sha256.New, r.secret)
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case ActionDrop:
+		return ""
+	default:
+		return r.mask
+	}
+}
+
+func (r *redactor) applyData(data *ElasticData) {
+	if data.Log != nil {
+		data.Log.Value = r.redact(FieldLogValue, data.Log.Value)
+	}
+
+	if data.Meter != nil {
+		data.Meter.Raw = r.redact(FieldMeterAppendix, data.Meter.Raw)
+	}
+}
+
+func (r *redactor) applyTrace(trace *TraceMessage) {
+	trace.Message = r.redact(FieldTraceMessage, trace.Message)
+
+	for key, value := range trace.Tags {
+		redacted := r.redact(FieldTraceTags, value)
+		if redacted == "" && value != "" {
+			delete(trace.Tags, key)
+		} else {
+			trace.Tags[key] = redacted
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDetectors(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{
+		Detectors: []string{"email", "ip", "iban"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := ElasticData{
+		Log: &LogMessage{
+			Value: "login of jane.doe@example.com from 10.0.12.7 paying with DE89 3704 0044 0532 0130 00",
+		},
+	}
+
+	r.applyData(&data)
+
+	if strings.Contains(data.Log.Value, "jane.doe") || strings.Contains(data.Log.Value, "10.0.12.7") || strings.Contains(data.Log.Value, "3704") {
+		t.Errorf("log value was not redacted: %s", data.Log.Value)
+	}
+
+	if !strings.HasPrefix(data.Log.Value, "login of **** from **** paying with ****") {
+		t.Errorf("unexpected redaction result: %s", data.Log.Value)
+	}
+}
+
+func TestRedactRules(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{
+		Rules: []RedactionRule{
+			{Name: "patients", Pattern: `(?i)from patients`, Fields: []string{FieldTraceMessage}, Action: ActionHash},
+			{Name: "secret", Fields: []string{FieldTraceTags}, Pattern: "^secret", Action: ActionDrop},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := TraceMessage{
+		Message: "select * from Patients",
+		Tags:    map[string]string{"db": "mysql", "token": "secret-123"},
+	}
+
+	r.applyTrace(&trace)
+
+	if strings.Contains(trace.Message, "Patients") || !strings.HasPrefix(trace.Message, "select * ") {
+		t.Errorf("trace message was not hashed: %s", trace.Message)
+	}
+
+	if _, ok := trace.Tags["token"]; ok {
+		t.Errorf("expected token tag to be dropped, got %+v", trace.Tags)
+	}
+
+	if trace.Tags["db"] != "mysql" {
+		t.Errorf("unrelated tag was changed: %+v", trace.Tags)
+	}
+
+	//the rule is limited to trace messages, logs must stay untouched
+	if value := r.redact(FieldLogValue, "select * from Patients"); value != "select * from Patients" {
+		t.Errorf("rule was applied to the wrong field: %s", value)
+	}
+}
+
+func TestRedactHashSecret(t *testing.T) {
+	hash := func(secret string) string {
+		r, err := newRedactor(RedactionConfig{
+			Secret: secret,
+			Rules:  []RedactionRule{{Fields: []string{FieldLogValue}, Action: ActionHash}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.redact(FieldLogValue, "patient-42")
+	}
+
+	//hmac-sha256 of patient-42 with the key secret
+	if value := hash("secret"); value != "166722db7a4d97a7" {
+		t.Errorf("unexpected hash %s", value)
+	}
+	if hash("secret") != hash("secret") || hash("secret") == hash("other") || hash("secret") == hash("") {
+		t.Error("expected stable hashes that depend on the secret")
+	}
+}
+
+func TestRedactDryRun(t *testing.T) {
+	r, err := newRedactor(RedactionConfig{
+		DryRun:    true,
+		Detectors: []string{"email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value := r.redact(FieldLogValue, "mail jane@example.com"); value != "mail jane@example.com" {
+		t.Errorf("dry-run must not change data, got %s", value)
+	}
+}
+
+func TestRedactInvalidConfig(t *testing.T) {
+	if _, err := newRedactor(RedactionConfig{Detectors: []string{"unknown"}}); err == nil {
+		t.Error("expected an error for an unknown detector")
+	}
+
+	if _, err := newRedactor(RedactionConfig{Rules: []RedactionRule{{Pattern: "("}}}); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+
+	if _, err := newRedactor(RedactionConfig{Rules: []RedactionRule{{Pattern: "x", Action: "burn"}}}); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,387 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/olivere/elastic"
+	opentracing "github.com/opentracing/opentracing-go"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const reloadPingTimeout = 5 * time.Second
+
+// configuration entries that can be changed without a restart
+var reloadable = map[string]bool{
+	"IgnoreElastic":    true,
+	"ZipkinEndpoint":   true,
+	"Endpoint":         true,
+	"ElasticSearchURL": true,
+	"ElasticBasicAuth": true,
+	"ElasticUser":      true,
+	"ElasticPassword":  true,
+	"Redaction":        true,
+	"Processors":       true,
+	"Sampling":         true,
+	"Verbose":          true,
+}
+
+// errStopped is returned by Reload after the agent was shut down
+var errStopped = errors.New("the agent is shut down")
+
+type reloadLocks struct {
+	swap    sync.RWMutex //guards the backends of the agent and the VDCs it serves
+	single  sync.Mutex   //only one reload at a time, guards stopped and the retired collectors
+	stopped bool         //set on shutdown, reloads are refused afterwards
+}
+
+// backends are the parts of the agent that are swapped by a reload
+type backends struct {
+	elastic   *elastic.Client
+	collector zipkin.Collector
+	tracer    opentracing.Tracer
+	sampler   *sampler
+	redactor  *redactor
+	pipeline  pipeline
+	debugging bool
+}
+
+// backends returns a consistent view of the current clients, it must be used instead of the fields
+// of the agent so requests are not affected by a concurrent reload
+func (agent *Agent) backends() backends {
+	if agent.locks != nil {
+		agent.locks.swap.RLock()
+		defer agent.locks.swap.RUnlock()
+	}
+
+	return backends{
+		elastic:   agent.elastic,
+		collector: agent.collector,
+		tracer:    agent.tracer,
+		sampler:   agent.sampler,
+		redactor:  agent.redactor,
+		pipeline:  agent.pipeline,
+		debugging: agent.isDebugging,
+	}
+}
+
+// diffConfiguration returns the names of all entries that differ
+func diffConfiguration(old, new Configuration) []string {
+	var changed []string
+
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+
+	return changed
+}
+
+func newElasticClient(cnf Configuration) (*elastic.Client, error) {
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(cnf.ElasticSearchURL),
+		elastic.SetSniff(false),
+		elastic.SetErrorLog(log),
+		elastic.SetInfoLog(log),
+	}
+	if cnf.ElasticBasicAuth {
+		options = append(options, elastic.SetBasicAuth(cnf.ElasticUser, cnf.ElasticPassword))
+	}
+	return elastic.NewSimpleClient(options...)
+}
+
+func newTracer(collector zipkin.Collector, debugging bool, endpoint, service string) (opentracing.Tracer, error) {
+	recorder := zipkin.NewRecorder(collector, debugging, endpoint, service)
+
+	return zipkin.NewTracer(recorder,
+		zipkin.WithLogger(zipkin.LoggerFunc(func(kv ...interface{}) error {
+			log.Info(kv)
+			return nil
+		})),
+		zipkin.DebugMode(debugging),
+		zipkin.DebugAssertUseAfterFinish(debugging),
+	)
+}
+
+// Reload applies a new configuration. All clients are created and checked before any of them is
+// swapped, if one fails the whole configuration is rejected and the current one stays active.
+// Open spans and buffered data are kept. It returns the names of the applied entries.
+func (agent *Agent) Reload(cnf Configuration) ([]string, error) {
+	agent.locks.single.Lock()
+	defer agent.locks.single.Unlock()
+
+	if agent.locks.stopped {
+		return nil, errStopped
+	}
+
+	current := agent.backends()
+	next := current
+
+	var applied, restart []string
+	for _, name := range diffConfiguration(agent.cnf, cnf) {
+		if reloadable[name] {
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+
+	if len(restart) > 0 {
+		log.Warnf("changes of %s require a restart of the agent", strings.Join(restart, ", "))
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+
+	changed := make(map[string]bool)
+	for _, name := range applied {
+		changed[name] = true
+	}
+
+	if changed["Verbose"] {
+		next.debugging = cnf.Verbose
+	}
+
+	var err error
+	if changed["Redaction"] {
+		next.redactor = nil
+		if len(cnf.Redaction.Rules) > 0 || len(cnf.Redaction.Detectors) > 0 {
+			if next.redactor, err = newRedactor(cnf.Redaction); err != nil {
+				return nil, fmt.Errorf("invalid redaction: %s", err)
+			}
+		}
+	}
+
+	if changed["Processors"] {
+		if next.pipeline, err = newPipeline(cnf, cnf.Processors); err != nil {
+			return nil, fmt.Errorf("invalid processors: %s", err)
+		}
+	}
+
+	if changed["Sampling"] {
+		if next.sampler, err = newSampler(cnf.Sampling); err != nil {
+			return nil, fmt.Errorf("invalid sampling: %s", err)
+		}
+	}
+
+	if changed["IgnoreElastic"] || changed["ElasticSearchURL"] || changed["ElasticBasicAuth"] ||
+		changed["ElasticUser"] || changed["ElasticPassword"] {
+		next.elastic = nil
+		if !agent.testing && !cnf.IgnoreElastic {
+			if next.elastic, err = newElasticClient(cnf); err != nil {
+				return nil, fmt.Errorf("invalid elastic search configuration: %s", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), reloadPingTimeout)
+			_, _, err = next.elastic.Ping(cnf.ElasticSearchURL).Do(ctx)
+			cancel()
+			if err != nil {
+				next.elastic.Stop()
+				return nil, fmt.Errorf("elastic search at %s is not available: %s", cnf.ElasticSearchURL, err)
+			}
+		}
+	}
+
+	//in testing mode spans are only captured, there is no zipkin to switch to
+	if current.collector != nil && !agent.testing && (changed["ZipkinEndpoint"] || changed["Endpoint"] || changed["Sampling"]) {
+		if next.collector, err = zipkin.NewHTTPCollector(cnf.ZipkinEndpoint); err != nil {
+			return nil, fmt.Errorf("invalid zipkin endpoint: %s", err)
+		}
+		next.collector = agent.withSinks(next.collector)
+		if cnf.Sampling.DecisionWait > 0 {
+			next.collector = newTailCollector(cnf.Sampling, next.collector)
+		}
+
+		if next.tracer, err = newTracer(next.collector, next.debugging, cnf.Endpoint, "vdc-agent"); err != nil {
+			next.collector.Close()
+			return nil, fmt.Errorf("could not create tracer: %s", err)
+		}
+	}
+
+	//everything is valid, swap the clients of the agent and all VDCs it serves
+	children, unlock := agent.lockChildren()
+	agent.locks.swap.Lock()
+	for _, target := range append(children, agent) {
+		target.elastic = next.elastic
+		target.collector = next.collector
+		target.sampler = next.sampler
+		target.redactor = next.redactor
+		target.pipeline = next.pipeline
+		target.isDebugging = next.debugging
+
+		if target == agent && next.collector != current.collector {
+			target.tracer = next.tracer
+		} else if next.collector != current.collector {
+			tracer, err := newTracer(next.collector, next.debugging, cnf.Endpoint, agent.tenants.serviceName(target.name))
+			if err != nil {
+				log.Errorf("could not create tracer for VDC %s %+v", target.name, err)
+				continue
+			}
+			target.tracer = tracer
+		}
+	}
+	agent.locks.swap.Unlock()
+	unlock()
+
+	//open spans still report to the old collector, it is closed on shutdown
+	if next.collector != current.collector {
+		agent.retired = append(agent.retired, current.collector)
+	}
+	if next.elastic != current.elastic && current.elastic != nil {
+		current.elastic.Stop()
+	}
+	if next.elastic != current.elastic {
+		for _, target := range append(children, agent) {
+			target.initIndex()
+		}
+	}
+	if changed["Verbose"] {
+		setLogLevel(next.debugging)
+	}
+
+	applyConfiguration(&agent.cnf, cnf, applied)
+	return applied, nil
+}
+
+// applyConfiguration copies the given entries, so entries that require a restart are reported again
+func applyConfiguration(target *Configuration, source Configuration, names []string) {
+	targetValue, sourceValue := reflect.ValueOf(target).Elem(), reflect.ValueOf(source)
+	for _, name := range names {
+		targetValue.FieldByName(name).Set(sourceValue.FieldByName(name))
+	}
+}
+
+// setLogLevel switches the log level for the verbose mode
+func setLogLevel(debugging bool) {
+	if debugging {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+}
+
+// lockChildren returns the agents of all VDCs served in multi VDC mode, no VDC is added until unlock
+// is called. It has to be called before the backends are locked, like new VDCs do.
+func (agent *Agent) lockChildren() ([]*Agent, func()) {
+	if agent.tenants == nil {
+		return nil, func() {}
+	}
+
+	agent.tenants.lock.Lock()
+	children := make([]*Agent, 0, len(agent.tenants.agents))
+	for _, child := range agent.tenants.agents {
+		children = append(children, child)
+	}
+	return children, agent.tenants.lock.Unlock
+}
+
+// Watch reloads the configuration whenever the config file changes or the agent receives SIGHUP,
+// without a config file only SIGHUP is handled
+func (agent *Agent) Watch() {
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(event fsnotify.Event) {
+			agent.reloadConfig(fmt.Sprintf("change of %s", event.Name))
+		})
+		viper.WatchConfig()
+	}
+
+	agent.hangup = make(chan os.Signal, 1)
+	signal.Notify(agent.hangup, syscall.SIGHUP)
+	go func() {
+		for range agent.hangup {
+			if err := readConfigFile(); err != nil {
+				log.Errorf("could not read configuration, keeping the current one %+v", err)
+				continue
+			}
+			agent.reloadConfig("SIGHUP")
+		}
+	}()
+}
+
+func (agent *Agent) reloadConfig(trigger string) {
+	//viper offers no way to remove the change handler, so it stays registered after the shutdown
+	if agent.isStopped() {
+		return
+	}
+	log.Infof("reloading configuration after %s", trigger)
+
+	cnf, err := decodeConfiguration()
+	if err != nil {
+		log.Errorf("keeping the current configuration, %s", err)
+		return
+	}
+
+	applied, err := agent.Reload(cnf)
+	if err == errStopped {
+		log.Infof("ignoring %s, the agent is shut down", trigger)
+		return
+	}
+	if err != nil {
+		log.Errorf("invalid configuration, keeping the current one %+v", err)
+		return
+	}
+
+	if len(applied) == 0 {
+		log.Info("configuration unchanged")
+		return
+	}
+	log.Infof("configuration reloaded, changed %s", strings.Join(applied, ", "))
+}
+
+// stopWatching stops reacting to SIGHUP and config changes. It waits for a running reload and
+// returns the collectors it replaced, no reload happens afterwards.
+func (agent *Agent) stopWatching() []zipkin.Collector {
+	if agent.hangup != nil {
+		signal.Stop(agent.hangup)
+		close(agent.hangup)
+	}
+
+	if agent.locks == nil {
+		return nil
+	}
+	agent.locks.single.Lock()
+	defer agent.locks.single.Unlock()
+	agent.locks.stopped = true
+	return agent.retired
+}
+
+func (agent *Agent) isStopped() bool {
+	agent.locks.single.Lock()
+	defer agent.locks.single.Unlock()
+	return agent.locks.stopped
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+func TestReload(t *testing.T) {
+	cnf := Configuration{
+		VDCName:       "test",
+		IgnoreElastic: true,
+		Processors:    []ProcessorConfig{{Type: "level"}},
+	}
+
+	agent, err := CreateAgent(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+
+	//open spans survive a reload
+	trace := TraceMessage{TraceId: "5e27c67030932221", SpanId: "38357d8f309b379d", Operation: "test"}
+	span := agent.getSpan(trace)
+
+	next := cnf
+	next.Port = 9000
+	next.Redaction = RedactionConfig{Detectors: []string{"email"}}
+	next.Sampling = SamplingConfig{Probability: 0.5}
+
+	applied, err := agent.Reload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []string{"Redaction", "Sampling"}) {
+		t.Errorf("expected redaction and sampling to be applied but got %v", applied)
+	}
+
+	backends := agent.backends()
+	if backends.redactor == nil || backends.sampler == nil || backends.sampler.probability != 0.5 {
+		t.Errorf("expected the new redactor and sampler to be active %+v", backends)
+	}
+	if len(backends.pipeline) != 1 {
+		t.Error("expected the unchanged pipeline to be kept")
+	}
+	if agent.getSpan(trace) != span {
+		t.Error("expected the open span to be kept")
+	}
+
+	//entries that need a restart are not applied
+	if agent.cnf.Port != 0 {
+		t.Errorf("expected the port to require a restart")
+	}
+
+	invalid := next
+	invalid.Processors = []ProcessorConfig{{Type: "unknown"}}
+	invalid.Redaction = RedactionConfig{}
+	if _, err := agent.Reload(invalid); err == nil {
+		t.Error("expected an invalid configuration to be rejected")
+	}
+	if backends := agent.backends(); backends.redactor == nil || len(backends.pipeline) != 1 {
+		t.Error("expected the old configuration to stay active")
+	}
+
+	if applied, err := agent.Reload(next); err != nil || len(applied) != 0 {
+		t.Errorf("expected nothing to change but got %v %v", applied, err)
+	}
+
+	//config changes after the shutdown must not swap the closed clients
+	if err := agent.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.Reload(cnf); err != errStopped {
+		t.Errorf("expected reloads to be refused after the shutdown but got %v", err)
+	}
+	if backends := agent.backends(); backends.redactor == nil {
+		t.Error("expected the configuration to stay unchanged after the shutdown")
+	}
+}
+
+func TestReloadTenants(t *testing.T) {
+	agent, err := CreateAgent(Configuration{
+		VDCName:       "root",
+		IgnoreElastic: true,
+		MultiTenant:   MultiTenantConfig{Enabled: true, AllowUnknown: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+
+	child, err := agent.tenant("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child.spans["open"] = opentracing.StartSpan("open")
+
+	cnf := agent.cnf
+	cnf.Redaction = RedactionConfig{Detectors: []string{"ip"}}
+	if _, err := agent.Reload(cnf); err != nil {
+		t.Fatal(err)
+	}
+
+	if child.backends().redactor == nil {
+		t.Error("expected the VDCs to use the new configuration")
+	}
+	if _, ok := child.spans["open"]; !ok {
+		t.Error("expected the open spans of the VDCs to be kept")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Routes registers the v1 api of the agent, in multi VDC mode it is also served below /vdc/{vdc}.
+// In testing mode the captured data can be inspected below /_debug.
+func (agent *Agent) Routes(router *mux.Router) {
+	if agent.tenants != nil {
+		agent.routes(router.PathPrefix("/vdc/{vdc}").Subrouter())
+	}
+	agent.routes(router)
+
+	if agent.capture != nil {
+		agent.debugRoutes(router)
+	}
+}
+
+func (agent *Agent) routes(router *mux.Router) {
+	router.PathPrefix("/close").Methods("POST").Handler(agent.serve((*Agent).Close))
+	router.PathPrefix("/trace").Methods("PUT").Handler(agent.serve((*Agent).Trace))
+
+	router.PathPrefix("/meter").Methods("POST").Handler(agent.serve((*Agent).Meter))
+	router.PathPrefix("/log").Methods("POST").Handler(agent.serve((*Agent).Log))
+
+	router.Path("/stream").Methods("GET").Handler(agent.serve((*Agent).Stream))
+
+	router.Path("/meter/aggregate").Methods("GET").Handler(agent.serve((*Agent).AggregateMeter))
+	router.PathPrefix("/meter").Methods("GET").Handler(agent.serve((*Agent).QueryMeter))
+	router.PathPrefix("/log").Methods("GET").Handler(agent.serve((*Agent).QueryLog))
+
+	router.Path("/alerts").Methods("GET").Handler(agent.serve((*Agent).Alerts))
+	router.Path("/metrics").Methods("GET").Handler(agent.serve((*Agent).Metrics))
+}
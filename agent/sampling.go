@@ -0,0 +1,304 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/types"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+)
+
+const (
+	maxSamplingDecisions = 100000
+	samplingDecisionTTL  = 10 * time.Minute
+	defaultMaxTraces     = 10000
+)
+
+type SamplingConfig struct {
+	Probability float64              //share of traces that are exported (0-1), all if not set
+	RateLimits  []OperationRateLimit //maximum number of traces per second started by an operation
+
+	DecisionWait    time.Duration //tail sampling: how long the spans of a trace are buffered before deciding, disabled if not set
+	Latency         time.Duration //tail sampling: traces with a span taking at least this long are kept
+	TailProbability float64       //tail sampling: share of the traces without errors or high latency that are kept anyway
+	MaxTraces       int           //tail sampling: maximum number of buffered traces (default 10000)
+}
+
+type OperationRateLimit struct {
+	Operation string
+	PerSecond float64
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	capacity := math.Max(1, b.rate)
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type samplingDecision struct {
+	sampled bool
+	at      time.Time
+}
+
+// sampler makes the head sampling decision once per trace, all later spans of the trace follow it
+type sampler struct {
+	probability float64
+
+	lock      sync.Mutex
+	limits    map[string]*tokenBucket
+	decisions map[types.TraceID]samplingDecision
+}
+
+func newSampler(cnf SamplingConfig) (*sampler, error) {
+	s := &sampler{
+		probability: cnf.Probability,
+		limits:      make(map[string]*tokenBucket),
+		decisions:   make(map[types.TraceID]samplingDecision),
+	}
+
+	if s.probability == 0 {
+		s.probability = 1
+	}
+	if s.probability < 0 || s.probability > 1 {
+		return nil, fmt.Errorf("sampling probability must be between 0 and 1")
+	}
+
+	for _, limit := range cnf.RateLimits {
+		if limit.PerSecond <= 0 {
+			return nil, fmt.Errorf("rate limit of %s must be positive", limit.Operation)
+		}
+		s.limits[limit.Operation] = &tokenBucket{rate: limit.PerSecond, tokens: math.Max(1, limit.PerSecond)}
+	}
+
+	return s, nil
+}
+
+// sample decides if a trace is exported, the rate limit of the operation that first reports the trace applies
+func (s *sampler) sample(operation string, id types.TraceID, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if decision, ok := s.decisions[id]; ok {
+		return decision.sampled
+	}
+
+	//the decision is derived from the trace id, so other agents sampling with the same probability agree
+	sampled := s.probability >= 1 || float64(id.Low) < s.probability*math.MaxUint64
+	if limit, ok := s.limits[operation]; ok && sampled {
+		if limit.last.IsZero() {
+			limit.last = now
+		}
+		sampled = limit.take(now)
+	}
+
+	if len(s.decisions) >= maxSamplingDecisions {
+		for key, decision := range s.decisions {
+			if now.Sub(decision.at) > samplingDecisionTTL {
+				delete(s.decisions, key)
+			}
+		}
+	}
+	s.decisions[id] = samplingDecision{sampled: sampled, at: now}
+
+	return sampled
+}
+
+type traceKey struct {
+	high int64
+	low  int64
+}
+
+type bufferedTrace struct {
+	first time.Time
+	spans []*zipkincore.Span
+}
+
+// tailCollector buffers the spans of each trace and only forwards traces that are worth keeping.
+// Decisions are kept for a while, spans arriving after the decision follow the rest of their trace.
+type tailCollector struct {
+	next zipkin.Collector
+	cnf  SamplingConfig
+
+	lock    sync.Mutex
+	traces  map[traceKey]*bufferedTrace
+	decided map[traceKey]samplingDecision
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTailCollector(cnf SamplingConfig, next zipkin.Collector) *tailCollector {
+	if cnf.MaxTraces <= 0 {
+		cnf.MaxTraces = defaultMaxTraces
+	}
+
+	c := &tailCollector{
+		next:    next,
+		cnf:     cnf,
+		traces:  make(map[traceKey]*bufferedTrace),
+		decided: make(map[traceKey]samplingDecision),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(cnf.DecisionWait / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case now := <-ticker.C:
+				c.decide(now)
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *tailCollector) Collect(span *zipkincore.Span) error {
+	key := traceKey{low: span.TraceID}
+	if span.TraceIDHigh != nil {
+		key.high = *span.TraceIDHigh
+	}
+
+	c.lock.Lock()
+	if decision, ok := c.decided[key]; ok {
+		c.lock.Unlock()
+		if !decision.sampled {
+			return nil
+		}
+		return c.next.Collect(span)
+	}
+
+	trace, ok := c.traces[key]
+	if !ok && len(c.traces) >= c.cnf.MaxTraces {
+		c.lock.Unlock()
+		//the buffer is full, the span is judged on its own
+		log.Warn("tail sampling buffer is full")
+		return c.forward([]*zipkincore.Span{span})
+	}
+	if !ok {
+		trace = &bufferedTrace{first: time.Now()}
+		c.traces[key] = trace
+	}
+	trace.spans = append(trace.spans, span)
+	c.lock.Unlock()
+
+	return nil
+}
+
+// decide forwards or drops all traces whose decision window has passed and remembers the decisions
+func (c *tailCollector) decide(now time.Time) {
+	var ready [][]*zipkincore.Span
+
+	c.lock.Lock()
+	for key, decision := range c.decided {
+		if now.Sub(decision.at) > samplingDecisionTTL {
+			delete(c.decided, key)
+		}
+	}
+	for key, trace := range c.traces {
+		if now.Sub(trace.first) < c.cnf.DecisionWait {
+			continue
+		}
+		delete(c.traces, key)
+
+		keep := c.keep(trace.spans)
+		if len(c.decided) < maxSamplingDecisions {
+			c.decided[key] = samplingDecision{sampled: keep, at: now}
+		}
+		if keep {
+			ready = append(ready, trace.spans)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, spans := range ready {
+		for _, span := range spans {
+			if err := c.next.Collect(span); err != nil {
+				log.Errorf("could not export span %+v", err)
+				break
+			}
+		}
+	}
+}
+
+func (c *tailCollector) forward(spans []*zipkincore.Span) error {
+	if !c.keep(spans) {
+		return nil
+	}
+
+	for _, span := range spans {
+		if err := c.next.Collect(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *tailCollector) keep(spans []*zipkincore.Span) bool {
+	latency := c.cnf.Latency.Nanoseconds() / 1e3
+
+	for _, span := range spans {
+		if latency > 0 && span.Duration != nil && *span.Duration >= latency {
+			return true
+		}
+
+		tags := make(map[string]string)
+		for _, annotation := range span.BinaryAnnotations {
+			tags[annotation.Key] = string(annotation.Value)
+		}
+		if isFailed(tags) {
+			return true
+		}
+	}
+
+	return c.cnf.TailProbability > 0 && rand.Float64() < c.cnf.TailProbability
+}
+
+// Close decides on all buffered traces and closes the wrapped collector
+func (c *tailCollector) Close() error {
+	close(c.stop)
+	<-c.done
+
+	c.decide(time.Now().Add(c.cnf.DecisionWait))
+	return c.next.Close()
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/types"
+)
+
+type recordingCollector struct {
+	lock   sync.Mutex
+	spans  []*zipkincore.Span
+	closed bool
+}
+
+func (c *recordingCollector) Collect(span *zipkincore.Span) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.spans = append(c.spans, span)
+	return nil
+}
+
+func (c *recordingCollector) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHeadSampling(t *testing.T) {
+	s, err := newSampler(SamplingConfig{
+		Probability: 0.5,
+		RateLimits:  []OperationRateLimit{{Operation: "getData", PerSecond: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	low := types.TraceID{Low: 1}
+	high := types.TraceID{Low: math.MaxUint64 - 1}
+
+	if !s.sample("putData", low, now) || s.sample("putData", high, now) {
+		t.Error("expected the decision to follow the trace id")
+	}
+
+	//two traces per second are allowed, the decision sticks to the trace
+	sampled := 0
+	for i := uint64(10); i < 20; i++ {
+		if s.sample("getData", types.TraceID{Low: i}, now) {
+			sampled++
+		}
+	}
+	if sampled != 2 {
+		t.Errorf("expected 2 sampled traces but got %d", sampled)
+	}
+	if !s.sample("getData", types.TraceID{Low: 10}, now) || s.sample("getData", types.TraceID{Low: 19}, now) {
+		t.Error("expected later spans to follow the decision of their trace")
+	}
+
+	if !s.sample("getData", types.TraceID{Low: 20}, now.Add(time.Second)) {
+		t.Error("expected the rate limit to refill")
+	}
+
+	if _, err := newSampler(SamplingConfig{Probability: 2}); err == nil {
+		t.Error("expected an invalid probability to be rejected")
+	}
+}
+
+func testSpan(trace int64, duration time.Duration, tags map[string]string) *zipkincore.Span {
+	micros := duration.Nanoseconds() / 1e3
+	span := &zipkincore.Span{TraceID: trace, ID: trace*10 + int64(len(tags)), Duration: &micros}
+	for key, value := range tags {
+		span.BinaryAnnotations = append(span.BinaryAnnotations, &zipkincore.BinaryAnnotation{Key: key, Value: []byte(value)})
+	}
+	return span
+}
+
+func TestTailSampling(t *testing.T) {
+	next := &recordingCollector{}
+	collector := newTailCollector(SamplingConfig{DecisionWait: time.Hour, Latency: time.Second}, next)
+
+	//trace 1 is fast, 2 contains an error and 3 a slow span
+	collector.Collect(testSpan(1, 10*time.Millisecond, nil))
+	collector.Collect(testSpan(1, 20*time.Millisecond, map[string]string{"http.status_code": "200"}))
+	collector.Collect(testSpan(2, 10*time.Millisecond, nil))
+	collector.Collect(testSpan(2, 10*time.Millisecond, map[string]string{"error": "true"}))
+	collector.Collect(testSpan(3, 2*time.Second, nil))
+
+	collector.decide(time.Now())
+	if len(next.spans) != 0 {
+		t.Fatalf("expected the spans to be buffered during the decision window but got %d", len(next.spans))
+	}
+
+	if err := collector.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	traces := make(map[int64]int)
+	for _, span := range next.spans {
+		traces[span.TraceID]++
+	}
+	if len(traces) != 2 || traces[2] != 2 || traces[3] != 1 {
+		t.Errorf("expected the complete traces 2 and 3 but got %v", traces)
+	}
+	if !next.closed {
+		t.Error("expected the wrapped collector to be closed")
+	}
+}
+
+func TestTailSamplingLateSpans(t *testing.T) {
+	next := &recordingCollector{}
+	collector := newTailCollector(SamplingConfig{DecisionWait: time.Hour, Latency: time.Second}, next)
+	defer collector.Close()
+
+	collector.Collect(testSpan(1, 10*time.Millisecond, nil))
+	collector.Collect(testSpan(2, 10*time.Millisecond, map[string]string{"error": "true"}))
+	collector.decide(time.Now().Add(2 * time.Hour))
+
+	//spans arriving after the decision follow their trace instead of being judged on their own
+	collector.Collect(testSpan(1, 2*time.Second, nil))
+	collector.Collect(testSpan(2, 10*time.Millisecond, nil))
+
+	next.lock.Lock()
+	defer next.lock.Unlock()
+	traces := make(map[int64]int)
+	for _, span := range next.spans {
+		traces[span.TraceID]++
+	}
+	if len(traces) != 1 || traces[2] != 2 {
+		t.Errorf("expected both spans of trace 2 and none of trace 1 but got %v", traces)
+	}
+	if len(collector.traces) != 0 {
+		t.Errorf("expected the late spans not to be buffered again %v", collector.traces)
+	}
+}
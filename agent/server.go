@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultWaitTime = 15 * time.Second
+
+// lifecycle holds the api server started by Run and tracks the writes to elastic search, so they can be
+// awaited on shutdown
+type lifecycle struct {
+	lock     sync.Mutex
+	server   *http.Server
+	addr     net.Addr
+	shutdown sync.Once
+
+	pending  int  //writes in progress
+	failed   int  //writes that failed after the shutdown started
+	draining bool //the shutdown started
+}
+
+func (l *lifecycle) begin() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	l.pending++
+	l.lock.Unlock()
+}
+
+func (l *lifecycle) end(err error) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	l.pending--
+	if err != nil && l.draining {
+		l.failed++
+	}
+	l.lock.Unlock()
+}
+
+func (l *lifecycle) stopping() {
+	l.lock.Lock()
+	l.draining = true
+	l.lock.Unlock()
+}
+
+// wait waits until all writes are done or the context ends, it returns the writes still in progress
+// and those that failed during the shutdown
+func (l *lifecycle) wait(ctx context.Context) (int, int) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		l.lock.Lock()
+		pending, failed := l.pending, l.failed
+		l.lock.Unlock()
+
+		if pending == 0 {
+			return 0, failed
+		}
+
+		select {
+		case <-ctx.Done():
+			return pending, failed
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *lifecycle) stopServer(ctx context.Context) error {
+	l.lock.Lock()
+	server := l.server
+	l.server = nil
+	l.lock.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// Handler returns the api of the agent, it can be served by any http server
+func (agent *Agent) Handler() http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	agent.Routes(router.PathPrefix("/v1").Subrouter())
+	return router
+}
+
+// Run serves the api on the configured port until the context ends, then the agent is shut down
+// and open requests get WaitTime to finish. It returns once the agent stopped or the server failed.
+func (agent *Agent) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:         fmt.Sprintf(":%d", agent.cnf.Port),
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      agent.Handler(),
+	}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	agent.lifecycle.lock.Lock()
+	agent.lifecycle.server = server
+	agent.lifecycle.addr = listener.Addr()
+	agent.lifecycle.lock.Unlock()
+
+	failed := make(chan error, 1)
+	go func() {
+		log.Infof("Listening on %s", listener.Addr())
+		failed <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-failed:
+		if err == http.ErrServerClosed {
+			//stopped by Shutdown
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		waitTime := agent.cnf.WaitTime
+		if waitTime <= 0 {
+			waitTime = defaultWaitTime
+		}
+		log.Infof("shutting down, waiting up to %s for open requests and pending data", waitTime)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), waitTime)
+		defer cancel()
+		return agent.Shutdown(shutdownCtx)
+	}
+}
+
+// Addr returns the address the api is served on, or nil if Run was not called
+func (agent *Agent) Addr() net.Addr {
+	agent.lifecycle.lock.Lock()
+	defer agent.lifecycle.lock.Unlock()
+	return agent.lifecycle.addr
+}
+
+func notFound(w http.ResponseWriter, req *http.Request) {
+	log.Infof("request not found %+v", req.URL)
+}
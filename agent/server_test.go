@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunIndependentAgents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var agents []*Agent
+	stopped := make(chan error, 2)
+	for _, name := range []string{"one", "two"} {
+		agent, err := CreateAgent(Configuration{VDCName: name, Testing: true, Tracing: true, WaitTime: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		agents = append(agents, agent)
+		go func() {
+			stopped <- agent.Run(ctx)
+		}()
+	}
+
+	addr := func(agent *Agent) string {
+		for i := 0; i < 100 && agent.Addr() == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if agent.Addr() == nil {
+			t.Fatal("agent is not listening")
+		}
+		return fmt.Sprintf("http://%s", agent.Addr())
+	}
+
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout"}`
+	req, _ := http.NewRequest(http.MethodPut, addr(agents[0])+"/v1/trace", strings.NewReader(trace))
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Post(addr(agents[0])+"/v1/close", "application/json", strings.NewReader(trace)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{true, false} {
+		resp, err := http.Get(addr(agents[i]) + "/v1/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if strings.Contains(string(body), `operation="checkout"`) != expected {
+			t.Errorf("expected only the first agent to count the request\n%s", body)
+		}
+	}
+
+	cancel()
+	for range agents {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("expected the agent to stop cleanly %+v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("agent did not stop")
+		}
+	}
+
+	//shutting down again has no effect
+	if err := agents[0].Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	agent, err := CreateAgent(Configuration{VDCName: "test", Testing: true, Tracing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := &recordingCollector{}
+	agent.collector = collector
+	if agent.tracer, err = newTracer(collector, false, "", "vdc-agent"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a span that is never closed and a write that never finishes
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"checkout"}`
+	agent.Trace(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/v1/trace", strings.NewReader(trace)))
+	agent.lifecycle.begin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = agent.Shutdown(ctx)
+	if err == nil || !strings.Contains(err.Error(), "1 documents were still being written") {
+		t.Errorf("expected the pending write to be reported but got %+v", err)
+	}
+
+	if len(collector.spans) != 1 || !collector.closed {
+		t.Fatalf("expected the open span to be exported before the collector is closed %+v", collector)
+	}
+	tagged := false
+	for _, annotation := range collector.spans[0].BinaryAnnotations {
+		tagged = tagged || (annotation.Key == "shutdown" && string(annotation.Value) == "true")
+	}
+	if !tagged {
+		t.Errorf("expected the span to be tagged with shutdown %+v", collector.spans[0].BinaryAnnotations)
+	}
+}
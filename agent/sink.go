@@ -0,0 +1,183 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+	zipkin "github.com/openzipkin/zipkin-go-opentracing"
+)
+
+// rpcAnnotations are set by the tracer itself, they are not reported as messages
+var rpcAnnotations = map[string]bool{
+	zipkincore.CLIENT_SEND: true,
+	zipkincore.CLIENT_RECV: true,
+	zipkincore.SERVER_SEND: true,
+	zipkincore.SERVER_RECV: true,
+}
+
+// SpanMessage is a finished span as it is passed to sinks and captured in testing mode, ids are hex
+// encoded like in trace messages
+type SpanMessage struct {
+	TraceId      string            `json:"traceId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"`
+	SpanId       string            `json:"spanId"`
+	Operation    string            `json:"operation"`
+	Service      string            `json:"service"`
+	Timestamp    time.Time         `json:"timestamp"`
+	Duration     time.Duration     `json:"duration"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	Messages     []string          `json:"messages,omitempty"`
+}
+
+func newSpanMessage(span *zipkincore.Span) SpanMessage {
+	msg := SpanMessage{
+		TraceId:   fmt.Sprintf("%016x", uint64(span.TraceID)),
+		SpanId:    fmt.Sprintf("%016x", uint64(span.ID)),
+		Operation: span.Name,
+		Tags:      make(map[string]string),
+	}
+	if span.ParentID != nil {
+		msg.ParentSpanId = fmt.Sprintf("%016x", uint64(*span.ParentID))
+	}
+	if span.Timestamp != nil {
+		msg.Timestamp = time.Unix(0, *span.Timestamp*1e3).UTC()
+	}
+	if span.Duration != nil {
+		msg.Duration = time.Duration(*span.Duration) * time.Microsecond
+	}
+
+	for _, annotation := range span.Annotations {
+		if annotation.Host != nil && msg.Service == "" {
+			msg.Service = annotation.Host.ServiceName
+		}
+		if !rpcAnnotations[annotation.Value] {
+			msg.Messages = append(msg.Messages, annotation.Value)
+		}
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		if annotation.Host != nil && msg.Service == "" {
+			msg.Service = annotation.Host.ServiceName
+		}
+		msg.Tags[annotation.Key] = string(annotation.Value)
+	}
+	return msg
+}
+
+// sink is an additional output for the documents and finished spans of the agent, next to elastic
+// search and zipkin. Writes are asynchronous, a sink handles and reports its failures itself and
+// tracks pending writes in the lifecycle of the agent so they are awaited on shutdown.
+type sink interface {
+	document(vdc string, data ElasticData)
+	span(vdc string, span SpanMessage)
+	close() error
+}
+
+// newSinks creates the sinks enabled in the configuration
+func newSinks(cnf Configuration, lifecycle *lifecycle) ([]sink, error) {
+	var sinks []sink
+
+	if len(cnf.Kafka.Brokers) > 0 {
+		kafka, err := newKafkaSink(cnf.Kafka, lifecycle)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, kafka)
+	}
+
+	if cnf.Loki.URL != "" {
+		loki, err := newLokiSink(cnf.Loki, lifecycle)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, loki)
+	}
+
+	for _, sc := range cnf.HTTPSinks {
+		sink, err := newHTTPSink(sc, lifecycle)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if cnf.InfluxDB.URL != "" {
+		sinks = append(sinks, newInfluxDBSink(cnf.InfluxDB, lifecycle))
+	}
+	if cnf.RemoteWrite.URL != "" {
+		sinks = append(sinks, newRemoteWriteSink(cnf.RemoteWrite, lifecycle))
+	}
+
+	return sinks, nil
+}
+
+// closeSinks closes sinks that were already started when a later one could not be created
+func closeSinks(sinks []sink) {
+	for _, sink := range sinks {
+		if err := sink.close(); err != nil {
+			log.Errorf("could not close sink %+v", err)
+		}
+	}
+}
+
+// sinkCollector passes finished spans to the sinks before they are sent to zipkin
+type sinkCollector struct {
+	next  zipkin.Collector
+	sinks []sink
+	vdc   func(service string) string //VDC of a span
+}
+
+// withSinks wraps a collector so the sinks of the agent receive all spans sent to zipkin
+func (agent *Agent) withSinks(collector zipkin.Collector) zipkin.Collector {
+	if len(agent.sinks) == 0 {
+		return collector
+	}
+	return &sinkCollector{next: collector, sinks: agent.sinks, vdc: agent.vdcOfService}
+}
+
+func (c *sinkCollector) Collect(span *zipkincore.Span) error {
+	msg := newSpanMessage(span)
+	vdc := c.vdc(msg.Service)
+	for _, sink := range c.sinks {
+		sink.span(vdc, msg)
+	}
+	return c.next.Collect(span)
+}
+
+func (c *sinkCollector) Close() error {
+	return c.next.Close()
+}
+
+// vdcOfService returns the VDC whose spans are reported under the zipkin service name
+func (agent *Agent) vdcOfService(service string) string {
+	if agent.tenants == nil || service == "vdc-agent" {
+		return agent.name
+	}
+	for name, settings := range agent.tenants.settings {
+		if settings.ServiceName == service {
+			return name
+		}
+	}
+	//unlisted VDCs use their name as service
+	return service
+}
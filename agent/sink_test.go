@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// recordingSink keeps everything it receives
+type recordingSink struct {
+	lock      sync.Mutex
+	documents map[string][]ElasticData
+	spans     map[string][]SpanMessage
+}
+
+func (s *recordingSink) document(vdc string, data ElasticData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.documents == nil {
+		s.documents = make(map[string][]ElasticData)
+	}
+	s.documents[vdc] = append(s.documents[vdc], data)
+}
+
+func (s *recordingSink) span(vdc string, span SpanMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.spans == nil {
+		s.spans = make(map[string][]SpanMessage)
+	}
+	s.spans[vdc] = append(s.spans[vdc], span)
+}
+
+func (s *recordingSink) close() error {
+	return nil
+}
+
+func TestSinkCollector(t *testing.T) {
+	tenants, err := newTenantRegistry(MultiTenantConfig{
+		AllowUnknown: true,
+		Tenants:      []TenantSettings{{Name: "shop", ServiceName: "shop-frontend"}},
+	}, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingSink{}
+	next := &recordingCollector{}
+	agent := &Agent{name: "root", tenants: tenants, sinks: []sink{recorder}}
+	collector := agent.withSinks(next)
+
+	for _, service := range []string{"vdc-agent", "shop-frontend", "unlisted"} {
+		span := testSpan(1, 10*time.Millisecond, map[string]string{"http.status_code": "200"})
+		span.Annotations = append(span.Annotations, &zipkincore.Annotation{
+			Value: zipkincore.SERVER_RECV,
+			Host:  &zipkincore.Endpoint{ServiceName: service},
+		})
+		if err := collector.Collect(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(next.spans) != 3 {
+		t.Errorf("expected all spans to be passed to zipkin but got %d", len(next.spans))
+	}
+	for _, vdc := range []string{"root", "shop", "unlisted"} {
+		spans := recorder.spans[vdc]
+		if len(spans) != 1 || spans[0].Tags["http.status_code"] != "200" || len(spans[0].Messages) != 0 {
+			t.Errorf("expected one span of %s without the rpc annotations %+v", vdc, spans)
+		}
+	}
+
+	if (&Agent{}).withSinks(next) != next {
+		t.Error("expected the collector not to be wrapped without sinks")
+	}
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultStreamBuffer = 256
+	heartbeatInterval   = 15 * time.Second
+)
+
+// event types that are published to stream subscribers
+const (
+	EventMeter = "meter"
+	EventLog   = "log"
+	EventTrace = "trace"
+	EventClose = "close"
+	EventAlert = "alert"
+)
+
+type StreamEvent struct {
+	Type  string        `json:"type"`
+	Data  *ElasticData  `json:"data,omitempty"`
+	Trace *TraceMessage `json:"trace,omitempty"`
+
+	vdc string //VDC that published the event
+}
+
+type streamFilter struct {
+	vdc         string
+	types       map[string]bool
+	name        string
+	operationID string
+	contains    string
+}
+
+func newStreamFilter(req *http.Request) streamFilter {
+	params := req.URL.Query()
+	filter := streamFilter{
+		name:        params.Get("name"),
+		operationID: params.Get("operationID"),
+		contains:    params.Get("contains"),
+	}
+
+	if types := params.Get("type"); types != "" {
+		filter.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			filter.types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	return filter
+}
+
+func (f streamFilter) matches(event StreamEvent) bool {
+	if f.vdc != "" && event.vdc != f.vdc {
+		return false
+	}
+
+	if f.types != nil && !f.types[event.Type] {
+		return false
+	}
+
+	if f.name != "" || f.operationID != "" {
+		if event.Data == nil || event.Data.Meter == nil {
+			return false
+		}
+		if f.name != "" && event.Data.Meter.Name != f.name {
+			return false
+		}
+		if f.operationID != "" && event.Data.Meter.OperationID != f.operationID {
+			return false
+		}
+	}
+
+	if f.contains != "" {
+		switch {
+		case event.Data != nil && event.Data.Log != nil:
+			return strings.Contains(event.Data.Log.Value, f.contains)
+		case event.Trace != nil:
+			return strings.Contains(event.Trace.Message, f.contains)
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+type subscriber struct {
+	filter streamFilter
+	events chan StreamEvent
+	slow   chan struct{} //closed if the subscriber could not keep up
+	done   chan struct{} //closed when the agent shuts down
+	once   sync.Once
+}
+
+// broadcaster fans out events to all subscribers without ever blocking the publisher,
+// subscribers with a full buffer are disconnected.
+type broadcaster struct {
+	lock   sync.RWMutex
+	subs   map[*subscriber]bool
+	buffer int
+	done   chan struct{} //closed on shutdown, ends all streams
+	closed bool
+}
+
+func newBroadcaster(buffer int) *broadcaster {
+	if buffer <= 0 {
+		buffer = defaultStreamBuffer
+	}
+	return &broadcaster{
+		subs:   make(map[*subscriber]bool),
+		buffer: buffer,
+		done:   make(chan struct{}),
+	}
+}
+
+func (b *broadcaster) subscribe(filter streamFilter) *subscriber {
+	sub := &subscriber{
+		filter: filter,
+		events: make(chan StreamEvent, b.buffer),
+		slow:   make(chan struct{}),
+		done:   b.done,
+	}
+
+	b.lock.Lock()
+	if !b.closed {
+		b.subs[sub] = true
+	}
+	b.lock.Unlock()
+
+	return sub
+}
+
+func (b *broadcaster) unsubscribe(sub *subscriber) {
+	b.lock.Lock()
+	delete(b.subs, sub)
+	b.lock.Unlock()
+}
+
+func (b *broadcaster) publish(event StreamEvent) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for sub := range b.subs {
+		if !sub.filter.matches(event) {
+			continue
+		}
+
+		select {
+		case sub.events <- event:
+		default:
+			sub.once.Do(func() {
+				log.Warn("disconnecting slow stream subscriber")
+				close(sub.slow)
+			})
+		}
+	}
+}
+
+// close ends the streams of all subscribers, later subscribers are ended right away
+func (b *broadcaster) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+		b.subs = make(map[*subscriber]bool)
+	}
+}
+
+func (agent *Agent) publish(event StreamEvent) {
+	if agent.stream != nil {
+		event.vdc = agent.name
+		agent.stream.publish(event)
+	}
+}
+
+func (agent *Agent) publishData(data ElasticData) {
+	event := StreamEvent{Type: EventMeter, Data: &data}
+	if data.Log != nil {
+		event.Type = EventLog
+	} else if data.Alert != nil {
+		event.Type = EventAlert
+	}
+	agent.publish(event)
+}
+
+// checkOrigin accepts websocket streams from clients that are not browsers and from pages of the
+// agent itself or one of the StreamOrigins, so other sites cannot read the stream with the
+// credentials of a visitor
+func (agent *Agent) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, req.Host) {
+		return true
+	}
+
+	for _, allowed := range agent.cnf.StreamOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stream pushes all accepted documents and trace events to the client, either as
+// server-sent events or over a websocket if the client asks for an upgrade.
+func (agent *Agent) Stream(w http.ResponseWriter, req *http.Request) {
+	if agent.stream == nil {
+		writeError(w, http.StatusServiceUnavailable, "streaming is not available")
+		return
+	}
+
+	filter := newStreamFilter(req)
+	if agent.tenants != nil {
+		filter.vdc = agent.name
+	}
+
+	sub := agent.stream.subscribe(filter)
+	defer agent.stream.unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(req) {
+		agent.streamWebSocket(w, req, sub)
+	} else {
+		agent.streamEvents(w, req, sub)
+	}
+}
+
+func (agent *Agent) streamWebSocket(w http.ResponseWriter, req *http.Request, sub *subscriber) {
+	upgrader := websocket.Upgrader{CheckOrigin: agent.checkOrigin}
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Warnf("could not upgrade stream %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	//the client is not expected to send anything, reading is only used to notice when it leaves
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatInterval)); err != nil {
+				return
+			}
+		case <-sub.slow:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"),
+				time.Now().Add(time.Second))
+			return
+		case <-sub.done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"),
+				time.Now().Add(time.Second))
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+func (agent *Agent) streamEvents(w http.ResponseWriter, req *http.Request, sub *subscriber) {
+	//the connection is taken over so the write timeout of the server does not end long running streams
+	if hijacker, ok := w.(http.Hijacker); ok && req.ProtoMajor == 1 {
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			log.Warnf("could not take over stream connection %+v", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			io.Copy(ioutil.Discard, buf)
+		}()
+		defer func() {
+			conn.Close()
+			<-gone
+		}()
+
+		fmt.Fprint(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n")
+		writeEvents(buf, buf.Flush, sub, gone)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvents(w, func() error {
+		flusher.Flush()
+		return nil
+	}, sub, req.Context().Done())
+}
+
+func writeEvents(out io.Writer, flush func() error, sub *subscriber, gone <-chan struct{}) {
+	flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-sub.events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(out, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(out, ": heartbeat\n\n")
+		case <-sub.slow:
+			fmt.Fprint(out, "event: error\ndata: {\"error\":\"slow consumer\"}\n\n")
+			flush()
+			return
+		case <-sub.done:
+			return
+		case <-gone:
+			return
+		}
+
+		if err := flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/opentracing/opentracing-go"
+)
+
+func TestBroadcaster(t *testing.T) {
+	b := newBroadcaster(2)
+
+	meters := b.subscribe(streamFilter{types: map[string]bool{EventMeter: true}, name: "responseTime"})
+	logs := b.subscribe(streamFilter{contains: "error"})
+
+	b.publish(StreamEvent{Type: EventMeter, Data: &ElasticData{Meter: &MeterMessage{Name: "responseTime"}}})
+	b.publish(StreamEvent{Type: EventMeter, Data: &ElasticData{Meter: &MeterMessage{Name: "payload"}}})
+	b.publish(StreamEvent{Type: EventLog, Data: &ElasticData{Log: &LogMessage{Value: "an error occurred"}}})
+	b.publish(StreamEvent{Type: EventLog, Data: &ElasticData{Log: &LogMessage{Value: "all fine"}}})
+
+	if len(meters.events) != 1 || len(logs.events) != 1 {
+		t.Fatalf("unexpected number of events meters:%d logs:%d", len(meters.events), len(logs.events))
+	}
+
+	//the log subscriber does not read, its buffer of two overflows on the third event
+	b.publish(StreamEvent{Type: EventLog, Data: &ElasticData{Log: &LogMessage{Value: "error 2"}}})
+	b.publish(StreamEvent{Type: EventLog, Data: &ElasticData{Log: &LogMessage{Value: "error 3"}}})
+
+	select {
+	case <-logs.slow:
+	default:
+		t.Error("slow subscriber was not disconnected")
+	}
+
+	select {
+	case <-meters.slow:
+		t.Error("subscriber that keeps up was disconnected")
+	default:
+	}
+}
+
+func TestStreamServerSentEvents(t *testing.T) {
+	agent := &Agent{
+		name:   "test",
+		spans:  make(map[string]opentracing.Span),
+		stream: newBroadcaster(16),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(agent.Stream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?type=log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	waitForSubscriber(t, agent)
+	agent.AddToES(ElasticData{Meter: &MeterMessage{Name: "filtered"}})
+	agent.addLog(LogMessage{Value: "streamed"})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if lines[0] != "event: log" {
+		t.Errorf("unexpected event %s", lines[0])
+	}
+
+	var event StreamEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Data == nil || event.Data.Log == nil || event.Data.Log.Value != "streamed" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	agent := &Agent{
+		name:   "test",
+		spans:  make(map[string]opentracing.Span),
+		stream: newBroadcaster(16),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(agent.Stream))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?name=responseTime", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitForSubscriber(t, agent)
+	agent.AddToES(ElasticData{Meter: &MeterMessage{Name: "payload"}})
+	agent.AddToES(ElasticData{Meter: &MeterMessage{Name: "responseTime", Value: 12.0}})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event StreamEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Type != EventMeter || event.Data.Meter.Name != "responseTime" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	agent := &Agent{
+		name:   "test",
+		spans:  make(map[string]opentracing.Span),
+		stream: newBroadcaster(16),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(agent.Stream))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 100; i++ {
+		agent.stream.lock.RLock()
+		subscribed := len(agent.stream.subs)
+		agent.stream.lock.RUnlock()
+		if subscribed == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	agent.stream.close()
+
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the event stream to end %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("event stream was not ended on shutdown")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected the websocket to be closed %+v", err)
+	}
+
+	//streams opened during the shutdown end right away
+	late, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Body.Close()
+	if _, err := ioutil.ReadAll(late.Body); err != nil {
+		t.Errorf("expected a late stream to end %+v", err)
+	}
+}
+
+func TestStreamOrigin(t *testing.T) {
+	agent := &Agent{
+		name:   "test",
+		spans:  make(map[string]opentracing.Span),
+		stream: newBroadcaster(16),
+		cnf:    Configuration{StreamOrigins: []string{"https://dashboard.example.com"}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(agent.Stream))
+	defer server.Close()
+	address := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for origin, allowed := range map[string]bool{
+		"":                              true,
+		server.URL:                      true,
+		"https://dashboard.example.com": true,
+		"https://evil.example.com":      false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(address, header)
+		if allowed && err != nil {
+			t.Errorf("expected origin %q to be allowed %+v", origin, err)
+		}
+		if !allowed && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("expected origin %q to be rejected", origin)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func waitForSubscriber(t *testing.T, agent *Agent) {
+	for i := 0; i < 100; i++ {
+		agent.stream.lock.RLock()
+		subscribed := len(agent.stream.subs) > 0
+		agent.stream.lock.RUnlock()
+		if subscribed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no subscriber connected")
+}
@@ -0,0 +1,411 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogConfig enables syslog inputs, a listener is only started if its address is set.
+type SyslogConfig struct {
+	UDP      string //address for syslog over udp, e.g. :514
+	TCP      string //address for syslog over tcp, e.g. :514
+	TLS      string //address for syslog over tls, e.g. :6514
+	CertFile string //certificate used for the tls listener
+	KeyFile  string //private key used for the tls listener
+}
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var severityLevels = []string{"fatal", "fatal", "fatal", "error", "warn", "info", "info", "debug"}
+
+// parseSyslog parses a RFC 5424 or RFC 3164 message, messages without a valid
+// priority are accepted as plain text.
+func parseSyslog(raw string, received time.Time) LogMessage {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+	msg := LogMessage{Timestamp: received, Value: raw, Source: "syslog"}
+
+	if !strings.HasPrefix(raw, "<") {
+		return msg
+	}
+
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return msg
+	}
+
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri > 191 {
+		return msg
+	}
+
+	fields := &SyslogFields{
+		Facility: facilities[pri/8],
+		Severity: severities[pri%8],
+	}
+	msg.Syslog = fields
+	msg.Level = severityLevels[pri%8]
+
+	rest := raw[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		parseRFC5424(rest[2:], &msg)
+	} else {
+		parseRFC3164(rest, &msg, received)
+	}
+
+	return msg
+}
+
+func parseRFC5424(rest string, msg *LogMessage) {
+	header := strings.SplitN(rest, " ", 6)
+	if len(header) < 6 {
+		msg.Value = rest
+		return
+	}
+
+	nilValue := func(value string) string {
+		if value == "-" {
+			return ""
+		}
+		return value
+	}
+
+	if stamp, err := time.Parse(time.RFC3339Nano, header[0]); err == nil {
+		msg.Timestamp = stamp
+	}
+
+	msg.Syslog.Hostname = nilValue(header[1])
+	msg.Syslog.AppName = nilValue(header[2])
+	msg.Syslog.ProcID = nilValue(header[3])
+	msg.Syslog.MsgID = nilValue(header[4])
+
+	data, text := parseStructuredData(header[5])
+	msg.Syslog.StructuredData = data
+	msg.Value = strings.TrimPrefix(text, "\ufeff")
+}
+
+// parseStructuredData returns the structured data elements and the remaining message
+func parseStructuredData(rest string) (map[string]map[string]string, string) {
+	if strings.HasPrefix(rest, "-") {
+		return nil, strings.TrimPrefix(rest[1:], " ")
+	}
+
+	data := make(map[string]map[string]string)
+	i := 0
+	for i < len(rest) && rest[i] == '[' {
+		i++
+		start := i
+		for i < len(rest) && rest[i] != ' ' && rest[i] != ']' {
+			i++
+		}
+		params := make(map[string]string)
+		data[rest[start:i]] = params
+
+		for i < len(rest) && rest[i] != ']' {
+			if rest[i] == ' ' {
+				i++
+				continue
+			}
+			eq := strings.IndexByte(rest[i:], '=')
+			if eq < 0 || i+eq+1 >= len(rest) || rest[i+eq+1] != '"' {
+				//malformed element, keep everything as message
+				return nil, rest
+			}
+			name := rest[i : i+eq]
+			i += eq + 2
+
+			var value strings.Builder
+			for i < len(rest) && rest[i] != '"' {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+				i++
+			}
+			params[name] = value.String()
+			i++
+		}
+		i++
+	}
+
+	if i > len(rest) {
+		return nil, rest
+	}
+
+	return data, strings.TrimPrefix(rest[i:], " ")
+}
+
+func parseRFC3164(rest string, msg *LogMessage, received time.Time) {
+	//Mmm dd hh:mm:ss, the day is space padded
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if stamp, err := time.Parse(time.Stamp, rest[:15]); err == nil {
+			msg.Timestamp = time.Date(received.Year(), stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, time.Local)
+			rest = rest[16:]
+
+			if space := strings.IndexByte(rest, ' '); space > 0 && !strings.HasSuffix(rest[:space], ":") {
+				msg.Syslog.Hostname = rest[:space]
+				rest = rest[space+1:]
+			}
+		}
+	}
+
+	//TAG[pid]: message
+	if colon := strings.Index(rest, ": "); colon > 0 && !strings.ContainsAny(rest[:colon], " ") {
+		tag := rest[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			msg.Syslog.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		msg.Syslog.AppName = tag
+		rest = rest[colon+2:]
+	}
+
+	msg.Value = rest
+}
+
+type syslogServer struct {
+	emit func(LogMessage)
+
+	packet    net.PacketConn
+	listeners []net.Listener
+
+	lock   sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool //shutdown started, new connections are closed right away
+	wg     sync.WaitGroup
+}
+
+func newSyslogServer(cnf SyslogConfig, emit func(LogMessage)) (*syslogServer, error) {
+	s := &syslogServer{
+		emit:  emit,
+		conns: make(map[net.Conn]bool),
+	}
+
+	if cnf.UDP != "" {
+		packet, err := net.ListenPacket("udp", cnf.UDP)
+		if err != nil {
+			return nil, err
+		}
+		s.packet = packet
+	}
+
+	if cnf.TCP != "" {
+		listener, err := net.Listen("tcp", cnf.TCP)
+		if err != nil {
+			s.shutdown()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+
+	if cnf.TLS != "" {
+		cert, err := tls.LoadX509KeyPair(cnf.CertFile, cnf.KeyFile)
+		if err != nil {
+			s.shutdown()
+			return nil, fmt.Errorf("could not load syslog tls certificate: %s", err)
+		}
+		listener, err := tls.Listen("tcp", cnf.TLS, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			s.shutdown()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+
+	return s, nil
+}
+
+// maxSyslogMessage is the largest message that is accepted, larger stream frames close the connection
+const maxSyslogMessage = 64 * 1024
+
+// maxFrameDigits is the longest octet count prefix, enough for maxSyslogMessage
+const maxFrameDigits = 5
+
+var errFrameTooLarge = errors.New("syslog message is too large")
+
+func (s *syslogServer) start() {
+	if s.packet != nil {
+		log.Infof("receiving syslog on udp %s", s.packet.LocalAddr())
+		s.wg.Add(1)
+		go s.servePackets()
+	}
+
+	for _, listener := range s.listeners {
+		log.Infof("receiving syslog on %s", listener.Addr())
+		s.wg.Add(1)
+		go s.accept(listener)
+	}
+}
+
+func (s *syslogServer) servePackets() {
+	defer s.wg.Done()
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, _, err := s.packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.emit(parseSyslog(string(buf[:n]), time.Now()))
+	}
+}
+
+func (s *syslogServer) accept(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			//accepted while shutting down, shutdown already closed the other connections
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.serveStream(conn)
+	}
+}
+
+// serveStream reads messages framed by octet counting or newlines (RFC 6587)
+func (s *syslogServer) serveStream(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var raw string
+		if first[0] >= '0' && first[0] <= '9' {
+			length, err := readFrameLength(reader)
+			if err != nil {
+				log.Warnf("invalid syslog frame from %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			size, err := strconv.Atoi(length)
+			if err != nil || size <= 0 || size > maxSyslogMessage {
+				log.Warnf("invalid syslog frame of %s bytes from %s", length, conn.RemoteAddr())
+				return
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			raw = string(buf)
+		} else {
+			raw, err = readLine(reader)
+			if err == errFrameTooLarge {
+				log.Warnf("syslog message from %s exceeds %d bytes", conn.RemoteAddr(), maxSyslogMessage)
+				return
+			}
+			if err != nil && raw == "" {
+				return
+			}
+		}
+
+		if strings.TrimSpace(raw) != "" {
+			s.emit(parseSyslog(raw, time.Now()))
+		}
+	}
+}
+
+// readLine reads a newline framed message of at most maxSyslogMessage bytes including the newline
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, err := reader.ReadSlice('\n')
+		line = append(line, part...)
+		//without a newline yet, a message that already has the maximum size can only get larger
+		if len(line) > maxSyslogMessage || (err == bufio.ErrBufferFull && len(line) >= maxSyslogMessage) {
+			return "", errFrameTooLarge
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// readFrameLength reads the octet count of a frame up to the separating space
+func readFrameLength(reader *bufio.Reader) (string, error) {
+	var length []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' {
+			return string(length), nil
+		}
+		if c < '0' || c > '9' || len(length) == maxFrameDigits {
+			return "", fmt.Errorf("octet count is not a number of at most %d digits", maxFrameDigits)
+		}
+		length = append(length, c)
+	}
+}
+
+func (s *syslogServer) shutdown() {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	if s.packet != nil {
+		s.packet.Close()
+	}
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	msg := parseSyslog(`<165>1 2018-02-19T12:32:32.003Z vdc-host caf 8710 ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][meta note="a \"quoted\" value"] connection lost`, time.Now())
+
+	if msg.Syslog == nil {
+		t.Fatal("expected syslog fields")
+	}
+
+	expect := SyslogFields{Facility: "local4", Severity: "notice", Hostname: "vdc-host", AppName: "caf", ProcID: "8710", MsgID: "ID47"}
+	got := *msg.Syslog
+	got.StructuredData = nil
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %+v got %+v", expect, got)
+	}
+
+	if msg.Value != "connection lost" || msg.Level != "info" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+
+	if msg.Syslog.StructuredData["exampleSDID@32473"]["eventID"] != "1011" {
+		t.Errorf("unexpected structured data %+v", msg.Syslog.StructuredData)
+	}
+
+	if msg.Syslog.StructuredData["meta"]["note"] != `a "quoted" value` {
+		t.Errorf("escapes were not handled %+v", msg.Syslog.StructuredData)
+	}
+
+	stamp, _ := time.Parse(time.RFC3339, "2018-02-19T12:32:32.003Z")
+	if !msg.Timestamp.Equal(stamp) {
+		t.Errorf("timestamps did not match %s", msg.Timestamp)
+	}
+
+	msg = parseSyslog("<11>1 - - - - - -", time.Now())
+	if msg.Syslog.Severity != "err" || msg.Level != "error" || msg.Value != "" {
+		t.Errorf("nil values were not handled %+v %+v", msg, msg.Syslog)
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	msg := parseSyslog("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8\n", time.Now())
+
+	if msg.Syslog == nil {
+		t.Fatal("expected syslog fields")
+	}
+
+	if msg.Syslog.Facility != "auth" || msg.Syslog.Severity != "crit" || msg.Level != "fatal" {
+		t.Errorf("unexpected priority %+v", msg.Syslog)
+	}
+
+	if msg.Syslog.Hostname != "mymachine" || msg.Syslog.AppName != "su" || msg.Syslog.ProcID != "123" {
+		t.Errorf("unexpected header %+v", msg.Syslog)
+	}
+
+	if msg.Value != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("unexpected message %s", msg.Value)
+	}
+
+	if msg.Timestamp.Month() != time.October || msg.Timestamp.Day() != 11 || msg.Timestamp.Hour() != 22 {
+		t.Errorf("unexpected timestamp %s", msg.Timestamp)
+	}
+
+	msg = parseSyslog("just some text", time.Now())
+	if msg.Syslog != nil || msg.Value != "just some text" {
+		t.Errorf("plain text should be accepted as is %+v", msg)
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	received := make(chan LogMessage, 10)
+	server, err := newSyslogServer(SyslogConfig{UDP: "127.0.0.1:0", TCP: "127.0.0.1:0"}, func(msg LogMessage) {
+		received <- msg
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.start()
+	defer server.shutdown()
+
+	udp, err := net.Dial("udp", server.packet.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "<14>1 - host app - - - over udp")
+
+	tcp, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	framed := "<14>1 - host app - - - octet counted"
+	fmt.Fprintf(tcp, "%d %s<14>Oct 11 22:14:15 host app: newline framed\n", len(framed), framed)
+
+	values := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-received:
+			values[msg.Value] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out, got %v", values)
+		}
+	}
+
+	for _, value := range []string{"over udp", "octet counted", "newline framed"} {
+		if !values[value] {
+			t.Errorf("missing message %s in %v", value, values)
+		}
+	}
+}
+
+func TestSyslogFrameLimit(t *testing.T) {
+	server, err := newSyslogServer(SyslogConfig{TCP: "127.0.0.1:0"}, func(msg LogMessage) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.start()
+	defer server.shutdown()
+
+	frames := []string{
+		"999999999999 <14>1 - host app - - - huge",
+		"65537 <14>1 - host app - - - too large",
+		"<14>1 - host app - - - " + strings.Repeat("x", maxSyslogMessage),
+	}
+	for _, frame := range frames {
+		conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, frame)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !isClosed(err) {
+			t.Errorf("expected the connection to be closed for %q but got %v", frame, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSyslogAcceptAfterShutdown(t *testing.T) {
+	server, err := newSyslogServer(SyslogConfig{}, func(msg LogMessage) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//a connection accepted during the shutdown is closed instead of being served
+	server.wg.Add(1)
+	server.accept(listener)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !isClosed(err) {
+		t.Errorf("expected the connection to be closed but got %v", err)
+	}
+	if len(server.conns) != 0 {
+		t.Errorf("expected no connections to be tracked %v", server.conns)
+	}
+}
+
+// isClosed reports whether a read failed because the peer closed the connection
+func isClosed(err error) bool {
+	if err == nil {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return !ok || !ne.Timeout()
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxTailLine  = 64 * 1024   //longer lines are truncated
+	maxTailEntry = 1024 * 1024 //multiline entries are flushed and truncated at this size
+)
+
+// TailConfig describes local log files that are followed and forwarded like messages sent to /v1/log.
+type TailConfig struct {
+	Paths         []string      //glob patterns of the files to follow
+	OffsetFile    string        //file used to persist read offsets across restarts
+	Multiline     string        //regex matching the first line of an entry, other lines are appended to the previous entry
+	PollInterval  time.Duration //how often files are checked for new data, defaults to one second
+	FromBeginning bool          //read files found at startup from the beginning instead of the end
+}
+
+type fileOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type tailedFile struct {
+	path      string
+	file      *os.File
+	info      os.FileInfo
+	offset    int64    //end of the last complete line
+	partial   []byte   //data after the last newline
+	skipping  bool     //the rest of a truncated line is discarded up to the next newline
+	pending   []string //lines of the current multiline entry
+	entry     int64    //offset of the first line of the pending entry
+	size      int      //bytes of the pending entry
+	truncated bool     //continuation lines are discarded up to the next entry
+}
+
+// committed is the offset that is persisted, a pending multiline entry is read again after a restart
+func (tf *tailedFile) committed() int64 {
+	if len(tf.pending) > 0 {
+		return tf.entry
+	}
+	return tf.offset
+}
+
+type tailer struct {
+	cnf       TailConfig
+	multiline *regexp.Regexp
+	emit      func(LogMessage)
+
+	files   map[string]*tailedFile
+	offsets map[string]fileOffset
+	started bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTailer(cnf TailConfig, emit func(LogMessage)) (*tailer, error) {
+	t := &tailer{
+		cnf:     cnf,
+		emit:    emit,
+		files:   make(map[string]*tailedFile),
+		offsets: make(map[string]fileOffset),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if t.cnf.PollInterval <= 0 {
+		t.cnf.PollInterval = time.Second
+	}
+
+	if cnf.Multiline != "" {
+		expr, err := regexp.Compile(cnf.Multiline)
+		if err != nil {
+			return nil, err
+		}
+		t.multiline = expr
+	}
+
+	for _, pattern := range cnf.Paths {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if cnf.OffsetFile != "" {
+		if data, err := ioutil.ReadFile(cnf.OffsetFile); err == nil {
+			if err := json.Unmarshal(data, &t.offsets); err != nil {
+				log.Warnf("ignoring invalid offset file %s %+v", cnf.OffsetFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *tailer) start() {
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(t.cnf.PollInterval)
+		defer ticker.Stop()
+
+		t.poll()
+		for {
+			select {
+			case <-t.stop:
+				t.close()
+				return
+			case <-ticker.C:
+				t.poll()
+			}
+		}
+	}()
+}
+
+func (t *tailer) shutdown() {
+	close(t.stop)
+	<-t.done
+}
+
+// poll discovers files, reads everything that was appended since the last poll
+// and persists the new offsets.
+func (t *tailer) poll() {
+	seen := make(map[string]bool)
+	for _, pattern := range t.cnf.Paths {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			seen[path] = true
+			t.follow(path)
+		}
+	}
+
+	for path, tf := range t.files {
+		if !seen[path] {
+			log.Infof("stopped following %s", path)
+			t.read(tf)
+			t.flush(tf)
+			tf.file.Close()
+			delete(t.files, path)
+			delete(t.offsets, path)
+		}
+	}
+
+	t.started = true
+	t.saveOffsets()
+}
+
+func (t *tailer) follow(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	tf, ok := t.files[path]
+	if ok && !os.SameFile(tf.info, info) {
+		//the file was rotated, finish the old one before switching
+		log.Infof("%s was rotated", path)
+		t.read(tf)
+		t.flush(tf)
+		tf.file.Close()
+		delete(t.files, path)
+		ok = false
+	}
+
+	if !ok {
+		if tf = t.open(path, info, !t.started); tf == nil {
+			return
+		}
+		t.files[path] = tf
+	} else if info.Size() < tf.offset {
+		log.Infof("%s was truncated", path)
+		tf.offset = 0
+		tf.partial = nil
+		tf.skipping = false
+	}
+
+	tf.info = info
+	if t.read(tf) == 0 {
+		//no new data, an open multiline entry is complete
+		t.flush(tf)
+	}
+}
+
+func (t *tailer) open(path string, info os.FileInfo, initial bool) *tailedFile {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Warnf("could not open %s %+v", path, err)
+		return nil
+	}
+
+	tf := &tailedFile{
+		path: path,
+		file: file,
+		info: info,
+	}
+
+	if stored, ok := t.offsets[path]; ok && stored.Inode == inode(info) && stored.Offset <= info.Size() {
+		tf.offset = stored.Offset
+	} else if initial && !t.cnf.FromBeginning {
+		tf.offset = info.Size()
+	}
+
+	log.Infof("following %s from offset %d", path, tf.offset)
+	return tf
+}
+
+// read consumes all new data of the file and returns the number of bytes read
+func (t *tailer) read(tf *tailedFile) int {
+	buf := make([]byte, 32*1024)
+	total := 0
+	for {
+		n, err := tf.file.ReadAt(buf, tf.offset+int64(len(tf.partial)))
+		if n > 0 {
+			total += n
+			tf.partial = append(tf.partial, buf[:n]...)
+			for {
+				i := bytes.IndexByte(tf.partial, '\n')
+				if i < 0 {
+					if len(tf.partial) >= maxTailLine {
+						t.truncate(tf)
+					}
+					break
+				}
+				if tf.skipping {
+					tf.skipping = false
+				} else {
+					t.line(tf, strings.TrimRight(string(tf.partial[:i]), "\r"))
+				}
+				tf.partial = tf.partial[i+1:]
+				tf.offset += int64(i + 1)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warnf("could not read %s %+v", tf.path, err)
+			}
+			break
+		}
+	}
+
+	t.offsets[tf.path] = fileOffset{Inode: inode(tf.info), Offset: tf.committed()}
+	return total
+}
+
+// truncate handles a line without a newline that exceeds maxTailLine, its beginning is passed on
+// and the rest is discarded so the buffer does not grow with the line
+func (t *tailer) truncate(tf *tailedFile) {
+	if !tf.skipping {
+		log.Warnf("truncating a line of %s that exceeds %d bytes", tf.path, maxTailLine)
+		t.line(tf, string(tf.partial[:maxTailLine]))
+		tf.skipping = true
+	}
+	tf.offset += int64(len(tf.partial))
+	tf.partial = nil
+}
+
+func (t *tailer) line(tf *tailedFile, line string) {
+	if t.multiline == nil {
+		if line != "" {
+			t.emit(LogMessage{Timestamp: time.Now(), Value: line, Source: tf.path})
+		}
+		return
+	}
+
+	if t.multiline.MatchString(line) {
+		t.flush(tf)
+		tf.truncated = false
+	} else if tf.truncated {
+		return
+	} else if len(tf.pending) > 0 && tf.size+len(line) > maxTailEntry {
+		log.Warnf("truncating an entry of %s that exceeds %d bytes", tf.path, maxTailEntry)
+		t.flush(tf)
+		tf.truncated = true
+		return
+	}
+
+	if len(tf.pending) == 0 {
+		tf.entry = tf.offset
+	}
+	tf.pending = append(tf.pending, line)
+	tf.size += len(line) + 1
+}
+
+func (t *tailer) flush(tf *tailedFile) {
+	if len(tf.pending) == 0 {
+		return
+	}
+	t.emit(LogMessage{Timestamp: time.Now(), Value: strings.Join(tf.pending, "\n"), Source: tf.path})
+	tf.pending = nil
+	tf.size = 0
+	t.offsets[tf.path] = fileOffset{Inode: inode(tf.info), Offset: tf.committed()}
+}
+
+func (t *tailer) close() {
+	for _, tf := range t.files {
+		t.flush(tf)
+		tf.file.Close()
+	}
+	t.saveOffsets()
+}
+
+func (t *tailer) saveOffsets() {
+	if t.cnf.OffsetFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(t.offsets)
+	if err != nil {
+		return
+	}
+
+	//write and rename so a crash never leaves a half written offset file
+	tmp := t.cnf.OffsetFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Warnf("could not persist offsets %+v", err)
+		return
+	}
+	if err := os.Rename(tmp, t.cnf.OffsetFile); err != nil {
+		log.Warnf("could not persist offsets %+v", err)
+	}
+}
+
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
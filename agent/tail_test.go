@@ -0,0 +1,200 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vdc.log")
+	offsets := filepath.Join(dir, "offsets.json")
+	appendFile(t, path, "old line\n")
+
+	var got []string
+	emit := func(msg LogMessage) {
+		if msg.Source != path {
+			t.Errorf("unexpected source %s", msg.Source)
+		}
+		got = append(got, msg.Value)
+	}
+
+	cnf := TailConfig{Paths: []string{filepath.Join(dir, "*.log")}, OffsetFile: offsets}
+	tail, err := newTailer(cnf, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//existing content is skipped on the first start
+	tail.poll()
+	appendFile(t, path, "first\nsecond\npart")
+	tail.poll()
+	appendFile(t, path, "ial\n")
+	tail.poll()
+
+	expect := []string{"first", "second", "partial"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v got %v", expect, got)
+	}
+
+	//rotation: remaining data of the old file is read before switching to the new file
+	appendFile(t, path, "before rotation\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "after rotation\n")
+	tail.poll()
+
+	//truncation starts from the beginning again
+	if err := ioutil.WriteFile(path, []byte("truncated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tail.poll()
+	tail.close()
+
+	expect = append(expect, "before rotation", "after rotation", "truncated")
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %v got %v", expect, got)
+	}
+
+	//a restarted tailer continues at the persisted offset
+	appendFile(t, path, "while stopped\n")
+	got = nil
+	tail, err = newTailer(cnf, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail.poll()
+	tail.close()
+
+	if !reflect.DeepEqual(got, []string{"while stopped"}) {
+		t.Fatalf("expected to resume at the stored offset got %v", got)
+	}
+}
+
+func TestTailerMultiline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vdc.log")
+	first := "2018-02-19 ERROR failed\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:12)\n2018-02-19 INFO recovered\n"
+	appendFile(t, path, first)
+
+	var got []string
+	tail, err := newTailer(TailConfig{
+		Paths:         []string{path},
+		Multiline:     `^[0-9]{4}-`,
+		FromBeginning: true,
+	}, func(msg LogMessage) {
+		got = append(got, msg.Value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the pending entry is read again after a restart, so only the offset before it is persisted
+	tail.poll()
+	if offset, start := tail.offsets[path].Offset, int64(strings.Index(first, "2018-02-19 INFO")); offset != start {
+		t.Errorf("expected the offset %d of the pending entry to be persisted got %d", start, offset)
+	}
+
+	//the last entry is complete once no more data arrives
+	tail.poll()
+
+	expect := []string{
+		"2018-02-19 ERROR failed\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:12)",
+		"2018-02-19 INFO recovered",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expected %q got %q", expect, got)
+	}
+	if offset := tail.offsets[path].Offset; offset != int64(len(first)) {
+		t.Errorf("expected the offset %d after the flushed entry got %d", len(first), offset)
+	}
+}
+
+func TestTailerLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines, entries := filepath.Join(dir, "lines.log"), filepath.Join(dir, "entries.log")
+	appendFile(t, lines, strings.Repeat("x", 3*maxTailLine))
+	appendFile(t, entries, "2018-02-19 ERROR failed\n"+strings.Repeat(strings.Repeat("y", 1000)+"\n", 2*maxTailEntry/1000))
+
+	got := make(map[string][]string)
+	newTail := func(path, multiline string) *tailer {
+		tail, err := newTailer(TailConfig{Paths: []string{path}, Multiline: multiline, FromBeginning: true}, func(msg LogMessage) {
+			got[msg.Source] = append(got[msg.Source], msg.Value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tail
+	}
+
+	//a line without newline is truncated instead of being buffered, its rest is discarded
+	tail := newTail(lines, "")
+	tail.poll()
+	if files := tail.files[lines]; len(files.partial) > 0 || files.offset != int64(3*maxTailLine) {
+		t.Errorf("expected the long line to be consumed, buffered %d offset %d", len(files.partial), files.offset)
+	}
+	appendFile(t, lines, "rest\nnext\n")
+	tail.poll()
+	if len(got[lines]) != 2 || got[lines][0] != strings.Repeat("x", maxTailLine) || got[lines][1] != "next" {
+		t.Errorf("expected the truncated line and the next one got %d lines", len(got[lines]))
+	}
+
+	//an entry is flushed at the limit, its remaining lines are discarded up to the next entry
+	tail = newTail(entries, `^[0-9]{4}-`)
+	tail.poll()
+	appendFile(t, entries, "2018-02-19 INFO recovered\n")
+	tail.poll()
+	tail.poll()
+	if len(got[entries]) != 2 || len(got[entries][0]) > maxTailEntry || got[entries][1] != "2018-02-19 INFO recovered" {
+		t.Errorf("expected the truncated entry and the next one got %d entries", len(got[entries]))
+	}
+}
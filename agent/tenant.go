@@ -0,0 +1,343 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+const (
+	defaultTenantHeader = "X-VDC-Name"
+	defaultKeyHeader    = "X-API-Key"
+	defaultMaxUnknown   = 100
+)
+
+var errTooManyTenants = errors.New("too many VDCs")
+
+// names of tenants end up in index names, so only a safe subset is accepted
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type MultiTenantConfig struct {
+	Enabled      bool
+	Header       string           //header naming the VDC of a request (default X-VDC-Name)
+	KeyHeader    string           //header carrying the api key of a VDC (default X-API-Key)
+	AllowUnknown bool             //accept VDCs that are not listed in Tenants
+	MaxUnknown   int              //number of unlisted VDCs that are served with AllowUnknown (default 100)
+	Tenants      []TenantSettings //known VDCs
+
+	RequestsPerSecond float64 //default rate limit of a VDC, unlimited if not set
+	MaxDocuments      int     //default number of meters and logs a VDC may write per day, unlimited if not set
+}
+
+type TenantSettings struct {
+	Name              string
+	APIKey            string  //if set, requests for this VDC have to present the key
+	ServiceName       string  //zipkin service name of the spans (default the name of the VDC)
+	RequestsPerSecond float64 //overrides the default rate limit
+	MaxDocuments      int     //overrides the default daily quota
+}
+
+// tenantLimits holds the rate limit and quota of a single VDC
+type tenantLimits struct {
+	lock         sync.Mutex
+	requests     *tokenBucket
+	maxDocuments int
+	day          string
+	documents    int
+}
+
+func newTenantLimits(cnf MultiTenantConfig, settings TenantSettings) *tenantLimits {
+	limits := &tenantLimits{maxDocuments: cnf.MaxDocuments}
+	if settings.MaxDocuments > 0 {
+		limits.maxDocuments = settings.MaxDocuments
+	}
+
+	rate := cnf.RequestsPerSecond
+	if settings.RequestsPerSecond > 0 {
+		rate = settings.RequestsPerSecond
+	}
+	if rate > 0 {
+		limits.requests = &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+	}
+
+	return limits
+}
+
+// allow takes a request from the rate limit
+func (l *tenantLimits) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.requests == nil || l.requests.take(now)
+}
+
+// consume counts a document against the daily quota
+func (l *tenantLimits) consume(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxDocuments <= 0 {
+		return true
+	}
+
+	if day := now.UTC().Format("2006-01-02"); day != l.day {
+		l.day = day
+		l.documents = 0
+	}
+
+	if l.documents >= l.maxDocuments {
+		return false
+	}
+	l.documents++
+	return true
+}
+
+type tenantRegistry struct {
+	cnf      MultiTenantConfig
+	root     string //name of the VDC served by the root agent
+	settings map[string]TenantSettings
+	keys     map[string]string //api key to VDC name
+
+	lock    sync.Mutex
+	agents  map[string]*Agent
+	unknown int //agents of VDCs that are not listed
+}
+
+func newTenantRegistry(cnf MultiTenantConfig, root string) (*tenantRegistry, error) {
+	if cnf.Header == "" {
+		cnf.Header = defaultTenantHeader
+	}
+	if cnf.KeyHeader == "" {
+		cnf.KeyHeader = defaultKeyHeader
+	}
+	if cnf.MaxUnknown <= 0 {
+		cnf.MaxUnknown = defaultMaxUnknown
+	}
+
+	registry := &tenantRegistry{
+		cnf:      cnf,
+		root:     root,
+		settings: make(map[string]TenantSettings),
+		keys:     make(map[string]string),
+		agents:   make(map[string]*Agent),
+	}
+
+	for _, settings := range cnf.Tenants {
+		if !tenantName.MatchString(settings.Name) {
+			return nil, fmt.Errorf("invalid VDC name %s", settings.Name)
+		}
+		if _, ok := registry.settings[settings.Name]; ok {
+			return nil, fmt.Errorf("VDC %s is listed twice", settings.Name)
+		}
+		registry.settings[settings.Name] = settings
+
+		if settings.APIKey != "" {
+			if _, ok := registry.keys[settings.APIKey]; ok {
+				return nil, fmt.Errorf("api key of VDC %s is not unique", settings.Name)
+			}
+			registry.keys[settings.APIKey] = settings.Name
+		}
+	}
+
+	return registry, nil
+}
+
+// resolve identifies the VDC of a request by the path, the header or the api key
+func (r *tenantRegistry) resolve(req *http.Request) (string, int, error) {
+	name := mux.Vars(req)["vdc"]
+	if name == "" {
+		name = req.Header.Get(r.cnf.Header)
+	}
+
+	key := req.Header.Get(r.cnf.KeyHeader)
+	if key != "" {
+		owner, ok := r.keys[key]
+		if !ok {
+			return "", http.StatusUnauthorized, fmt.Errorf("unknown api key")
+		}
+		if name == "" {
+			name = owner
+		} else if name != owner {
+			return "", http.StatusForbidden, fmt.Errorf("api key does not belong to VDC %s", name)
+		}
+	}
+
+	//requests without a VDC are served as the root VDC, which may require a key as well
+	if name == "" {
+		if r.settings[r.root].APIKey != "" {
+			return "", http.StatusUnauthorized, fmt.Errorf("VDC %s requires an api key", r.root)
+		}
+		return "", 0, nil
+	}
+
+	if !tenantName.MatchString(name) {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid VDC name")
+	}
+
+	settings, known := r.settings[name]
+	if !known && name != r.root && !r.cnf.AllowUnknown {
+		return "", http.StatusForbidden, fmt.Errorf("unknown VDC %s", name)
+	}
+	if settings.APIKey != "" && key != settings.APIKey {
+		return "", http.StatusUnauthorized, fmt.Errorf("VDC %s requires an api key", name)
+	}
+
+	return name, 0, nil
+}
+
+// tenant returns the agent serving a VDC, it shares all clients with the root agent. Alerts are
+// evaluated and stored per VDC, the log and process inputs belong to the root VDC only.
+func (agent *Agent) tenant(name string) (*Agent, error) {
+	registry := agent.tenants
+	if name == agent.name {
+		return agent, nil
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if child, ok := registry.agents[name]; ok {
+		return child, nil
+	}
+
+	settings, known := registry.settings[name]
+	if !known && registry.unknown >= registry.cnf.MaxUnknown {
+		return nil, errTooManyTenants
+	}
+	if agent.locks != nil {
+		agent.locks.swap.RLock()
+		defer agent.locks.swap.RUnlock()
+	}
+	child := *agent
+	child.name = name
+	child.spans = make(map[string]opentracing.Span)
+	child.limits = newTenantLimits(registry.cnf, settings)
+	child.metrics = newSpanMetrics(agent.spanConfig, func(data ElasticData) {
+		child.AddToES(data)
+	})
+	child.tailer, child.syslog, child.processes = nil, nil, nil
+
+	if agent.alerts != nil {
+		alerts, err := newAlertManager(agent.cnf.Alerting, func(data ElasticData) {
+			child.AddToES(data)
+		})
+		if err != nil {
+			return nil, err
+		}
+		alerts.vdc = name
+		child.alerts = alerts
+	}
+
+	if child.collector != nil {
+		tracer, err := newTracer(child.collector, child.isDebugging, child.endpoint, registry.serviceName(name))
+		if err != nil {
+			return nil, err
+		}
+		child.tracer = tracer
+	}
+
+	child.initIndex()
+	child.metrics.start()
+	if child.alerts != nil {
+		child.alerts.start()
+	}
+	registry.agents[name] = &child
+	if !known {
+		registry.unknown++
+	}
+	log.Infof("serving VDC %s", name)
+
+	return &child, nil
+}
+
+// serve resolves the VDC of a request and passes the request to the agent serving it
+func (agent *Agent) serve(handler func(*Agent, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		target := agent
+		if agent.tenants != nil {
+			name, status, err := agent.tenants.resolve(req)
+			if err != nil {
+				writeError(w, status, err.Error())
+				return
+			}
+
+			if name != "" {
+				if target, err = agent.tenant(name); err == errTooManyTenants {
+					writeError(w, http.StatusForbidden, "too many VDCs, VDC "+name+" is not accepted")
+					return
+				} else if err != nil {
+					log.Errorf("could not serve VDC %s %+v", name, err)
+					writeError(w, http.StatusInternalServerError, "could not serve VDC")
+					return
+				}
+			}
+		}
+
+		if target.limits != nil && !target.limits.allow(time.Now()) {
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+
+		handler(target, w, req)
+	}
+}
+
+// withinQuota counts a document that is written through the api against the quota of the VDC
+func (agent *Agent) withinQuota(w http.ResponseWriter) bool {
+	if agent.limits == nil || agent.limits.consume(time.Now()) {
+		return true
+	}
+	writeError(w, http.StatusTooManyRequests, "daily quota exceeded")
+	return false
+}
+
+// startSpan uses the tracer of the VDC, or the global tracer in single VDC mode
+func (agent *Agent) startSpan(operation string, options ...opentracing.StartSpanOption) opentracing.Span {
+	if tracer := agent.backends().tracer; tracer != nil {
+		return tracer.StartSpan(operation, options...)
+	}
+	return opentracing.StartSpan(operation, options...)
+}
+
+// serviceName returns the zipkin service name of a VDC
+func (r *tenantRegistry) serviceName(name string) string {
+	if service := r.settings[name].ServiceName; service != "" {
+		return service
+	}
+	return name
+}
+
+func (r *tenantRegistry) shutdown() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, child := range r.agents {
+		child.metrics.shutdown()
+		if child.alerts != nil {
+			child.alerts.shutdown()
+		}
+	}
+}
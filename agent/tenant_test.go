@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+func newTenantAgent(t *testing.T, cnf MultiTenantConfig) (*Agent, http.Handler) {
+	tenants, err := newTenantRegistry(cnf, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := &Agent{
+		name:    "root",
+		spans:   make(map[string]opentracing.Span),
+		tracing: true,
+		stream:  newBroadcaster(16),
+		tenants: tenants,
+		limits:  newTenantLimits(cnf, tenants.settings["root"]),
+	}
+	agent.metrics = newSpanMetrics(SpanMetricsConfig{}, func(data ElasticData) {})
+
+	router := mux.NewRouter()
+	agent.Routes(router.PathPrefix("/v1").Subrouter())
+	return agent, router
+}
+
+func send(handler http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTenantResolution(t *testing.T) {
+	agent, handler := newTenantAgent(t, MultiTenantConfig{
+		Tenants: []TenantSettings{
+			{Name: "open"},
+			{Name: "secured", APIKey: "secret"},
+			{Name: "other", APIKey: "other-secret"},
+		},
+	})
+	defer agent.tenants.shutdown()
+
+	cases := []struct {
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"/v1/log", nil, http.StatusOK},
+		{"/v1/vdc/open/log", nil, http.StatusOK},
+		{"/v1/log", map[string]string{"X-VDC-Name": "open"}, http.StatusOK},
+		{"/v1/log", map[string]string{"X-API-Key": "secret"}, http.StatusOK},
+		{"/v1/vdc/secured/log", map[string]string{"X-API-Key": "secret"}, http.StatusOK},
+		{"/v1/vdc/secured/log", nil, http.StatusUnauthorized},
+		{"/v1/vdc/secured/log", map[string]string{"X-API-Key": "wrong"}, http.StatusUnauthorized},
+		{"/v1/vdc/secured/log", map[string]string{"X-API-Key": "other-secret"}, http.StatusForbidden},
+		{"/v1/vdc/unknown/log", nil, http.StatusForbidden},
+		{"/v1/log", map[string]string{"X-VDC-Name": "../index"}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		if rr := send(handler, "POST", c.path, "message", c.headers); rr.Code != c.status {
+			t.Errorf("%s %v: expected %d got %d %s", c.path, c.headers, c.status, rr.Code, rr.Body.String())
+		}
+	}
+
+	if len(agent.tenants.agents) != 2 {
+		t.Errorf("expected agents for open and secured but got %d", len(agent.tenants.agents))
+	}
+	if child := agent.tenants.agents["secured"]; child == nil || child.getElasticIndex() == agent.getElasticIndex() {
+		t.Error("expected the VDCs to use their own index")
+	}
+}
+
+func TestTenantRootKey(t *testing.T) {
+	agent, handler := newTenantAgent(t, MultiTenantConfig{
+		Tenants: []TenantSettings{{Name: "root", APIKey: "root-secret"}},
+	})
+	defer agent.tenants.shutdown()
+
+	for _, c := range []struct {
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"/v1/log", nil, http.StatusUnauthorized},
+		{"/v1/vdc/root/log", nil, http.StatusUnauthorized},
+		{"/v1/log", map[string]string{"X-API-Key": "root-secret"}, http.StatusOK},
+	} {
+		if rr := send(handler, "POST", c.path, "message", c.headers); rr.Code != c.status {
+			t.Errorf("%s %v: expected %d got %d %s", c.path, c.headers, c.status, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestTenantMaxUnknown(t *testing.T) {
+	agent, handler := newTenantAgent(t, MultiTenantConfig{
+		AllowUnknown: true,
+		MaxUnknown:   2,
+		Tenants:      []TenantSettings{{Name: "listed"}},
+	})
+	defer agent.tenants.shutdown()
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/v1/vdc/a/log", http.StatusOK},
+		{"/v1/vdc/b/log", http.StatusOK},
+		{"/v1/vdc/c/log", http.StatusForbidden},
+		{"/v1/vdc/a/log", http.StatusOK},
+		{"/v1/vdc/listed/log", http.StatusOK},
+		{"/v1/log", http.StatusOK},
+	} {
+		if rr := send(handler, "POST", c.path, "message", nil); rr.Code != c.status {
+			t.Errorf("%s: expected %d got %d %s", c.path, c.status, rr.Code, rr.Body.String())
+		}
+	}
+
+	if len(agent.tenants.agents) != 3 {
+		t.Errorf("expected agents for a, b and listed but got %d", len(agent.tenants.agents))
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	agent, handler := newTenantAgent(t, MultiTenantConfig{
+		AllowUnknown: true,
+		MaxDocuments: 2,
+		Tenants: []TenantSettings{
+			{Name: "limited", RequestsPerSecond: 1, MaxDocuments: 10},
+		},
+	})
+	defer agent.tenants.shutdown()
+
+	if rr := send(handler, "POST", "/v1/vdc/limited/log", "first", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected the first request to pass but got %d", rr.Code)
+	}
+	if rr := send(handler, "POST", "/v1/vdc/limited/log", "second", nil); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the rate limit to apply but got %d", rr.Code)
+	}
+
+	//the quota of one VDC does not affect the others
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rr := send(handler, "POST", "/v1/vdc/any/log", "message", nil); rr.Code != status {
+			t.Errorf("document %d: expected %d got %d", i, status, rr.Code)
+		}
+	}
+	if rr := send(handler, "POST", "/v1/vdc/other/log", "message", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected another VDC to have its own quota but got %d", rr.Code)
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	agent, handler := newTenantAgent(t, MultiTenantConfig{AllowUnknown: true})
+	defer agent.tenants.shutdown()
+
+	trace := `{"traceId":"5e27c67030932221","spanId":"38357d8f309b379d","operation":"getData"}`
+	send(handler, "PUT", "/v1/vdc/a/trace", trace, nil)
+	send(handler, "POST", "/v1/vdc/a/close", trace, nil)
+
+	if body := send(handler, "GET", "/v1/vdc/a/metrics", "", nil).Body.String(); !strings.Contains(body, `vdc_requests_total{vdc="a",operation="getData"} 1`) {
+		t.Errorf("expected the request in the metrics of the VDC but got\n%s", body)
+	}
+	if body := send(handler, "GET", "/v1/metrics", "", nil).Body.String(); strings.Contains(body, "getData") {
+		t.Errorf("expected the metrics of the VDCs to be isolated but got\n%s", body)
+	}
+}
+
+func TestTenantAlerts(t *testing.T) {
+	agent, err := CreateAgent(Configuration{
+		VDCName:     "root",
+		Testing:     true,
+		MultiTenant: MultiTenantConfig{Enabled: true, AllowUnknown: true},
+		Alerting:    AlertingConfig{Logs: []LogAlertRule{{Name: "failures", Pattern: "failed"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown(context.Background())
+	handler := agent.Handler()
+
+	send(handler, "POST", "/v1/vdc/a/log", "payment failed", nil)
+
+	var alerts []CapturedDocument
+	for _, document := range agent.capture.documents {
+		if document.Data.Alert != nil {
+			alerts = append(alerts, document)
+		}
+	}
+	if len(alerts) != 1 || alerts[0].VDC != "a" || alerts[0].Data.Alert.VDC != "a" {
+		t.Fatalf("expected the alert to be stored for VDC a but got %+v", alerts)
+	}
+
+	if body := send(handler, "GET", "/v1/vdc/a/alerts", "", nil).Body.String(); !strings.Contains(body, `"rule":"failures"`) {
+		t.Errorf("expected the alert to be active for VDC a but got %s", body)
+	}
+	if body := send(handler, "GET", "/v1/alerts", "", nil).Body.String(); strings.Contains(body, "failures") {
+		t.Errorf("expected the alerts of the VDCs to be isolated but got %s", body)
+	}
+}
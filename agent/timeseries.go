@@ -0,0 +1,259 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+type InfluxDBConfig struct {
+	URL string //write endpoint including the database, e.g. http://influxdb:8086/write?db=ditas, the sink is enabled if set
+
+	Auth  HTTPAuthConfig
+	Batch BatchConfig
+}
+
+type RemoteWriteConfig struct {
+	URL string //prometheus remote write endpoint, e.g. http://prometheus:9090/api/v1/write, the sink is enabled if set
+
+	Auth  HTTPAuthConfig
+	Batch BatchConfig
+}
+
+// meterPoint is a numeric meter with the labels it is stored under
+type meterPoint struct {
+	name   string
+	labels map[string]string //vdc, unit and operationID if they are set
+	value  float64
+	time   time.Time
+}
+
+// newMeterPoint converts a meter, it returns false for other documents and meters without a numeric value
+func newMeterPoint(vdc string, data ElasticData) (meterPoint, bool) {
+	if data.Meter == nil || data.Meter.Name == "" {
+		return meterPoint{}, false
+	}
+	value, ok := toFloat(data.Meter.Value)
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return meterPoint{}, false
+	}
+
+	point := meterPoint{
+		name:   data.Meter.Name,
+		labels: map[string]string{"vdc": vdc},
+		value:  value,
+		time:   data.Meter.Timestamp,
+	}
+	if point.time.IsZero() {
+		point.time = data.Timestamp
+	}
+	if data.Meter.Unit != "" {
+		point.labels["unit"] = data.Meter.Unit
+	}
+	if data.Meter.OperationID != "" {
+		point.labels["operationID"] = data.Meter.OperationID
+	}
+	return point, true
+}
+
+// labelNames returns the names of the labels of a point in order
+func (p meterPoint) labelNames() []string {
+	names := make([]string, 0, len(p.labels))
+	for name := range p.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// meterSink writes numeric meters as time series, the encoding depends on the database
+type meterSink struct {
+	output *batchOutput
+}
+
+func (s *meterSink) document(vdc string, data ElasticData) {
+	if _, ok := newMeterPoint(vdc, data); !ok {
+		return
+	}
+	s.output.add(batchEntry{VDC: vdc, Document: data})
+}
+
+func (s *meterSink) span(vdc string, span SpanMessage) {}
+
+func (s *meterSink) close() error {
+	s.output.close()
+	return nil
+}
+
+func newInfluxDBSink(cnf InfluxDBConfig, lifecycle *lifecycle) *meterSink {
+	log.Infof("writing meters to influxdb at %s", redactURL(cnf.URL))
+	return &meterSink{
+		output: newBatchOutput("influxdb", http.MethodPost, cnf.URL, cnf.Auth, cnf.Batch, encodeInfluxDB, lifecycle),
+	}
+}
+
+func newRemoteWriteSink(cnf RemoteWriteConfig, lifecycle *lifecycle) *meterSink {
+	log.Infof("writing meters to prometheus remote write at %s", redactURL(cnf.URL))
+	return &meterSink{
+		output: newBatchOutput("remote write", http.MethodPost, cnf.URL, cnf.Auth, cnf.Batch, encodeRemoteWrite, lifecycle),
+	}
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// encodeInfluxDB writes the meters in the line protocol, the name is the measurement, the VDC, unit
+// and operation are tags and the value is the field value, e.g.
+// responseTime,operationID=checkout,unit=ms,vdc=shop value=12 1551441600000000000
+func encodeInfluxDB(entries []batchEntry) ([]byte, http.Header, error) {
+	var body bytes.Buffer
+	for _, entry := range entries {
+		point, ok := newMeterPoint(entry.VDC, entry.Document)
+		if !ok {
+			continue
+		}
+
+		body.WriteString(influxMeasurementEscaper.Replace(point.name))
+		for _, name := range point.labelNames() {
+			body.WriteString("," + influxTagEscaper.Replace(name) + "=" + influxTagEscaper.Replace(point.labels[name]))
+		}
+		body.WriteString(" value=" + strconv.FormatFloat(point.value, 'f', -1, 64))
+		body.WriteString(" " + strconv.FormatInt(point.time.UnixNano(), 10) + "\n")
+	}
+	return body.Bytes(), http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, nil
+}
+
+// invalid characters of prometheus metric names
+var metricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// metricName turns a meter name into a valid prometheus metric name, e.g. red.requests into red_requests
+func metricName(name string) string {
+	name = metricNameChars.ReplaceAllString(name, "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// remoteSeries is a time series of a remote write request, labels are sorted by name
+type remoteSeries struct {
+	labels  [][2]string
+	samples []meterPoint
+}
+
+// encodeRemoteWrite builds a snappy compressed remote write request, one series per meter name and
+// labels with the samples in order
+func encodeRemoteWrite(entries []batchEntry) ([]byte, http.Header, error) {
+	var series []*remoteSeries
+	byKey := make(map[string]*remoteSeries)
+
+	for _, entry := range entries {
+		point, ok := newMeterPoint(entry.VDC, entry.Document)
+		if !ok {
+			continue
+		}
+
+		labels := map[string]string{"__name__": metricName(point.name)}
+		for name, value := range point.labels {
+			labels[name] = value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var key strings.Builder
+		pairs := make([][2]string, 0, len(names))
+		for _, name := range names {
+			pairs = append(pairs, [2]string{name, labels[name]})
+			key.WriteString(name + "=" + strconv.Quote(labels[name]) + ",")
+		}
+
+		s, ok := byKey[key.String()]
+		if !ok {
+			s = &remoteSeries{labels: pairs}
+			byKey[key.String()] = s
+			series = append(series, s)
+		}
+		s.samples = append(s.samples, point)
+	}
+
+	var request []byte
+	for _, s := range series {
+		sort.SliceStable(s.samples, func(i, j int) bool {
+			return s.samples[i].time.Before(s.samples[j].time)
+		})
+
+		var encoded []byte
+		for _, label := range s.labels {
+			var pair []byte
+			pair = appendProtoBytes(pair, 1, []byte(label[0]))
+			pair = appendProtoBytes(pair, 2, []byte(label[1]))
+			encoded = appendProtoBytes(encoded, 1, pair)
+		}
+		for _, sample := range s.samples {
+			var value []byte
+			value = appendProtoKey(value, 1, 1)
+			var bits [8]byte
+			binary.LittleEndian.PutUint64(bits[:], math.Float64bits(sample.value))
+			value = append(value, bits[:]...)
+			value = appendProtoKey(value, 2, 0)
+			value = appendVarint(value, uint64(sample.time.UnixNano()/int64(time.Millisecond)))
+			encoded = appendProtoBytes(encoded, 2, value)
+		}
+		request = appendProtoBytes(request, 1, encoded)
+	}
+
+	return snappy.Encode(nil, request), http.Header{
+		"Content-Type":                      {"application/x-protobuf"},
+		"Content-Encoding":                  {"snappy"},
+		"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+	}, nil
+}
+
+// appendProtoKey appends the key of a protobuf field with its wire type
+func appendProtoKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarint(b []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	return append(b, buf[:n]...)
+}
+
+// appendProtoBytes appends a length delimited protobuf field, a string or an embedded message
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendProtoKey(b, field, 2)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+var meterTime = time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func meterEntry(name string, value interface{}, operation string, offset time.Duration) batchEntry {
+	return batchEntry{VDC: "shop", Document: ElasticData{Meter: &MeterMessage{
+		Timestamp:   meterTime.Add(offset),
+		Name:        name,
+		Value:       value,
+		Unit:        "ms",
+		OperationID: operation,
+	}}}
+}
+
+func TestInfluxDBEncode(t *testing.T) {
+	body, header, err := encodeInfluxDB([]batchEntry{
+		meterEntry("responseTime", 12.5, "checkout", 0),
+		meterEntry("response time", "7", "get,cart", time.Second),
+		meterEntry("state", "healthy", "", 0),
+		{VDC: "shop", Document: ElasticData{Log: &LogMessage{Value: "payment accepted"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected content type %s", header.Get("Content-Type"))
+	}
+
+	expected := "responseTime,operationID=checkout,unit=ms,vdc=shop value=12.5 1551441600000000000\n" +
+		"response\\ time,operationID=get\\,cart,unit=ms,vdc=shop value=7 1551441601000000000\n"
+	if string(body) != expected {
+		t.Errorf("expected only the numeric meters in line protocol but got\n%s", body)
+	}
+}
+
+// remoteSample is a decoded sample of a remote write request
+type remoteSample struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeProto splits a protobuf message into its length delimited fields and fixed or varint values
+func decodeProto(t *testing.T, data []byte, visit func(field int, value []byte, number uint64)) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			number, n := binary.Uvarint(data)
+			data = data[n:]
+			visit(int(key>>3), nil, number)
+		case 1:
+			visit(int(key>>3), nil, binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			data = data[n:]
+			visit(int(key>>3), data[:length], 0)
+			data = data[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+}
+
+func decodeRemoteWrite(t *testing.T, body []byte) []remoteSample {
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []remoteSample
+	decodeProto(t, request, func(_ int, series []byte, _ uint64) {
+		labels := make(map[string]string)
+		decodeProto(t, series, func(field int, value []byte, _ uint64) {
+			if field == 1 {
+				var name string
+				decodeProto(t, value, func(field int, value []byte, _ uint64) {
+					if field == 1 {
+						name = string(value)
+					} else {
+						labels[name] = string(value)
+					}
+				})
+				return
+			}
+			sample := remoteSample{labels: labels}
+			decodeProto(t, value, func(field int, _ []byte, number uint64) {
+				if field == 1 {
+					sample.value = math.Float64frombits(number)
+				} else {
+					sample.timestamp = int64(number)
+				}
+			})
+			samples = append(samples, sample)
+		})
+	})
+	return samples
+}
+
+func TestRemoteWriteEncode(t *testing.T) {
+	body, header, err := encodeRemoteWrite([]batchEntry{
+		meterEntry("red.requests", 3, "checkout", time.Second),
+		meterEntry("red.requests", 5, "checkout", 0),
+		meterEntry("red.requests", 1, "", 0),
+		meterEntry("state", "healthy", "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Encoding") != "snappy" || header.Get("Content-Type") != "application/x-protobuf" ||
+		header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("unexpected headers %+v", header)
+	}
+
+	samples := decodeRemoteWrite(t, body)
+	if len(samples) != 3 {
+		t.Fatalf("expected the numeric meters but got %+v", samples)
+	}
+	first := samples[0]
+	if first.labels["__name__"] != "red_requests" || first.labels["operationID"] != "checkout" ||
+		first.labels["unit"] != "ms" || first.labels["vdc"] != "shop" {
+		t.Errorf("unexpected labels %+v", first.labels)
+	}
+	if first.value != 5 || first.timestamp != 1551441600000 || samples[1].value != 3 {
+		t.Errorf("expected the samples of a series in order %+v", samples)
+	}
+	if _, ok := samples[2].labels["operationID"]; ok || samples[2].value != 1 {
+		t.Errorf("expected a separate series without operation %+v", samples[2])
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for name, expected := range map[string]string{"responseTime": "responseTime", "red.duration.p95": "red_duration_p95", "5xx-errors": "_5xx_errors"} {
+		if metric := metricName(name); metric != expected {
+			t.Errorf("expected %s for %s but got %s", expected, name, metric)
+		}
+	}
+}
+
+func TestTimeSeriesSinks(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		lock.Lock()
+		bodies[req.URL.Path] = body
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	agent, err := CreateAgent(Configuration{
+		VDCName:       "shop",
+		IgnoreElastic: true,
+		InfluxDB:      InfluxDBConfig{URL: server.URL + "/write?db=ditas"},
+		RemoteWrite:   RemoteWriteConfig{URL: server.URL + "/api/v1/write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := agent.Handler()
+
+	send(handler, "POST", "/v1/meter", `{"name":"responseTime","value":12,"unit":"ms","operationID":"checkout"}`, nil)
+	send(handler, "POST", "/v1/log", "payment accepted", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := agent.Shutdown(ctx); err != nil {
+		t.Fatalf("expected the meter to be written %+v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !strings.HasPrefix(string(bodies["/write"]), "responseTime,operationID=checkout,unit=ms,vdc=shop value=12 ") {
+		t.Errorf("unexpected line protocol %s", bodies["/write"])
+	}
+	samples := decodeRemoteWrite(t, bodies["/api/v1/write"])
+	if len(samples) != 1 || samples[0].labels["__name__"] != "responseTime" || samples[0].value != 12 {
+		t.Errorf("unexpected remote write samples %+v", samples)
+	}
+}
@@ -0,0 +1,410 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// flags that are registered under another name than the entry they set
+var flagAliases = map[string]string{
+	"zipkin":  "ZipkinEndpoint",
+	"vdc":     "Endpoint",
+	"name":    "VDCName",
+	"elastic": "ElasticSearchURL",
+}
+
+// the decoder names the entry of a problem in quotes
+var decodedKey = regexp.MustCompile(`'([^']+)'`)
+
+// ConfigProblem is a single invalid entry of the configuration
+type ConfigProblem struct {
+	Key     string //name of the entry, e.g. Sampling.Probability
+	Source  string //where the value comes from: a flag, the environment, the config file or the default
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Source == "" {
+		return fmt.Sprintf("%s: %s", p.Key, p.Message)
+	}
+	return fmt.Sprintf("%s (%s): %s", p.Key, p.Source, p.Message)
+}
+
+// ConfigErrors lists all problems of a configuration
+type ConfigErrors []ConfigProblem
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("invalid configuration, %d problem(s):", len(e)))
+	for _, problem := range e {
+		lines = append(lines, "  "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type configCheck struct {
+	problems ConfigErrors
+}
+
+func (c *configCheck) fail(key, format string, args ...interface{}) {
+	c.problems = append(c.problems, ConfigProblem{
+		Key:     key,
+		Source:  configSource(key),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// warn logs entries that are valid but probably not what was intended
+func (c *configCheck) warn(key, format string, args ...interface{}) {
+	problem := ConfigProblem{Key: key, Source: configSource(key), Message: fmt.Sprintf(format, args...)}
+	log.Warn(problem.String())
+}
+
+func (c *configCheck) url(key, value string) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		c.fail(key, "%q is not a valid url: %s", value, err)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		c.fail(key, "%q must be an http or https url", value)
+		return
+	}
+	if parsed.Host == "" {
+		c.fail(key, "%q has no host", value)
+		return
+	}
+	if port := parsed.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			c.fail(key, "%q has an invalid port", value)
+		}
+	}
+}
+
+func (c *configCheck) address(key, value string) {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		c.fail(key, "%q is not a valid address, expected host:port: %s", value, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		c.fail(key, "%q has an invalid port", value)
+	}
+}
+
+func (c *configCheck) duration(key string, value time.Duration) {
+	if value < 0 {
+		c.fail(key, "must not be negative, got %s", value)
+	}
+}
+
+func (c *configCheck) share(key string, value float64) {
+	if value < 0 || value > 1 {
+		c.fail(key, "must be between 0 and 1, got %v", value)
+	}
+}
+
+func (c *configCheck) err(key string, err error) {
+	if err != nil {
+		c.fail(key, "%s", err)
+	}
+}
+
+// Validate checks the whole configuration and reports all problems at once, each with the source
+// of the value. Nothing is started or connected.
+func (cnf Configuration) Validate() error {
+	c := &configCheck{}
+
+	if cnf.Port < 1 || cnf.Port > 65535 {
+		c.fail("Port", "must be between 1 and 65535, got %d", cnf.Port)
+	}
+	if !tenantName.MatchString(cnf.VDCName) {
+		c.fail("VDCName", "%q is not a valid VDC name, use letters, digits, '_', '.' and '-'", cnf.VDCName)
+	}
+	if cnf.Endpoint != "" {
+		c.url("Endpoint", cnf.Endpoint)
+	}
+	if cnf.Tracing || cnf.ZipkinEndpoint != "" {
+		c.url("ZipkinEndpoint", cnf.ZipkinEndpoint)
+	}
+	c.duration("WaitTime", cnf.WaitTime)
+
+	if !cnf.IgnoreElastic {
+		c.url("ElasticSearchURL", cnf.ElasticSearchURL)
+	}
+	if cnf.ElasticBasicAuth {
+		if cnf.ElasticUser == "" {
+			c.fail("ElasticUser", "is required if ElasticBasicAuth is set")
+		}
+		if cnf.ElasticPassword == "" {
+			c.fail("ElasticPassword", "is required if ElasticBasicAuth is set")
+		}
+	} else {
+		if cnf.ElasticUser != "" {
+			c.warn("ElasticUser", "is set but ElasticBasicAuth is not enabled, it is ignored")
+		}
+		if cnf.ElasticPassword != "" {
+			c.warn("ElasticPassword", "is set but ElasticBasicAuth is not enabled, it is ignored")
+		}
+	}
+
+	if len(cnf.Redaction.Rules) > 0 || len(cnf.Redaction.Detectors) > 0 {
+		_, err := newRedactor(cnf.Redaction)
+		c.err("Redaction", err)
+	}
+	if cnf.Redaction.Secret == "" {
+		for _, rule := range cnf.Redaction.Rules {
+			if strings.ToLower(rule.Action) == ActionHash {
+				c.warn("Redaction.Secret", "is not set, hashed values of rule %s can be guessed", rule.Name)
+				break
+			}
+		}
+	}
+	_, err := newPipeline(cnf, cnf.Processors)
+	c.err("Processors", err)
+
+	c.duration("Tail.PollInterval", cnf.Tail.PollInterval)
+	if cnf.Tail.Multiline != "" {
+		_, err := regexp.Compile(cnf.Tail.Multiline)
+		c.err("Tail.Multiline", err)
+	}
+	for _, pattern := range cnf.Tail.Paths {
+		_, err := filepath.Match(pattern, "")
+		c.err("Tail.Paths", err)
+	}
+
+	if cnf.Syslog.UDP != "" {
+		c.address("Syslog.UDP", cnf.Syslog.UDP)
+	}
+	if cnf.Syslog.TCP != "" {
+		c.address("Syslog.TCP", cnf.Syslog.TCP)
+	}
+	if cnf.Syslog.TLS != "" {
+		c.address("Syslog.TLS", cnf.Syslog.TLS)
+		if cnf.Syslog.CertFile == "" || cnf.Syslog.KeyFile == "" {
+			c.fail("Syslog.TLS", "requires Syslog.CertFile and Syslog.KeyFile")
+		}
+	} else if cnf.Syslog.CertFile != "" || cnf.Syslog.KeyFile != "" {
+		c.fail("Syslog.CertFile", "is set but no Syslog.TLS listener is configured")
+	}
+
+	c.duration("ProcessMetrics.Interval", cnf.ProcessMetrics.Interval)
+	if cnf.ProcessMetrics.Interval > 0 {
+		_, err := newProcessCollector(cnf.ProcessMetrics, nil)
+		c.err("ProcessMetrics.Match", err)
+	}
+
+	if len(cnf.Kafka.Brokers) > 0 {
+		for _, broker := range cnf.Kafka.Brokers {
+			c.address("Kafka.Brokers", broker)
+		}
+		_, err := newKafkaConfig(cnf.Kafka)
+		c.err("Kafka", err)
+	}
+	c.duration("Kafka.FlushInterval", cnf.Kafka.FlushInterval)
+
+	if cnf.Loki.URL != "" {
+		c.url("Loki.URL", cnf.Loki.URL)
+		c.err("Loki.Labels", checkLokiLabels(cnf.Loki.Labels))
+	}
+	cnf.Loki.Batch.check(c, "Loki.Batch")
+
+	for _, sc := range cnf.HTTPSinks {
+		c.url("HTTPSinks.URL", sc.URL)
+		_, err := parseHTTPSink(sc)
+		c.err("HTTPSinks", err)
+		sc.Batch.check(c, "HTTPSinks.Batch")
+	}
+
+	if cnf.InfluxDB.URL != "" {
+		c.url("InfluxDB.URL", cnf.InfluxDB.URL)
+	}
+	cnf.InfluxDB.Batch.check(c, "InfluxDB.Batch")
+	if cnf.RemoteWrite.URL != "" {
+		c.url("RemoteWrite.URL", cnf.RemoteWrite.URL)
+	}
+	cnf.RemoteWrite.Batch.check(c, "RemoteWrite.Batch")
+
+	if cnf.StreamBuffer < 0 {
+		c.fail("StreamBuffer", "must not be negative, got %d", cnf.StreamBuffer)
+	}
+	for _, origin := range cnf.StreamOrigins {
+		if origin != "*" {
+			c.url("StreamOrigins", origin)
+		}
+	}
+	if cnf.CaptureSize < 0 {
+		c.fail("CaptureSize", "must not be negative, got %d", cnf.CaptureSize)
+	}
+
+	for _, webhook := range cnf.Alerting.Webhooks {
+		c.url("Alerting.Webhooks", webhook)
+	}
+	for _, rule := range cnf.Alerting.Meters {
+		c.duration("Alerting.Meters.Window", rule.Window)
+		c.duration("Alerting.Meters.For", rule.For)
+		for _, webhook := range rule.Webhooks {
+			c.url("Alerting.Meters.Webhooks", webhook)
+		}
+	}
+	for _, rule := range cnf.Alerting.Logs {
+		c.duration("Alerting.Logs.Window", rule.Window)
+		if rule.Threshold < 0 {
+			c.fail("Alerting.Logs.Threshold", "must not be negative, got %d", rule.Threshold)
+		}
+		for _, webhook := range rule.Webhooks {
+			c.url("Alerting.Logs.Webhooks", webhook)
+		}
+	}
+	_, err = newAlertManager(cnf.Alerting, nil)
+	c.err("Alerting", err)
+
+	c.duration("SpanMetrics.Interval", cnf.SpanMetrics.Interval)
+	for _, bound := range cnf.SpanMetrics.Buckets {
+		if bound <= 0 {
+			c.fail("SpanMetrics.Buckets", "bounds must be positive, got %v", bound)
+		}
+	}
+
+	if cnf.Sampling.Probability != 0 {
+		c.share("Sampling.Probability", cnf.Sampling.Probability)
+	}
+	for _, limit := range cnf.Sampling.RateLimits {
+		if limit.PerSecond <= 0 {
+			c.fail("Sampling.RateLimits", "rate limit of %s must be positive, got %v", limit.Operation, limit.PerSecond)
+		}
+	}
+	c.duration("Sampling.DecisionWait", cnf.Sampling.DecisionWait)
+	c.duration("Sampling.Latency", cnf.Sampling.Latency)
+	c.share("Sampling.TailProbability", cnf.Sampling.TailProbability)
+	if cnf.Sampling.MaxTraces < 0 {
+		c.fail("Sampling.MaxTraces", "must not be negative, got %d", cnf.Sampling.MaxTraces)
+	}
+
+	if cnf.MultiTenant.Enabled {
+		_, err := newTenantRegistry(cnf.MultiTenant, cnf.VDCName)
+		c.err("MultiTenant.Tenants", err)
+	}
+	if cnf.MultiTenant.RequestsPerSecond < 0 {
+		c.fail("MultiTenant.RequestsPerSecond", "must not be negative, got %v", cnf.MultiTenant.RequestsPerSecond)
+	}
+	if cnf.MultiTenant.MaxUnknown < 0 {
+		c.fail("MultiTenant.MaxUnknown", "must not be negative, got %d", cnf.MultiTenant.MaxUnknown)
+	}
+	if cnf.MultiTenant.MaxDocuments < 0 {
+		c.fail("MultiTenant.MaxDocuments", "must not be negative, got %d", cnf.MultiTenant.MaxDocuments)
+	}
+
+	if len(c.problems) > 0 {
+		return c.problems
+	}
+	return nil
+}
+
+// configSource describes where the value of an entry comes from, nested entries are attributed to
+// the source of their section
+func configSource(key string) string {
+	section := strings.Split(key, ".")[0]
+
+	var flag string
+	pflag.Visit(func(f *pflag.Flag) {
+		if strings.EqualFold(f.Name, section) || strings.EqualFold(flagAliases[f.Name], section) {
+			flag = f.Name
+		}
+	})
+	if flag != "" {
+		return "flag --" + flag
+	}
+
+	//nested entries can also be set on their own
+	for _, name := range []string{envName(key), envName(section)} {
+		if _, ok := os.LookupEnv(name); ok {
+			return "environment " + name
+		}
+	}
+
+	if viper.InConfig(strings.ToLower(section)) {
+		if file := viper.ConfigFileUsed(); file != "" {
+			return "config file " + file
+		}
+		return "config file"
+	}
+
+	if viper.IsSet(key) {
+		return "default"
+	}
+	return ""
+}
+
+// decodeConfiguration reads the configuration from viper and validates it. Values that cannot be
+// decoded are reported together with all other problems.
+func decodeConfiguration() (Configuration, error) {
+	cnf := Configuration{}
+
+	var problems ConfigErrors
+	if err := viper.Unmarshal(&cnf); err != nil {
+		problems = append(problems, decodeProblems(err)...)
+	}
+	if err := cnf.Validate(); err != nil {
+		problems = append(problems, err.(ConfigErrors)...)
+	}
+
+	if len(problems) > 0 {
+		return cnf, problems
+	}
+	return cnf, nil
+}
+
+func decodeProblems(err error) []ConfigProblem {
+	messages := []string{err.Error()}
+	if decodeErr, ok := err.(*mapstructure.Error); ok {
+		messages = decodeErr.Errors
+	}
+
+	problems := make([]ConfigProblem, 0, len(messages))
+	for _, message := range messages {
+		key := "configuration"
+		if match := decodedKey.FindStringSubmatch(message); match != nil {
+			key = match[1]
+		}
+		problems = append(problems, ConfigProblem{Key: key, Source: configSource(key), Message: message})
+	}
+	return problems
+}
+
+// LoadConfiguration reads the config file, if any, and returns the validated configuration
+func LoadConfiguration() (Configuration, error) {
+	if err := readConfigFile(); err != nil {
+		return Configuration{}, err
+	}
+	return decodeConfiguration()
+}
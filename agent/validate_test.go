@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestValidate(t *testing.T) {
+	cnf := Configuration{
+		Port:             8484,
+		VDCName:          "test",
+		Endpoint:         "http://0.0.0.0:0",
+		ZipkinEndpoint:   "http://localhost:9411/api/v1/spans",
+		ElasticSearchURL: "http://127.0.0.1:9200",
+	}
+	if err := cnf.Validate(); err != nil {
+		t.Fatalf("expected the configuration to be valid %+v", err)
+	}
+
+	//credentials without basic auth are ignored with a warning
+	cnf.ElasticPassword = "secret"
+	if err := cnf.Validate(); err != nil {
+		t.Fatalf("expected unused credentials to be valid %+v", err)
+	}
+	cnf.ElasticPassword = ""
+
+	cnf.Port = 70000
+	cnf.ElasticSearchURL = "127.0.0.1:9200"
+	cnf.ElasticBasicAuth = true
+	cnf.ElasticUser = "elastic"
+	cnf.Sampling.Probability = 2
+	cnf.Tail.PollInterval = -time.Second
+	cnf.Syslog.TLS = ":6514"
+
+	err := cnf.Validate()
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected config errors but got %+v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, problem := range problems {
+		keys[problem.Key] = true
+	}
+	for _, key := range []string{"Port", "ElasticSearchURL", "ElasticPassword", "Sampling.Probability", "Tail.PollInterval", "Syslog.TLS"} {
+		if !keys[key] {
+			t.Errorf("expected a problem with %s in %s", key, err)
+		}
+	}
+	if len(problems) != 6 {
+		t.Errorf("expected 6 problems but got %s", err)
+	}
+}
+
+func TestDecodeConfiguration(t *testing.T) {
+	defer viper.Reset()
+
+	viper.SetConfigType("json")
+	err := viper.ReadConfig(strings.NewReader(`{
+		"Port": "http",
+		"VDCName": "test",
+		"ElasticSearchURL": "http://127.0.0.1:9200",
+		"ZipkinEndpoint": "ftp://zipkin",
+		"Sampling": {"DecisionWait": "soon"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decodeConfiguration()
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected config errors but got %+v", err)
+	}
+
+	sources := make(map[string]string)
+	for _, problem := range problems {
+		sources[problem.Key] = problem.Source
+	}
+	for _, key := range []string{"Port", "Sampling.DecisionWait", "ZipkinEndpoint"} {
+		if source, ok := sources[key]; !ok {
+			t.Errorf("expected a problem with %s in %s", key, err)
+		} else if !strings.HasPrefix(source, "config file") {
+			t.Errorf("expected %s to come from the config file but got %s", key, source)
+		}
+	}
+}
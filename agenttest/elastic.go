@@ -0,0 +1,360 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+// Package agenttest provides in-memory elastic search and zipkin servers to test the agent and VDCs
+// using it without the real services.
+package agenttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Document is a document indexed in the fake elastic search
+type Document struct {
+	Index  string
+	Type   string
+	ID     string
+	Source map[string]interface{}
+}
+
+// Elastic is a fake elastic search that keeps all indexed documents in memory. It understands the
+// calls the agent makes: ping, index and template management, indexing single documents and searching. Searches
+// apply the query (see matchQuery), size and search_after, documents are sorted in the order they were
+// indexed. Aggregations are not computed, searches return none.
+type Elastic struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	indices   map[string]bool
+	mappings  map[string]map[string]interface{} //mapping of the documents per index, if one was set
+	templates map[string]indexTemplate          //templates applied to indices created by indexing
+	documents []Document
+	failure   int //status of all requests but the ping if set
+}
+
+func NewElastic() *Elastic {
+	e := &Elastic{
+		indices:   make(map[string]bool),
+		mappings:  make(map[string]map[string]interface{}),
+		templates: make(map[string]indexTemplate),
+	}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	return e
+}
+
+// Documents returns the documents of all indices starting with the prefix, e.g. the name of a VDC
+func (e *Elastic) Documents(prefix string) []Document {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var documents []Document
+	for _, document := range e.documents {
+		if strings.HasPrefix(document.Index, prefix) {
+			documents = append(documents, document)
+		}
+	}
+	return documents
+}
+
+// Mapping returns the mapping of the documents of an index as it was set when the index was created
+// or updated, nil if there is none
+func (e *Elastic) Mapping(index string) map[string]interface{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.mappings[index]
+}
+
+// Fail lets all following requests fail with the status until Recover is called, the ping still
+// succeeds so the agent can start
+func (e *Elastic) Fail(status int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.failure = status
+}
+
+func (e *Elastic) Recover() {
+	e.Fail(0)
+}
+
+// Reset removes all documents and indices
+func (e *Elastic) Reset() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.indices = make(map[string]bool)
+	e.mappings = make(map[string]map[string]interface{})
+	e.templates = make(map[string]indexTemplate)
+	e.documents = nil
+}
+
+func (e *Elastic) serve(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if path[0] == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":         "agenttest",
+			"cluster_name": "agenttest",
+			"version":      map[string]interface{}{"number": "6.8.0"},
+			"tagline":      "You Know, for Search",
+		})
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.failure != 0 {
+		writeError(w, e.failure, "failure injected by agenttest")
+		return
+	}
+
+	index := path[0]
+	switch {
+	case path[len(path)-1] == "_search":
+		e.search(w, req, index)
+	case len(path) == 1 && req.Method == http.MethodHead:
+		if e.indices[index] {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(path) == 2 && index == "_template" && req.Method == http.MethodPut:
+		e.putTemplate(w, req, path[1])
+	case len(path) == 1 && req.Method == http.MethodPut:
+		e.createIndex(w, req, index)
+	case len(path) == 3 && path[1] == "_mapping" && req.Method == http.MethodPut:
+		e.putMapping(w, req, index)
+	case (len(path) == 2 || len(path) == 3) && (req.Method == http.MethodPost || req.Method == http.MethodPut):
+		e.index(w, req, path)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not supported by agenttest", req.Method, req.URL.Path))
+	}
+}
+
+// createIndex only checks that the settings and mappings are valid json, the mapping of the first type is kept
+func (e *Elastic) createIndex(w http.ResponseWriter, req *http.Request, index string) {
+	var body struct {
+		Mappings map[string]map[string]interface{} `json:"mappings"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	e.indices[index] = true
+	for _, mapping := range body.Mappings {
+		e.mappings[index] = mapping
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true, "index": index})
+}
+
+func (e *Elastic) putMapping(w http.ResponseWriter, req *http.Request, index string) {
+	var mapping map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&mapping); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !e.indices[index] {
+		writeError(w, http.StatusNotFound, "no such index "+index)
+		return
+	}
+
+	e.mappings[index] = mapping
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+// indexTemplate is the mapping of the first type of a template with the patterns it applies to
+type indexTemplate struct {
+	patterns []string
+	mapping  map[string]interface{}
+}
+
+func (e *Elastic) putTemplate(w http.ResponseWriter, req *http.Request, name string) {
+	var body struct {
+		IndexPatterns []string                          `json:"index_patterns"`
+		Mappings      map[string]map[string]interface{} `json:"mappings"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body.IndexPatterns) == 0 {
+		writeError(w, http.StatusBadRequest, "index_patterns is missing")
+		return
+	}
+
+	template := indexTemplate{patterns: body.IndexPatterns}
+	for _, mapping := range body.Mappings {
+		template.mapping = mapping
+	}
+	e.templates[name] = template
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func (e *Elastic) index(w http.ResponseWriter, req *http.Request, path []string) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	document := Document{Index: path[0], Type: path[1], ID: fmt.Sprintf("%d", len(e.documents)+1)}
+	if len(path) == 3 {
+		document.ID = path[2]
+	}
+	if err := json.Unmarshal(body, &document.Source); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !e.indices[document.Index] {
+		e.indices[document.Index] = true
+		for _, template := range e.templates {
+			if matchIndex(strings.Join(template.patterns, ","), document.Index) && template.mapping != nil {
+				e.mappings[document.Index] = template.mapping
+			}
+		}
+	}
+	e.documents = append(e.documents, document)
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"_index":   document.Index,
+		"_type":    document.Type,
+		"_id":      document.ID,
+		"_version": 1,
+		"result":   "created",
+	})
+}
+
+func (e *Elastic) search(w http.ResponseWriter, req *http.Request, index string) {
+	var body map[string]interface{}
+	if data, err := ioutil.ReadAll(req.Body); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var matching []Document
+	for _, document := range e.documents {
+		if !matchIndex(index, document.Index) {
+			continue
+		}
+		ok, err := matchQuery(body["query"], document.Source)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if ok {
+			matching = append(matching, document)
+		}
+	}
+	if descending(body["sort"]) {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+
+	//search after continues behind the document with the given id, the last sort value
+	if after, ok := body["search_after"].([]interface{}); ok && len(after) > 0 {
+		for i, document := range matching {
+			if fmt.Sprint(after[len(after)-1]) == sortID(document) {
+				matching = matching[i+1:]
+				break
+			}
+		}
+	}
+
+	total := len(matching)
+	if size, ok := body["size"].(float64); ok && int(size) < len(matching) {
+		matching = matching[:int(size)]
+	}
+
+	hits := []map[string]interface{}{}
+	for _, document := range matching {
+		hits = append(hits, map[string]interface{}{
+			"_index":  document.Index,
+			"_type":   document.Type,
+			"_id":     document.ID,
+			"_source": document.Source,
+			"sort":    []interface{}{document.Source["@timestamp"], sortID(document)},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"took":         1,
+		"hits":         map[string]interface{}{"total": total, "hits": hits},
+		"aggregations": map[string]interface{}{},
+	})
+}
+
+// sortID is the tiebreaker of the agent, the id field of the document, or its _id if it has none
+func sortID(document Document) string {
+	if id, ok := document.Source["id"].(string); ok {
+		return id
+	}
+	return document.ID
+}
+
+// descending reports if the first sort of a search is descending
+func descending(sort interface{}) bool {
+	sorts, ok := sort.([]interface{})
+	if !ok || len(sorts) == 0 {
+		return false
+	}
+	first, ok := sorts[0].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, order := range first {
+		if options, ok := order.(map[string]interface{}); ok {
+			return options["order"] == "desc"
+		}
+	}
+	return false
+}
+
+// matchIndex supports comma separated lists and a trailing wildcard
+func matchIndex(pattern, index string) bool {
+	for _, candidate := range strings.Split(pattern, ",") {
+		if candidate == index || candidate == "_all" ||
+			(strings.HasSuffix(candidate, "*") && strings.HasPrefix(index, strings.TrimSuffix(candidate, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":  map[string]interface{}{"type": "agenttest_exception", "reason": reason},
+		"status": status,
+	})
+}
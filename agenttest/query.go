@@ -0,0 +1,288 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agenttest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matchQuery evaluates the query of a search against the source of a document. It supports the
+// clauses the agent uses: bool, match_all, exists, term, terms, match, match_phrase and range. Text is
+// not analyzed, match and match_phrase compare case insensitive words and substrings instead.
+func matchQuery(query interface{}, source map[string]interface{}) (bool, error) {
+	if query == nil {
+		return true, nil
+	}
+	clause, ok := query.(map[string]interface{})
+	if !ok || len(clause) != 1 {
+		return false, fmt.Errorf("invalid query %v", query)
+	}
+
+	for kind, body := range clause {
+		switch kind {
+		case "match_all":
+			return true, nil
+		case "bool":
+			return matchBool(body, source)
+		case "exists":
+			options, _ := body.(map[string]interface{})
+			field, _ := options["field"].(string)
+			value, ok := lookup(source, field)
+			return ok && value != nil, nil
+		}
+
+		field, options, err := fieldClause(kind, body)
+		if err != nil {
+			return false, err
+		}
+		value, ok := lookup(source, field)
+		if !ok || value == nil {
+			return false, nil
+		}
+
+		switch kind {
+		case "term":
+			if object, ok := options.(map[string]interface{}); ok {
+				options = object["value"]
+			}
+			return anyValue(value, func(v interface{}) bool { return equal(v, options) }), nil
+		case "terms":
+			terms, ok := options.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("terms of %s must be a list", field)
+			}
+			return anyValue(value, func(v interface{}) bool {
+				for _, term := range terms {
+					if equal(v, term) {
+						return true
+					}
+				}
+				return false
+			}), nil
+		case "match", "match_phrase":
+			text, operator := options, "or"
+			if object, ok := options.(map[string]interface{}); ok {
+				text = object["query"]
+				if op, ok := object["operator"].(string); ok {
+					operator = strings.ToLower(op)
+				}
+			}
+			return anyValue(value, func(v interface{}) bool { return matchText(kind, fmt.Sprint(v), fmt.Sprint(text), operator) }), nil
+		case "range":
+			bounds, ok := options.(map[string]interface{})
+			if !ok {
+				return false, fmt.Errorf("range of %s must be an object", field)
+			}
+			return anyValue(value, func(v interface{}) bool { return inRange(v, bounds) }), nil
+		}
+		return false, fmt.Errorf("%s queries are not supported by agenttest", kind)
+	}
+	return false, nil
+}
+
+func matchBool(body interface{}, source map[string]interface{}) (bool, error) {
+	options, ok := body.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("invalid bool query %v", body)
+	}
+
+	for _, occur := range []string{"must", "filter", "must_not", "should"} {
+		clauses := options[occur]
+		if clauses == nil {
+			continue
+		}
+		list, ok := clauses.([]interface{})
+		if !ok {
+			list = []interface{}{clauses}
+		}
+
+		matched := 0
+		for _, clause := range list {
+			ok, err := matchQuery(clause, source)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				matched++
+			}
+		}
+
+		switch {
+		case (occur == "must" || occur == "filter") && matched < len(list):
+			return false, nil
+		case occur == "must_not" && matched > 0:
+			return false, nil
+		case occur == "should" && matched == 0 && len(list) > 0 && shouldRequired(options):
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// shouldRequired reports if one of the should clauses has to match, they are optional next to must or filter
+func shouldRequired(options map[string]interface{}) bool {
+	return (options["must"] == nil && options["filter"] == nil) || options["minimum_should_match"] != nil
+}
+
+// fieldClause returns the field and options of clauses like {"term": {"field": options}}
+func fieldClause(kind string, body interface{}) (string, interface{}, error) {
+	object, ok := body.(map[string]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("invalid %s query %v", kind, body)
+	}
+	for field, options := range object {
+		if field != "boost" && field != "_name" {
+			return field, options, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%s query without a field", kind)
+}
+
+// lookup resolves dotted paths, e.g. meter.name
+func lookup(source map[string]interface{}, field string) (interface{}, bool) {
+	var current interface{} = source
+	for _, part := range strings.Split(field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// anyValue applies the check to a value or to each element of a list, like elastic search does for arrays
+func anyValue(value interface{}, check func(interface{}) bool) bool {
+	if list, ok := value.([]interface{}); ok {
+		for _, element := range list {
+			if check(element) {
+				return true
+			}
+		}
+		return false
+	}
+	return check(value)
+}
+
+func equal(value, term interface{}) bool {
+	if a, ok := number(value); ok {
+		if b, ok := number(term); ok {
+			return a == b
+		}
+	}
+	return fmt.Sprint(value) == fmt.Sprint(term)
+}
+
+func matchText(kind, value, text, operator string) bool {
+	value, text = strings.ToLower(value), strings.ToLower(text)
+	if kind == "match_phrase" {
+		return strings.Contains(value, text)
+	}
+
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(value) {
+		words[word] = true
+	}
+	terms := strings.Fields(text)
+	for _, term := range terms {
+		if words[term] && operator != "and" {
+			return true
+		}
+		if !words[term] && operator == "and" {
+			return false
+		}
+	}
+	return operator == "and" && len(terms) > 0
+}
+
+// inRange supports gt, gte, lt and lte as well as from and to with include_lower and include_upper
+func inRange(value interface{}, bounds map[string]interface{}) bool {
+	lower, upper := bounds["gte"], bounds["lte"]
+	includeLower, includeUpper := true, true
+	if bound, ok := bounds["gt"]; ok {
+		lower, includeLower = bound, false
+	}
+	if bound, ok := bounds["lt"]; ok {
+		upper, includeUpper = bound, false
+	}
+	if bound, ok := bounds["from"]; ok && bound != nil {
+		lower, includeLower = bound, bounds["include_lower"] != false
+	}
+	if bound, ok := bounds["to"]; ok && bound != nil {
+		upper, includeUpper = bound, bounds["include_upper"] != false
+	}
+
+	if lower != nil {
+		if c, ok := compare(value, lower); !ok || c < 0 || (c == 0 && !includeLower) {
+			return false
+		}
+	}
+	if upper != nil {
+		if c, ok := compare(value, upper); !ok || c > 0 || (c == 0 && !includeUpper) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare orders numbers, RFC 3339 timestamps or other strings, ok is false if they are not comparable
+func compare(value, bound interface{}) (int, bool) {
+	if a, ok := number(value); ok {
+		if b, ok := number(bound); ok {
+			return order(a < b, a > b), true
+		}
+		return 0, false
+	}
+
+	a, b := fmt.Sprint(value), fmt.Sprint(bound)
+	if at, err := time.Parse(time.RFC3339Nano, a); err == nil {
+		bt, err := time.Parse(time.RFC3339Nano, b)
+		if err != nil {
+			return 0, false
+		}
+		return order(at.Before(bt), at.After(bt)), true
+	}
+	return strings.Compare(a, b), true
+}
+
+func order(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
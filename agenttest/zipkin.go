@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package agenttest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/openzipkin-contrib/zipkin-go-opentracing/thrift/gen-go/zipkincore"
+)
+
+// SpansPath is the path the zipkin http collector sends spans to
+const SpansPath = "/api/v1/spans"
+
+// Span is a span received by the fake zipkin, ids are hex encoded like in the trace messages of the agent
+type Span struct {
+	TraceID     string
+	ID          string
+	ParentID    string
+	Name        string
+	ServiceName string
+	Tags        map[string]string
+	Annotations []string
+	Duration    time.Duration
+}
+
+// Zipkin is a fake zipkin that decodes the thrift encoded spans of the http collector and keeps them
+// in memory
+type Zipkin struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	spans   []Span
+	failure int //status of all requests if set
+}
+
+func NewZipkin() *Zipkin {
+	z := &Zipkin{}
+	z.Server = httptest.NewServer(http.HandlerFunc(z.serve))
+	return z
+}
+
+// Endpoint returns the url to configure as ZipkinEndpoint
+func (z *Zipkin) Endpoint() string {
+	return z.URL + SpansPath
+}
+
+// Spans returns all received spans in the order they arrived
+func (z *Zipkin) Spans() []Span {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return append([]Span{}, z.spans...)
+}
+
+// WaitForSpans waits until at least n spans arrived, the collector sends them in batches so they
+// show up with a delay. It returns the spans received until then.
+func (z *Zipkin) WaitForSpans(n int, timeout time.Duration) []Span {
+	deadline := time.Now().Add(timeout)
+	for {
+		spans := z.Spans()
+		if len(spans) >= n || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Fail lets all following requests fail with the status until Recover is called, the spans of failed
+// requests are dropped
+func (z *Zipkin) Fail(status int) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.failure = status
+}
+
+func (z *Zipkin) Recover() {
+	z.Fail(0)
+}
+
+// Reset removes all spans
+func (z *Zipkin) Reset() {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.spans = nil
+}
+
+func (z *Zipkin) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != SpansPath || req.Method != http.MethodPost {
+		http.NotFound(w, req)
+		return
+	}
+
+	z.lock.Lock()
+	failure := z.failure
+	z.lock.Unlock()
+	if failure != 0 {
+		w.WriteHeader(failure)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spans, err := decodeSpans(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	z.lock.Lock()
+	z.spans = append(z.spans, spans...)
+	z.lock.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeSpans reads a thrift binary list of spans
+func decodeSpans(body []byte) ([]Span, error) {
+	buffer := thrift.NewTMemoryBuffer()
+	buffer.Write(body)
+	protocol := thrift.NewTBinaryProtocolTransport(buffer)
+
+	_, size, err := protocol.ReadListBegin()
+	if err != nil {
+		return nil, fmt.Errorf("could not read span list %+v", err)
+	}
+
+	spans := make([]Span, 0, size)
+	for i := 0; i < size; i++ {
+		span := zipkincore.NewSpan()
+		if err := span.Read(protocol); err != nil {
+			return nil, fmt.Errorf("could not read span %d %+v", i, err)
+		}
+		spans = append(spans, convertSpan(span))
+	}
+	return spans, protocol.ReadListEnd()
+}
+
+func convertSpan(span *zipkincore.Span) Span {
+	converted := Span{
+		TraceID: fmt.Sprintf("%016x", uint64(span.TraceID)),
+		ID:      fmt.Sprintf("%016x", uint64(span.ID)),
+		Name:    span.Name,
+		Tags:    make(map[string]string),
+	}
+	if span.ParentID != nil {
+		converted.ParentID = fmt.Sprintf("%016x", uint64(*span.ParentID))
+	}
+	if span.Duration != nil {
+		converted.Duration = time.Duration(*span.Duration) * time.Microsecond
+	}
+
+	for _, annotation := range span.Annotations {
+		converted.Annotations = append(converted.Annotations, annotation.Value)
+		if annotation.Host != nil && converted.ServiceName == "" {
+			converted.ServiceName = annotation.Host.ServiceName
+		}
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		converted.Tags[annotation.Key] = string(annotation.Value)
+		if annotation.Host != nil && converted.ServiceName == "" {
+			converted.ServiceName = annotation.Host.ServiceName
+		}
+	}
+	return converted
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+// Package client lets a VDC use the logging agent without writing the http calls itself.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DITAS-Project/VDC-Logging-Agent/message"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultQueueSize     = 10000
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+)
+
+var (
+	// ErrQueueFull is returned if a request is queued faster than the agent accepts them
+	ErrQueueFull = errors.New("queue of the agent client is full")
+	// ErrClosed is returned if a request is queued after Shutdown
+	ErrClosed = errors.New("agent client is shut down")
+)
+
+var log = logrus.NewEntry(logrus.New())
+
+// SetLog sets the logger used to report failed requests if Config.OnError is not set
+func SetLog(entry *logrus.Entry) {
+	log = entry
+}
+
+type Config struct {
+	Endpoint   string       //address of the agent, e.g. http://localhost:8484
+	Header     http.Header  //sent with every request, e.g. X-VDC-Name and X-API-Key in multi VDC mode
+	HTTPClient *http.Client //default a client with a 10s timeout
+
+	BatchSize     int           //number of queued requests that triggers sending them (default 100)
+	FlushInterval time.Duration //how often queued requests are sent (default 1s)
+	QueueSize     int           //maximum number of queued requests (default 10000)
+
+	MaxRetries   int           //retries of a failed request (default 3), a negative value disables retries
+	RetryBackoff time.Duration //wait before the first retry, doubled for each further one (default 100ms)
+
+	OnError func(error) //called for queued requests that finally failed, errors are logged if not set
+}
+
+// StatusError is returned if the agent rejects a request
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("agent responded with %d %s", e.Code, e.Body)
+}
+
+type request struct {
+	method      string
+	path        string
+	contentType string
+	body        []byte
+}
+
+// Client sends traces, meters and logs to the agent. Requests can either be sent directly or be
+// queued, queued requests are sent in order by a background worker.
+type Client struct {
+	cnf      Config
+	endpoint string
+
+	lock   sync.RWMutex
+	closed bool
+	queue  chan request
+	flush  chan chan struct{}
+
+	ctx    context.Context //cancelled if Shutdown gives up waiting
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func New(cnf Config) (*Client, error) {
+	if cnf.Endpoint == "" {
+		return nil, fmt.Errorf("the endpoint of the agent is required")
+	}
+	if cnf.HTTPClient == nil {
+		cnf.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cnf.BatchSize <= 0 {
+		cnf.BatchSize = defaultBatchSize
+	}
+	if cnf.FlushInterval <= 0 {
+		cnf.FlushInterval = defaultFlushInterval
+	}
+	if cnf.QueueSize <= 0 {
+		cnf.QueueSize = defaultQueueSize
+	}
+	if cnf.MaxRetries == 0 {
+		cnf.MaxRetries = defaultMaxRetries
+	}
+	if cnf.RetryBackoff <= 0 {
+		cnf.RetryBackoff = defaultRetryBackoff
+	}
+	if cnf.OnError == nil {
+		cnf.OnError = func(err error) {
+			log.Errorf("could not send to the logging agent %+v", err)
+		}
+	}
+
+	c := &Client{
+		cnf:      cnf,
+		endpoint: strings.TrimRight(cnf.Endpoint, "/"),
+		queue:    make(chan request, cnf.QueueSize),
+		flush:    make(chan chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.run()
+	return c, nil
+}
+
+// Trace starts a span or adds the message and tags to an open one
+func (c *Client) Trace(ctx context.Context, trace message.TraceMessage) error {
+	return c.sendJSON(ctx, http.MethodPut, "/v1/trace", trace)
+}
+
+// CloseTrace finishes a span
+func (c *Client) CloseTrace(ctx context.Context, trace message.TraceMessage) error {
+	return c.sendJSON(ctx, http.MethodPost, "/v1/close", trace)
+}
+
+// Meter stores a meter
+func (c *Client) Meter(ctx context.Context, meter message.MeterMessage) error {
+	return c.sendJSON(ctx, http.MethodPost, "/v1/meter", meter)
+}
+
+// Log stores a log message
+func (c *Client) Log(ctx context.Context, value string) error {
+	return c.send(ctx, request{method: http.MethodPost, path: "/v1/log", contentType: "text/plain", body: []byte(value)})
+}
+
+// QueueMeter stores a meter in the background
+func (c *Client) QueueMeter(meter message.MeterMessage) error {
+	return c.enqueueJSON(http.MethodPost, "/v1/meter", meter)
+}
+
+// QueueLog stores a log message in the background
+func (c *Client) QueueLog(value string) error {
+	return c.enqueue(request{method: http.MethodPost, path: "/v1/log", contentType: "text/plain", body: []byte(value)})
+}
+
+func (c *Client) sendJSON(ctx context.Context, method, path string, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, request{method: method, path: path, contentType: "application/json", body: body})
+}
+
+func (c *Client) enqueueJSON(method, path string, msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(request{method: method, path: path, contentType: "application/json", body: body})
+}
+
+func (c *Client) enqueue(r request) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	select {
+	case c.queue <- r:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// send retries requests that failed because of the network or a temporary error of the agent
+func (c *Client) send(ctx context.Context, r request) error {
+	backoff := c.cnf.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.do(ctx, r)
+		if err == nil || !retryable(err) || attempt >= c.cnf.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) do(ctx context.Context, r request) error {
+	req, err := http.NewRequest(r.method, c.endpoint+r.path, bytes.NewReader(r.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range c.cnf.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", r.contentType)
+
+	resp, err := c.cnf.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+func retryable(err error) bool {
+	if status, ok := err.(*StatusError); ok {
+		return status.Code >= 500 || status.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// run sends the queued requests once enough are queued, the interval passed or a flush is requested
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cnf.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]request, 0, c.cnf.BatchSize)
+	for {
+		select {
+		case r := <-c.queue:
+			batch = append(batch, r)
+			if len(batch) >= c.cnf.BatchSize {
+				batch = c.sendBatch(batch)
+			}
+		case <-ticker.C:
+			batch = c.sendBatch(batch)
+		case flushed := <-c.flush:
+			batch = c.sendBatch(c.drain(batch))
+			close(flushed)
+		case <-c.stop:
+			c.sendBatch(c.drain(batch))
+			return
+		}
+	}
+}
+
+func (c *Client) drain(batch []request) []request {
+	for {
+		select {
+		case r := <-c.queue:
+			batch = append(batch, r)
+		default:
+			return batch
+		}
+	}
+}
+
+func (c *Client) sendBatch(batch []request) []request {
+	for _, r := range batch {
+		if err := c.send(c.ctx, r); err != nil {
+			c.cnf.OnError(err)
+		}
+	}
+	return batch[:0]
+}
+
+// Flush sends all queued requests and waits until they are done
+func (c *Client) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case c.flush <- flushed:
+	case <-c.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown sends all queued requests and stops the client. If the context ends first, the
+// remaining requests are dropped.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	close(c.stop)
+	select {
+	case <-c.done:
+		c.cancel()
+		return nil
+	case <-ctx.Done():
+		c.cancel()
+		<-c.done
+		return ctx.Err()
+	}
+}
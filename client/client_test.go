@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DITAS-Project/VDC-Logging-Agent/message"
+	"github.com/sirupsen/logrus"
+)
+
+type received struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+// fakeAgent records all requests and answers with the given status codes before succeeding
+type fakeAgent struct {
+	lock     sync.Mutex
+	requests []received
+	failures []int
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, received{method: req.Method, path: req.URL.Path, header: req.Header, body: string(body)})
+	if len(f.failures) > 0 {
+		w.WriteHeader(f.failures[0])
+		f.failures = f.failures[1:]
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeAgent) received() []received {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]received{}, f.requests...)
+}
+
+func newTestClient(t *testing.T, fake *fakeAgent, cnf Config) (*Client, func()) {
+	server := httptest.NewServer(fake)
+	cnf.Endpoint = server.URL
+	cnf.RetryBackoff = time.Millisecond
+	if cnf.OnError == nil {
+		cnf.OnError = func(err error) {
+			t.Errorf("unexpected error %+v", err)
+		}
+	}
+
+	c, err := New(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Shutdown(context.Background())
+		server.Close()
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	fake := &fakeAgent{failures: []int{http.StatusServiceUnavailable, http.StatusBadGateway}}
+	c, done := newTestClient(t, fake, Config{Header: http.Header{"X-Vdc-Name": {"test"}}})
+	defer done()
+
+	err := c.Meter(context.Background(), message.MeterMessage{Name: "requests", Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := fake.received()
+	if len(requests) != 3 {
+		t.Fatalf("expected two retries but got %d requests", len(requests))
+	}
+	if requests[2].path != "/v1/meter" || requests[2].header.Get("X-VDC-Name") != "test" {
+		t.Errorf("unexpected request %+v", requests[2])
+	}
+
+	//rejected requests are not retried
+	fake.failures = []int{http.StatusBadRequest}
+	err = c.Log(context.Background(), "broken")
+	if status, ok := err.(*StatusError); !ok || status.Code != http.StatusBadRequest {
+		t.Errorf("expected the rejection to be returned but got %+v", err)
+	}
+	if len(fake.received()) != 4 {
+		t.Errorf("expected no retry of a rejected request")
+	}
+}
+
+func TestClientQueue(t *testing.T) {
+	fake := &fakeAgent{}
+	c, done := newTestClient(t, fake, Config{FlushInterval: time.Hour})
+	defer done()
+
+	for _, value := range []string{"first", "second", "third"} {
+		if err := c.QueueLog(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.received()) != 0 {
+		t.Errorf("expected queued logs to wait for the flush")
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := fake.received()
+	if len(requests) != 3 || requests[0].body != "first" || requests[2].body != "third" {
+		t.Errorf("expected the logs in order but got %+v", requests)
+	}
+
+	c.Shutdown(context.Background())
+	if err := c.QueueLog("late"); err != ErrClosed {
+		t.Errorf("expected the client to be closed but got %+v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	fake := &fakeAgent{}
+	c, done := newTestClient(t, fake, Config{})
+	defer done()
+
+	var outgoing http.Header
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outgoing = http.Header{}
+		Inject(req.Context(), outgoing)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/data?token=secret", nil)
+	req.Header.Set(TraceIDHeader, "5e27c67030932221")
+	req.Header.Set(SpanIDHeader, "38357d8f309b379d")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := fake.received()
+	if len(requests) != 2 || requests[0].method != http.MethodPut || requests[0].path != "/v1/trace" ||
+		requests[1].method != http.MethodPost || requests[1].path != "/v1/close" {
+		t.Fatalf("expected the span to be started and closed but got %+v", requests)
+	}
+
+	var start, end message.TraceMessage
+	json.Unmarshal([]byte(requests[0].body), &start)
+	json.Unmarshal([]byte(requests[1].body), &end)
+
+	if start.TraceId != "5e27c67030932221" || start.ParentSpanId != "38357d8f309b379d" || start.Operation != "GET /data" {
+		t.Errorf("expected the trace of the caller to be continued %+v", start)
+	}
+	if end.SpanId != start.SpanId || end.Tags["http.status_code"] != "404" || end.Tags["http.url"] != "/data" {
+		t.Errorf("expected the span to be closed with the status %+v", end)
+	}
+	if outgoing.Get(TraceIDHeader) != start.TraceId || outgoing.Get(SpanIDHeader) != start.SpanId {
+		t.Errorf("expected the span to be propagated %+v", outgoing)
+	}
+}
+
+func TestHook(t *testing.T) {
+	fake := &fakeAgent{}
+	c, done := newTestClient(t, fake, Config{})
+	defer done()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(c.Hook(logrus.WarnLevel, logrus.ErrorLevel))
+
+	logger.Info("not forwarded")
+	logger.WithField("component", "db").Warn("connection lost")
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := fake.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected only the warning to be forwarded but got %+v", requests)
+	}
+	for _, part := range []string{"level=warning", `msg="connection lost"`, "component=db"} {
+		if !strings.Contains(requests[0].body, part) {
+			t.Errorf("expected %s in %s", part, requests[0].body)
+		}
+	}
+}
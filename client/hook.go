@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package client
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hook forwards logrus entries to /v1/log. Entries are queued, so logging never waits for the agent.
+type Hook struct {
+	client    *Client
+	levels    []logrus.Level
+	Formatter logrus.Formatter //format of the forwarded entries, text without colors by default
+}
+
+// Hook returns a hook for the given levels, or all levels if none are given
+func (c *Client) Hook(levels ...logrus.Level) *Hook {
+	if len(levels) == 0 {
+		levels = logrus.AllLevels
+	}
+	return &Hook{
+		client:    c,
+		levels:    levels,
+		Formatter: &logrus.TextFormatter{DisableColors: true},
+	}
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return h.levels
+}
+
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	line, err := h.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return h.client.QueueLog(strings.TrimRight(string(line), "\n"))
+}
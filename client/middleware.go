@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package client
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware traces every request handled by next. The span is named after the method and path and
+// continues the trace of the caller if the request carries B3 headers. Handlers find it with
+// SpanFromContext(req.Context()).
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parent, _ := Extract(req.Header)
+		span, ctx := c.StartSpanFrom(req.Context(), req.Method+" "+req.URL.Path, parent)
+		span.SetTag("http.method", req.Method)
+		span.SetTag("http.url", req.URL.Path) //the query may contain tokens or personal data
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if r := recover(); r != nil {
+				span.SetTag("error", "true")
+				span.SetTag("http.status_code", strconv.Itoa(http.StatusInternalServerError))
+				span.Finish()
+				panic(r)
+			}
+			span.SetTag("http.status_code", strconv.Itoa(recorder.status))
+			span.Finish()
+		}()
+
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+	})
+}
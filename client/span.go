@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/DITAS-Project/VDC-Logging-Agent/message"
+)
+
+// B3 headers used by zipkin to propagate a trace
+const (
+	TraceIDHeader      = "X-B3-TraceId"
+	SpanIDHeader       = "X-B3-SpanId"
+	ParentSpanIDHeader = "X-B3-ParentSpanId"
+	SampledHeader      = "X-B3-Sampled"
+)
+
+type spanKey struct{}
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Span is an operation traced by the agent. It is started and finished through the queue of the
+// client, so the order of both is kept without blocking the caller.
+type Span struct {
+	client *Client
+
+	lock     sync.Mutex
+	trace    message.TraceMessage
+	finished bool
+}
+
+// StartSpan starts a span, it is a child of the span in the context if there is one
+func (c *Client) StartSpan(ctx context.Context, operation string) (*Span, context.Context) {
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.Context()
+	}
+	return c.StartSpanFrom(ctx, operation, parent)
+}
+
+// StartSpanFrom starts a child of the given span, a new trace is started if the parent is empty
+func (c *Client) StartSpanFrom(ctx context.Context, operation string, parent SpanContext) (*Span, context.Context) {
+	trace := message.TraceMessage{
+		TraceId:      parent.TraceID,
+		ParentSpanId: parent.SpanID,
+		SpanId:       newID(),
+		Operation:    operation,
+	}
+	if trace.TraceId == "" {
+		trace.TraceId = newID()
+		trace.ParentSpanId = ""
+	}
+
+	span := &Span{client: c, trace: trace}
+	if err := c.enqueueJSON(http.MethodPut, "/v1/trace", trace); err != nil {
+		c.cnf.OnError(err)
+	}
+
+	return span, ContextWithSpan(ctx, span)
+}
+
+// Context returns the ids of the span
+func (s *Span) Context() SpanContext {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SpanContext{TraceID: s.trace.TraceId, SpanID: s.trace.SpanId}
+}
+
+// SetTag sets a tag that is sent when the span is finished
+func (s *Span) SetTag(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.trace.Tags == nil {
+		s.trace.Tags = make(map[string]string)
+	}
+	s.trace.Tags[key] = value
+}
+
+// Log adds a message to the span
+func (s *Span) Log(msg string) {
+	s.lock.Lock()
+	trace := s.trace
+	trace.Tags = nil
+	trace.Message = msg
+	s.lock.Unlock()
+
+	if err := s.client.enqueueJSON(http.MethodPut, "/v1/trace", trace); err != nil {
+		s.client.cnf.OnError(err)
+	}
+}
+
+// Finish closes the span with all tags, only the first call has an effect
+func (s *Span) Finish() {
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	trace := s.trace
+	s.lock.Unlock()
+
+	if err := s.client.enqueueJSON(http.MethodPost, "/v1/close", trace); err != nil {
+		s.client.cnf.OnError(err)
+	}
+}
+
+// ContextWithSpan returns a context carrying the span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span of the context or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Extract reads the B3 headers of a request
+func Extract(header http.Header) (SpanContext, bool) {
+	parent := SpanContext{
+		TraceID: header.Get(TraceIDHeader),
+		SpanID:  header.Get(SpanIDHeader),
+	}
+	return parent, parent.TraceID != "" && parent.SpanID != ""
+}
+
+// Inject writes the B3 headers of the span in the context, so the called service continues the trace
+func Inject(ctx context.Context, header http.Header) {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+
+	span.lock.Lock()
+	defer span.lock.Unlock()
+
+	header.Set(TraceIDHeader, span.trace.TraceId)
+	header.Set(SpanIDHeader, span.trace.SpanId)
+	if span.trace.ParentSpanId != "" {
+		header.Set(ParentSpanIDHeader, span.trace.ParentSpanId)
+	}
+	header.Set(SampledHeader, "1")
+}
+
+// newID returns a random 64 bit id in hex as used by zipkin
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -21,16 +21,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/DITAS-Project/VDC-Logging-Agent/agent"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
-	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
@@ -71,6 +70,15 @@ func main() {
 	viper.SetDefault("ElasticSearchURL", "http://127.0.0.1:9200")
 	viper.SetDefault("waitTime", time.Duration(1.5e+10))
 	viper.SetDefault("verbose", false)
+	viper.Set("Build", Build)
+	viper.SetDefault("Metadata.Hostname", true)
+	viper.SetDefault("Metadata.ContainerID", true)
+	viper.SetDefault("Metadata.Kubernetes", true)
+	viper.SetDefault("Metadata.Build", true)
+	viper.SetDefault("Metadata.BlueprintID", true)
+	viper.SetDefault("BlueprintPath", "/opt/blueprint/blueprint.json")
+
+	agent.BindEnvironment()
 
 	viper.RegisterAlias("zipkin", "ZipkinEndpoint")
 	viper.RegisterAlias("vdc", "Endpoint")
@@ -85,10 +93,16 @@ func main() {
 	flag.String("name", "vdc", "vdc name that this agent is paired with (used as the elastic search index)")
 	flag.String("elastic", "http://127.0.0.1:9200", "elastic search address")
 	flag.Bool("testing", false, "flag to usie the service in api testing mode")
+	flag.Bool("check-config", false, "validate the configuration, report all problems and exit")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
+	//flags named like an alias are only found if bound to the entry itself
+	viper.BindPFlag("ZipkinEndpoint", pflag.Lookup("zipkin"))
+	viper.BindPFlag("Endpoint", pflag.Lookup("vdc"))
+	viper.BindPFlag("VDCName", pflag.Lookup("name"))
+	viper.BindPFlag("ElasticSearchURL", pflag.Lookup("elastic"))
 
 	if viper.GetBool("verbose") {
 		logger.SetLevel(logrus.DebugLevel)
@@ -101,6 +115,15 @@ func main() {
 	agent.SetLogger(logger)
 	agent.SetLog(log)
 
+	if viper.GetBool("check-config") {
+		if _, err := agent.LoadConfiguration(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+		os.Exit(0)
+	}
+
 	agent, err := agent.NewAgent()
 
 	if err != nil {
@@ -108,52 +131,20 @@ func main() {
 		os.Exit(-1)
 	}
 
-	startServer(agent, viper.GetInt("Port"), viper.GetDuration("waitTime"))
-
-}
-
-func startServer(agent *agent.Agent, port int, waitTime time.Duration) {
-	//setup routing
-	apiRouter := mux.NewRouter()
-	apiRouter.NotFoundHandler = http.HandlerFunc(notFound)
-
-	v1 := apiRouter.PathPrefix("/v1").Subrouter()
-	v1.PathPrefix("/close").Methods("POST").Handler(http.HandlerFunc(agent.Close))
-	v1.PathPrefix("/trace").Methods("PUT").Handler(http.HandlerFunc(agent.Trace))
-
-	v1.PathPrefix("/meter").Methods("POST").Handler(http.HandlerFunc(agent.Meter))
-	v1.PathPrefix("/log").Methods("POST").Handler(http.HandlerFunc(agent.Log))
-
-	//start server
-	api := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      apiRouter,
-	}
+	agent.Watch()
 
+	//gracefull shutdown on ctrl-c and when the container is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		log.Infof("Listening on :%d", port)
-		if err := api.ListenAndServe(); err != nil {
-			log.Error(err)
-		}
+		<-c
+		cancel()
 	}()
 
-	//gracefull shutdown @see mux github.com
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-
-	<-c
-
-	ctx, cancel := context.WithTimeout(context.Background(), waitTime)
-	defer cancel()
-	agent.Shutdown()
-	api.Shutdown(ctx)
-	log.Info("shutting down")
-	os.Exit(0)
-}
-
-func notFound(w http.ResponseWriter, req *http.Request) {
-	log.Infof("request not found %+v", req.URL)
+	if err := agent.Run(ctx); err != nil {
+		log.Errorf("agent stopped %s", err)
+		os.Exit(-1)
+	}
+	log.Info("agent stopped, all data delivered")
 }
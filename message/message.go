@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018 Information Systems Engineering, TU Berlin, Germany
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *                  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * This is being developed for the DITAS Project: https://www.ditas-project.eu/
+ */
+
+// Package message contains the messages accepted by the agent api. It is shared by the agent and
+// the client, so VDCs using the client do not depend on the agent and its backends.
+package message
+
+import "time"
+
+type TraceMessage struct {
+	TraceId      string            `json:"traceId"`
+	ParentSpanId string            `json:"parentSpanId"`
+	SpanId       string            `json:"spanId"`
+	Operation    string            `json:"operation"`
+	Message      string            `json:"message"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+type MeterMessage struct {
+	Timestamp   time.Time   `json:"timestamp,omitempty"`
+	OperationID string      `json:"operationID,omitempty"`
+	Value       interface{} `json:"value,omitempty"`
+	Unit        string      `json:"unit,omitempty"`
+	Name        string      `json:"name,omitempty"`
+	Raw         string      `json:"appendix,omitempty"`
+}
+
+type LogMessage struct {
+	Timestamp time.Time     `json:"timestamp,omitempty"`
+	Value     string        `json:"value,omitempty"`
+	Level     string        `json:"level,omitempty"`
+	Source    string        `json:"source,omitempty"`
+	Syslog    *SyslogFields `json:"syslog,omitempty"`
+}
+
+type SyslogFields struct {
+	Facility       string                       `json:"facility,omitempty"`
+	Severity       string                       `json:"severity,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"appName,omitempty"`
+	ProcID         string                       `json:"procID,omitempty"`
+	MsgID          string                       `json:"msgID,omitempty"`
+	StructuredData map[string]map[string]string `json:"structuredData,omitempty"`
+}